@@ -0,0 +1,184 @@
+package pomegranate
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Finding describes a statement in a migration that is likely to hold heavy locks or rewrite a
+// table when run against a large table.
+type Finding struct {
+	Migration  string
+	Direction  string
+	Rule       string
+	Statement  string
+	Problem    string
+	Suggestion string
+}
+
+// analyzerRule matches statements starting with prefix, by their upper-cased head as returned by
+// statementHead.  The pg_query analyzer only uses its name, problem and suggestion.
+type analyzerRule struct {
+	name       string
+	prefix     string
+	pattern    *regexp.Regexp
+	unless     *regexp.Regexp
+	problem    string
+	suggestion string
+}
+
+// analyzerRules are checked by AnalyzeMigrations.  Their names may be given to a "-- pmg:allow"
+// directive.
+var analyzerRules = []analyzerRule{
+	{
+		name:       "create-index-concurrently",
+		prefix:     "CREATE ",
+		pattern:    regexp.MustCompile(`^CREATE (UNIQUE )?INDEX\b`),
+		unless:     regexp.MustCompile(`^CREATE (UNIQUE )?INDEX CONCURRENTLY\b`),
+		problem:    "CREATE INDEX blocks writes to the table until the index is built.",
+		suggestion: "Use CREATE INDEX CONCURRENTLY, in a migration file of its own without BEGIN and COMMIT.",
+	},
+	{
+		name:       "volatile-default",
+		prefix:     "ALTER TABLE ",
+		pattern:    regexp.MustCompile(`\bADD (COLUMN )?(IF NOT EXISTS )?\S+ ((SMALL|BIG)?SERIAL\d?\b|[^,]*\bDEFAULT (RANDOM|CLOCK_TIMESTAMP|TIMEOFDAY|GEN_RANDOM_UUID|UUID_GENERATE_V\w+|NEXTVAL) ?\()`),
+		problem:    "Adding a column with a volatile default rewrites the whole table while holding an ACCESS EXCLUSIVE lock.",
+		suggestion: "Add the column without a default, set the default in a separate statement, and backfill existing rows in batches.",
+	},
+	{
+		name:       "alter-column-type",
+		prefix:     "ALTER TABLE ",
+		pattern:    regexp.MustCompile(`\bALTER (COLUMN )?\S+ (SET DATA )?TYPE\b`),
+		problem:    "Changing a column's type usually rewrites the table and its indexes while holding an ACCESS EXCLUSIVE lock.",
+		suggestion: "Add a new column with the new type, backfill it in batches, and switch over to it.",
+	},
+	{
+		name:       "foreign-key-not-valid",
+		prefix:     "ALTER TABLE ",
+		pattern:    regexp.MustCompile(`\bADD (CONSTRAINT \S+ )?FOREIGN KEY\b`),
+		unless:     regexp.MustCompile(`\bNOT VALID\b`),
+		problem:    "Adding a foreign key checks every existing row while blocking writes to both tables.",
+		suggestion: "Add the constraint with NOT VALID, then run ALTER TABLE ... VALIDATE CONSTRAINT in a later migration.",
+	},
+	{
+		name:       "set-not-null",
+		prefix:     "ALTER TABLE ",
+		pattern:    regexp.MustCompile(`\bALTER (COLUMN )?\S+ SET NOT NULL\b`),
+		problem:    "SET NOT NULL scans the whole table while holding an ACCESS EXCLUSIVE lock.",
+		suggestion: "Add a CHECK (column IS NOT NULL) NOT VALID constraint and validate it first; Postgres 12 and later then skip the scan.",
+	},
+}
+
+// createTablePattern matches the head of a CREATE TABLE statement.
+var createTablePattern = regexp.MustCompile(`^CREATE (UNLOGGED |TEMP |TEMPORARY )?TABLE\b`)
+
+// tableNamePattern finds the table a statement creates or changes.
+var tableNamePattern = regexp.MustCompile(`^(?:CREATE (?:UNLOGGED |TEMP |TEMPORARY )?TABLE|ALTER TABLE|CREATE (?:UNIQUE )?INDEX(?: CONCURRENTLY)?(?: IF NOT EXISTS)?(?: \S+)? ON)(?: IF (?:NOT )?EXISTS)?(?: ONLY)? ([^\s(]+)`)
+
+// AnalyzeMigrations checks the forward and backward SQL of each migration for statements that are
+// likely to hold heavy locks or rewrite a table when run against a large table.  Statements on
+// tables created earlier in the same file are not reported, since those tables are still empty.
+// A finding can be suppressed by putting a "-- pmg:allow <rule name>" comment in the statement,
+// usually on the line above it.
+//
+// Statements are parsed with the Postgres parser from github.com/pganalyze/pg_query_go, which
+// also checks the bodies of DO blocks and SQL and PL/pgSQL functions, REFERENCES clauses on added
+// columns, and every clause of an ALTER TABLE.  Statements the parser rejects fall back to a
+// keyword-based check.  The parser needs cgo; built without it, or with the no_pg_query tag,
+// only the keyword check is run, which can miss dangerous statements hidden inside functions or
+// DO blocks.  Analyzer says which is in use.
+func AnalyzeMigrations(migrations []Migration) []Finding {
+	findings := []Finding{}
+	for _, mig := range migrations {
+		findings = append(findings, analyzeSQL(mig.Name, "forward", mig.ForwardSQL)...)
+		findings = append(findings, analyzeSQL(mig.Name, "backward", mig.BackwardSQL)...)
+	}
+	return findings
+}
+
+// violation is a rule broken by a statement, on the named table if it is known.
+type violation struct {
+	rule  string
+	table string
+}
+
+// statementCheck is what checkStatement found in a statement: the tables it creates, and the
+// rules it breaks.
+type statementCheck struct {
+	created    []string
+	violations []violation
+}
+
+func analyzeSQL(name, direction string, sqls []string) []Finding {
+	findings := []Finding{}
+	for _, sql := range sqls {
+		created := map[string]bool{}
+		for _, stmt := range splitStatements(sql) {
+			check := checkStatement(stmt)
+			allowed := map[string]bool{}
+			for _, d := range getDirectives("allow", []string{stmt}) {
+				for _, rule := range strings.Fields(d) {
+					allowed[rule] = true
+				}
+			}
+			for _, v := range check.violations {
+				if allowed[v.rule] || created[v.table] {
+					continue
+				}
+				rule := analyzerRuleNamed(v.rule)
+				findings = append(findings, Finding{
+					Migration:  name,
+					Direction:  direction,
+					Rule:       rule.name,
+					Statement:  stmt,
+					Problem:    rule.problem,
+					Suggestion: rule.suggestion,
+				})
+			}
+			for _, table := range check.created {
+				created[table] = true
+			}
+		}
+	}
+	return findings
+}
+
+func analyzerRuleNamed(name string) analyzerRule {
+	for _, rule := range analyzerRules {
+		if rule.name == name {
+			return rule
+		}
+	}
+	return analyzerRule{name: name}
+}
+
+// keywordCheck checks a statement by matching the keywords in its head against analyzerRules.
+// CREATE TABLE statements are not checked, since the table they create is empty.
+func keywordCheck(stmt string) statementCheck {
+	head := statementHead(stmt)
+	table := statementTable(head)
+	if createTablePattern.MatchString(head) {
+		return statementCheck{created: []string{table}}
+	}
+	var c statementCheck
+	for _, rule := range analyzerRules {
+		if !strings.HasPrefix(head, rule.prefix) || !rule.pattern.MatchString(head) {
+			continue
+		}
+		if rule.unless != nil && rule.unless.MatchString(head) {
+			continue
+		}
+		c.violations = append(c.violations, violation{rule: rule.name, table: table})
+	}
+	return c
+}
+
+// statementTable returns the name of the table that a CREATE TABLE, ALTER TABLE or CREATE INDEX
+// statement head refers to, without a "PUBLIC." schema or quotes, or an empty string.
+func statementTable(head string) string {
+	m := tableNamePattern.FindStringSubmatch(head)
+	if m == nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ReplaceAll(m[1], `"`, ""), "PUBLIC.")
+}
@@ -0,0 +1,12 @@
+//go:build !cgo || no_pg_query
+
+package pomegranate
+
+// Analyzer names the check that AnalyzeMigrations runs on each statement.
+const Analyzer = "keyword check"
+
+// checkStatement checks a statement with keywordCheck.  This is only used when cgo is disabled or
+// the no_pg_query tag is set; otherwise statements are parsed with the Postgres parser.
+func checkStatement(stmt string) statementCheck {
+	return keywordCheck(stmt)
+}
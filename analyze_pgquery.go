@@ -0,0 +1,284 @@
+//go:build cgo && !no_pg_query
+
+package pomegranate
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	pg_query "github.com/pganalyze/pg_query_go/v5"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Analyzer names the check that AnalyzeMigrations runs on each statement.
+const Analyzer = "Postgres parser (pg_query)"
+
+// serialTypes are the pseudo-types that give a column a default from a new sequence.
+var serialTypes = map[string]bool{
+	"smallserial": true, "serial": true, "bigserial": true,
+	"serial2": true, "serial4": true, "serial8": true,
+}
+
+// volatileFunctions are the functions that make a column default volatile, so that adding the
+// column has to write a value into every row.
+var volatileFunctions = map[string]bool{
+	"random": true, "clock_timestamp": true, "timeofday": true, "gen_random_uuid": true,
+	"uuid_generate_v1": true, "uuid_generate_v1mc": true, "uuid_generate_v4": true, "nextval": true,
+}
+
+// checkStatement parses a statement with the Postgres parser and checks it against
+// analyzerRules.  Statements the parser rejects are checked with keywordCheck.
+func checkStatement(stmt string) statementCheck {
+	tree, err := pg_query.Parse(stmt)
+	if err != nil {
+		return keywordCheck(stmt)
+	}
+	var c statementCheck
+	for _, raw := range tree.Stmts {
+		check := checkNode(stmt, raw.Stmt)
+		c.created = append(c.created, check.created...)
+		c.violations = append(c.violations, check.violations...)
+	}
+	return c
+}
+
+// checkNode checks a parsed statement.  stmt is its SQL, which PL/pgSQL function bodies are
+// parsed from.
+func checkNode(stmt string, node *pg_query.Node) statementCheck {
+	var c statementCheck
+	switch n := node.Node.(type) {
+	case *pg_query.Node_CreateStmt:
+		c.created = append(c.created, relationName(n.CreateStmt.Relation))
+	case *pg_query.Node_CreateTableAsStmt:
+		if n.CreateTableAsStmt.Objtype == pg_query.ObjectType_OBJECT_TABLE {
+			c.created = append(c.created, relationName(n.CreateTableAsStmt.Into.Rel))
+		}
+	case *pg_query.Node_IndexStmt:
+		if !n.IndexStmt.Concurrent {
+			c.violations = append(c.violations, violation{"create-index-concurrently", relationName(n.IndexStmt.Relation)})
+		}
+	case *pg_query.Node_AlterTableStmt:
+		if n.AlterTableStmt.Objtype != pg_query.ObjectType_OBJECT_TABLE {
+			break
+		}
+		table := relationName(n.AlterTableStmt.Relation)
+		for _, cmd := range n.AlterTableStmt.Cmds {
+			for _, rule := range alterTableRules(cmd.GetAlterTableCmd()) {
+				c.violations = append(c.violations, violation{rule, table})
+			}
+		}
+	case *pg_query.Node_DoStmt:
+		language, body := "plpgsql", ""
+		for _, arg := range n.DoStmt.Args {
+			switch d := arg.GetDefElem(); d.Defname {
+			case "language":
+				language = d.Arg.GetString_().Sval
+			case "as":
+				body = d.Arg.GetString_().Sval
+			}
+		}
+		if language == "plpgsql" {
+			c.addChecks(checkPlpgsql(wrapDoBody(body)))
+		}
+	case *pg_query.Node_CreateFunctionStmt:
+		if n.CreateFunctionStmt.SqlBody != nil {
+			checks := []statementCheck{}
+			for _, body := range listNodes(n.CreateFunctionStmt.SqlBody) {
+				checks = append(checks, checkNode(stmt, body))
+			}
+			c.addChecks(checks)
+			break
+		}
+		language, body := "", ""
+		for _, opt := range n.CreateFunctionStmt.Options {
+			switch d := opt.GetDefElem(); d.Defname {
+			case "language":
+				language = d.Arg.GetString_().Sval
+			case "as":
+				if items := d.Arg.GetList().GetItems(); len(items) > 0 {
+					body = items[0].GetString_().Sval
+				}
+			}
+		}
+		switch language {
+		case "plpgsql":
+			c.addChecks(checkPlpgsql(stmt))
+		case "sql":
+			checks := []statementCheck{}
+			for _, s := range splitStatements(body) {
+				checks = append(checks, checkStatement(s))
+			}
+			c.addChecks(checks)
+		}
+	}
+	return c
+}
+
+// addChecks appends the results of checking a list of statements in order, leaving out rules
+// broken on tables that an earlier statement in the list created.
+func (c *statementCheck) addChecks(checks []statementCheck) {
+	created := map[string]bool{}
+	for _, check := range checks {
+		for _, v := range check.violations {
+			if !created[v.table] {
+				c.violations = append(c.violations, v)
+			}
+		}
+		for _, table := range check.created {
+			created[table] = true
+			c.created = append(c.created, table)
+		}
+	}
+}
+
+// alterTableRules returns the names of the rules that one clause of an ALTER TABLE breaks.
+func alterTableRules(cmd *pg_query.AlterTableCmd) []string {
+	rules := []string{}
+	switch cmd.Subtype {
+	case pg_query.AlterTableType_AT_AddColumn:
+		col := cmd.Def.GetColumnDef()
+		volatile := serialTypes[lastName(col.GetTypeName().GetNames())]
+		foreignKey := false
+		for _, node := range col.GetConstraints() {
+			con := node.GetConstraint()
+			switch con.Contype {
+			case pg_query.ConstrType_CONSTR_DEFAULT:
+				volatile = volatile || hasVolatileCall(con.RawExpr)
+			case pg_query.ConstrType_CONSTR_FOREIGN:
+				foreignKey = true
+			}
+		}
+		if volatile {
+			rules = append(rules, "volatile-default")
+		}
+		if foreignKey {
+			rules = append(rules, "foreign-key-not-valid")
+		}
+	case pg_query.AlterTableType_AT_AlterColumnType:
+		rules = append(rules, "alter-column-type")
+	case pg_query.AlterTableType_AT_AddConstraint:
+		con := cmd.Def.GetConstraint()
+		if con.Contype == pg_query.ConstrType_CONSTR_FOREIGN && !con.SkipValidation {
+			rules = append(rules, "foreign-key-not-valid")
+		}
+	case pg_query.AlterTableType_AT_SetNotNull:
+		rules = append(rules, "set-not-null")
+	}
+	return rules
+}
+
+// checkPlpgsql checks the SQL statements in the body of a CREATE FUNCTION statement for a
+// PL/pgSQL function.  Statements run with EXECUTE can't be checked.
+func checkPlpgsql(createFunction string) []statementCheck {
+	out, err := pg_query.ParsePlPgSqlToJSON(createFunction)
+	if err != nil {
+		return nil
+	}
+	var tree interface{}
+	if err := json.Unmarshal([]byte(out), &tree); err != nil {
+		return nil
+	}
+	checks := []statementCheck{}
+	for _, query := range plpgsqlQueries(tree) {
+		checks = append(checks, checkStatement(query))
+	}
+	return checks
+}
+
+// plpgsqlQueries returns the SQL of the statements in a parsed PL/pgSQL function, in the order
+// they appear.
+func plpgsqlQueries(tree interface{}) []string {
+	queries := []string{}
+	switch t := tree.(type) {
+	case []interface{}:
+		for _, item := range t {
+			queries = append(queries, plpgsqlQueries(item)...)
+		}
+	case map[string]interface{}:
+		if execsql, ok := t["PLpgSQL_stmt_execsql"].(map[string]interface{}); ok {
+			sqlstmt, _ := execsql["sqlstmt"].(map[string]interface{})
+			expr, _ := sqlstmt["PLpgSQL_expr"].(map[string]interface{})
+			if query, ok := expr["query"].(string); ok {
+				queries = append(queries, query)
+			}
+			return queries
+		}
+		keys := []string{}
+		for key := range t {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			queries = append(queries, plpgsqlQueries(t[key])...)
+		}
+	}
+	return queries
+}
+
+// wrapDoBody turns the body of a DO block into a CREATE FUNCTION statement, so that it can be
+// parsed as PL/pgSQL.
+func wrapDoBody(body string) string {
+	tag := "$pmg$"
+	for strings.Contains(body, tag) {
+		tag = "$pmg" + tag[1:]
+	}
+	return "CREATE FUNCTION pmg_do() RETURNS void LANGUAGE plpgsql AS " + tag + body + tag
+}
+
+// listNodes flattens the nested lists in the body of a BEGIN ATOMIC function into its statements.
+func listNodes(node *pg_query.Node) []*pg_query.Node {
+	list := node.GetList()
+	if list == nil {
+		return []*pg_query.Node{node}
+	}
+	nodes := []*pg_query.Node{}
+	for _, item := range list.Items {
+		nodes = append(nodes, listNodes(item)...)
+	}
+	return nodes
+}
+
+// hasVolatileCall reports whether an expression calls any of volatileFunctions.
+func hasVolatileCall(node *pg_query.Node) bool {
+	if node == nil {
+		return false
+	}
+	found := false
+	var walk func(m protoreflect.Message)
+	walk = func(m protoreflect.Message) {
+		if call, ok := m.Interface().(*pg_query.FuncCall); ok && volatileFunctions[lastName(call.Funcname)] {
+			found = true
+		}
+		m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+			switch {
+			case fd.Message() == nil || fd.IsMap():
+			case fd.IsList():
+				for i := 0; i < v.List().Len(); i++ {
+					walk(v.List().Get(i).Message())
+				}
+			default:
+				walk(v.Message())
+			}
+			return !found
+		})
+	}
+	walk(node.ProtoReflect())
+	return found
+}
+
+// lastName returns the last part of a qualified name, such as a function or type name.
+func lastName(names []*pg_query.Node) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return names[len(names)-1].GetString_().Sval
+}
+
+// relationName returns the name of a table, with its schema unless that is public.
+func relationName(rel *pg_query.RangeVar) string {
+	if rel.GetSchemaname() == "" || rel.GetSchemaname() == "public" {
+		return rel.GetRelname()
+	}
+	return rel.Schemaname + "." + rel.Relname
+}
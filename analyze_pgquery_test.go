@@ -0,0 +1,73 @@
+//go:build cgo && !no_pg_query
+
+package pomegranate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyzeParsed(t *testing.T) {
+	tt := []struct {
+		desc  string
+		sql   string
+		rules []string
+	}{
+		{
+			desc:  "second clause of an alter table",
+			sql:   "ALTER TABLE foo ADD COLUMN note text, ALTER COLUMN bar SET NOT NULL;",
+			rules: []string{"set-not-null"},
+		},
+		{
+			desc:  "inline references on an added column",
+			sql:   "ALTER TABLE foo ADD COLUMN bar_id int REFERENCES bar (id);",
+			rules: []string{"foreign-key-not-valid"},
+		},
+		{
+			desc:  "volatile default inside an expression",
+			sql:   "ALTER TABLE foo ADD COLUMN jitter int DEFAULT (random() * 10)::int;",
+			rules: []string{"volatile-default"},
+		},
+		{
+			desc:  "quoted identifiers",
+			sql:   "CREATE TABLE \"Foo\" (bar int);\nCREATE INDEX foo_bar ON \"Foo\" (bar);\nCREATE INDEX foo_baz ON foo (baz);",
+			rules: []string{"create-index-concurrently"},
+		},
+		{
+			desc:  "do block",
+			sql:   "DO $$\nBEGIN\n  IF true THEN\n    ALTER TABLE foo ALTER COLUMN bar TYPE bigint;\n  END IF;\nEND\n$$;",
+			rules: []string{"alter-column-type"},
+		},
+		{
+			desc:  "do block creating its own table",
+			sql:   "DO $$\nBEGIN\n  CREATE TABLE scratch (id int);\n  CREATE INDEX scratch_id ON scratch (id);\nEND\n$$;",
+			rules: []string{},
+		},
+		{
+			desc:  "plpgsql function body",
+			sql:   "CREATE FUNCTION add_index() RETURNS void AS $$\nBEGIN\n  CREATE INDEX foo_bar ON foo (bar);\nEND;\n$$ LANGUAGE plpgsql;",
+			rules: []string{"create-index-concurrently"},
+		},
+		{
+			desc:  "sql function body",
+			sql:   "CREATE FUNCTION add_fk() RETURNS void LANGUAGE sql AS 'ALTER TABLE foo ADD FOREIGN KEY (bar) REFERENCES bar (id)';",
+			rules: []string{"foreign-key-not-valid"},
+		},
+		{
+			desc:  "unparseable statement falls back to keywords",
+			sql:   "CREATE INDEX foo_bar ON foo (bar) WITH WITH;",
+			rules: []string{"create-index-concurrently"},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			findings := AnalyzeMigrations([]Migration{{Name: "00002_foo", ForwardSQL: []string{tc.sql}}})
+			rules := []string{}
+			for _, f := range findings {
+				rules = append(rules, f.Rule)
+			}
+			assert.Equal(t, tc.rules, rules)
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package pomegranate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyzeMigrations(t *testing.T) {
+	tt := []struct {
+		desc  string
+		sql   string
+		rules []string
+	}{
+		{
+			desc:  "create index",
+			sql:   "BEGIN;\nCREATE INDEX foo_bar ON foo (bar);\nCOMMIT;",
+			rules: []string{"create-index-concurrently"},
+		},
+		{
+			desc:  "create unique index concurrently",
+			sql:   "CREATE UNIQUE INDEX CONCURRENTLY foo_bar ON foo (bar);",
+			rules: []string{},
+		},
+		{
+			desc:  "index on a table created in the same file",
+			sql:   "CREATE TABLE public.\"Foo\" (bar int);\nCREATE INDEX foo_bar ON \"Foo\" (bar);",
+			rules: []string{},
+		},
+		{
+			desc:  "volatile default",
+			sql:   "ALTER TABLE foo ADD COLUMN token uuid NOT NULL DEFAULT gen_random_uuid();",
+			rules: []string{"volatile-default"},
+		},
+		{
+			desc:  "serial column",
+			sql:   "alter table foo add column seq bigserial;",
+			rules: []string{"volatile-default"},
+		},
+		{
+			desc:  "constant default",
+			sql:   "ALTER TABLE foo ADD COLUMN status text NOT NULL DEFAULT 'new', ADD COLUMN created timestamptz DEFAULT now();",
+			rules: []string{},
+		},
+		{
+			desc:  "alter column type",
+			sql:   "ALTER TABLE foo ALTER COLUMN bar TYPE bigint;\nALTER TABLE foo ALTER baz SET DATA TYPE text;",
+			rules: []string{"alter-column-type", "alter-column-type"},
+		},
+		{
+			desc:  "foreign key",
+			sql:   "ALTER TABLE foo ADD CONSTRAINT foo_bar_fk FOREIGN KEY (bar) REFERENCES bar (id);",
+			rules: []string{"foreign-key-not-valid"},
+		},
+		{
+			desc:  "foreign key not valid",
+			sql:   "ALTER TABLE foo ADD CONSTRAINT foo_bar_fk FOREIGN KEY (bar) REFERENCES bar (id) NOT VALID;\nALTER TABLE foo VALIDATE CONSTRAINT foo_bar_fk;",
+			rules: []string{},
+		},
+		{
+			desc:  "set not null",
+			sql:   "ALTER TABLE foo ALTER COLUMN bar SET NOT NULL;",
+			rules: []string{"set-not-null"},
+		},
+		{
+			desc:  "allowed",
+			sql:   "-- foo is tiny\n-- pmg:allow create-index-concurrently\nCREATE INDEX foo_bar ON foo (bar);\nCREATE INDEX foo_baz ON foo (baz);",
+			rules: []string{"create-index-concurrently"},
+		},
+		{
+			desc:  "keywords in strings and comments",
+			sql:   "/* CREATE INDEX foo_bar ON foo (bar); */\nINSERT INTO notes VALUES ('ALTER TABLE foo ALTER bar TYPE int');",
+			rules: []string{},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			findings := AnalyzeMigrations([]Migration{{Name: "00002_foo", ForwardSQL: []string{tc.sql}}})
+			rules := []string{}
+			for _, f := range findings {
+				assert.Equal(t, "00002_foo", f.Migration)
+				assert.Equal(t, "forward", f.Direction)
+				rules = append(rules, f.Rule)
+			}
+			assert.Equal(t, tc.rules, rules)
+		})
+	}
+}
+
+func TestAnalyzeBackward(t *testing.T) {
+	findings := AnalyzeMigrations([]Migration{{
+		Name:        "00002_foo",
+		ForwardSQL:  []string{"ALTER TABLE foo DROP COLUMN bar;"},
+		BackwardSQL: []string{"ALTER TABLE foo ADD COLUMN bar int;\nCREATE INDEX foo_bar ON foo (bar);"},
+	}})
+	assert.Equal(t, 1, len(findings))
+	assert.Equal(t, "backward", findings[0].Direction)
+	assert.Equal(t, "CREATE INDEX foo_bar ON foo (bar)", findings[0].Statement)
+}
+
+func TestStatementTable(t *testing.T) {
+	assert.Equal(t, "FOO", statementTable("CREATE TABLE IF NOT EXISTS PUBLIC.FOO(ID INT)"))
+	assert.Equal(t, "FOO", statementTable("ALTER TABLE ONLY FOO ADD COLUMN BAR INT"))
+	assert.Equal(t, "FOO", statementTable("CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS FOO_BAR ON FOO USING BTREE (BAR)"))
+	assert.Equal(t, "", statementTable("SELECT 1"))
+}
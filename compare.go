@@ -0,0 +1,98 @@
+package pomegranate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// EnvironmentState is the migration state of the database for one environment, like "staging".
+type EnvironmentState struct {
+	Environment string
+	State       []MigrationRecord
+}
+
+// Comparison is one row of the matrix returned by CompareEnvironments: a migration, and whether
+// it has been applied in each environment.  OnDisk is false for migrations that are only in the
+// environments' state.  Environments is in the same order as the states that were compared.
+type Comparison struct {
+	Name         string
+	OnDisk       bool
+	Environments []EnvironmentComparison
+}
+
+// EnvironmentComparison is whether a migration has been applied in one environment.  OutOfOrder
+// is set if it was applied before a migration it depends on, or while one of those is still
+// missing.  Without "-- pmg:depends_on" lines, each migration depends on the one before it.
+type EnvironmentComparison struct {
+	Applied    bool
+	Time       time.Time
+	OutOfOrder bool
+}
+
+// GetEnvironmentStateContext returns the migration state of db, for comparing with other
+// environments.  Like the Migrate functions, it only includes the state of the migration set that
+// allMigrations belongs to.
+func GetEnvironmentStateContext(ctx context.Context, env string, db Database, allMigrations []Migration) (EnvironmentState, error) {
+	state, err := getSetStateContext(ctx, db, allMigrations)
+	if err != nil {
+		return EnvironmentState{}, fmt.Errorf("could not get migration state for %s: %v", env, err)
+	}
+	return EnvironmentState{Environment: env, State: state}, nil
+}
+
+// CompareEnvironments returns a matrix of migrations against environments: first the migrations
+// in allMigrations, in order, and then those found only in the environments' state, by name.
+func CompareEnvironments(allMigrations []Migration, envs []EnvironmentState) ([]Comparison, error) {
+	deps, err := migrationDependencies(allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	applied := make([]map[string]MigrationRecord, len(envs))
+	extra := map[string]bool{}
+	for i, env := range envs {
+		state, err := CollapseReplacedState(env.State, allMigrations)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", env.Environment, err)
+		}
+		applied[i] = map[string]MigrationRecord{}
+		for _, rec := range state {
+			applied[i][rec.Name] = rec
+			if !nameInMigrationList(rec.Name, allMigrations) {
+				extra[rec.Name] = true
+			}
+		}
+	}
+
+	comparisons := []Comparison{}
+	for _, mig := range allMigrations {
+		c := Comparison{Name: mig.Name, OnDisk: true}
+		for i := range envs {
+			rec, ok := applied[i][mig.Name]
+			ec := EnvironmentComparison{Applied: ok, Time: rec.Time}
+			for _, dep := range deps[mig.Name] {
+				depRec, depOK := applied[i][dep]
+				if ok && (!depOK || rec.Time.Before(depRec.Time)) {
+					ec.OutOfOrder = true
+				}
+			}
+			c.Environments = append(c.Environments, ec)
+		}
+		comparisons = append(comparisons, c)
+	}
+	names := []string{}
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := Comparison{Name: name}
+		for i := range envs {
+			rec, ok := applied[i][name]
+			c.Environments = append(c.Environments, EnvironmentComparison{Applied: ok, Time: rec.Time})
+		}
+		comparisons = append(comparisons, c)
+	}
+	return comparisons, nil
+}
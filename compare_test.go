@@ -0,0 +1,55 @@
+package pomegranate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// timedState makes a MigrationRecord for each name, applied an hour apart in the order given.
+func timedState(names ...string) []MigrationRecord {
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	state := []MigrationRecord{}
+	for i, name := range names {
+		state = append(state, MigrationRecord{Name: name, Time: start.Add(time.Duration(i) * time.Hour)})
+	}
+	return state
+}
+
+func TestCompareEnvironments(t *testing.T) {
+	migs := namesToMigs([]string{"a", "b", "c"})
+	envs := []EnvironmentState{
+		{Environment: "dev", State: timedState("a", "b", "c", "d_experiment")},
+		{Environment: "staging", State: timedState("a", "c", "b")},
+		{Environment: "prod", State: timedState("a", "c")},
+	}
+	comparisons, err := CompareEnvironments(migs, envs)
+	assert.Nil(t, err)
+
+	type cell struct{ applied, outOfOrder bool }
+	matrix := map[string][]cell{}
+	for _, c := range comparisons {
+		for _, ec := range c.Environments {
+			matrix[c.Name] = append(matrix[c.Name], cell{ec.Applied, ec.OutOfOrder})
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d_experiment"}, []string{
+		comparisons[0].Name, comparisons[1].Name, comparisons[2].Name, comparisons[3].Name,
+	})
+	assert.False(t, comparisons[3].OnDisk)
+	assert.Equal(t, []cell{{true, false}, {true, false}, {true, false}}, matrix["a"])
+	assert.Equal(t, []cell{{true, false}, {true, false}, {false, false}}, matrix["b"])
+	// c was applied before b in staging, and without it in prod
+	assert.Equal(t, []cell{{true, false}, {true, true}, {true, true}}, matrix["c"])
+	assert.Equal(t, []cell{{true, false}, {false, false}, {false, false}}, matrix["d_experiment"])
+}
+
+func TestCompareEnvironmentsDependencies(t *testing.T) {
+	migs := depsToMigs([]string{"a", "b", "c"}, map[string]string{"c": "a"})
+	comparisons, err := CompareEnvironments(migs, []EnvironmentState{{Environment: "prod", State: timedState("a", "c")}})
+	assert.Nil(t, err)
+	for _, c := range comparisons {
+		assert.False(t, c.Environments[0].OutOfOrder, c.Name)
+	}
+}
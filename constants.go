@@ -3,8 +3,9 @@ package pomegranate
 const leadingDigits = 5
 const timestampFormat = "20060102150405"
 
-const initForwardTmpl = `BEGIN;
-CREATE TABLE migration_state (
+// initBookkeepingSQL creates the tables, function and trigger pomegranate uses to keep track of
+// migrations, including the table for stored backward SQL.
+const initBookkeepingSQL = `CREATE TABLE migration_state (
 	name TEXT NOT NULL,
 	time TIMESTAMP WITH TIME ZONE DEFAULT now() NOT NULL,
 	who TEXT DEFAULT CURRENT_USER NOT NULL,
@@ -40,6 +41,11 @@ $$ language plpgsql;
 CREATE TRIGGER record_migration AFTER INSERT OR UPDATE OR DELETE ON migration_state
   FOR EACH ROW EXECUTE PROCEDURE record_migration();
 
+` + backwardStoreSQL + `
+`
+
+const initForwardTmpl = `BEGIN;
+` + initBookkeepingSQL + `
 INSERT INTO migration_state(name) VALUES ('%s');
 COMMIT;
 `
@@ -55,6 +61,105 @@ SELECT no_rollback();
 COMMIT;
 `
 
+// backwardStoreSQL creates the table in which pomegranate keeps a copy of each
+// applied migration's BackwardSQL, so it can be rolled back even when the
+// source for it is no longer available.  New databases get it from the init
+// migration; older ones have it created the first time a migration is stored.
+const backwardStoreSQL = `CREATE TABLE IF NOT EXISTS migration_backward (
+	name TEXT NOT NULL,
+	backward_sql TEXT[] NOT NULL,
+	checksum TEXT NOT NULL,
+	time TIMESTAMP WITH TIME ZONE DEFAULT now() NOT NULL,
+	PRIMARY KEY (name)
+);`
+
+// repeatableStoreSQL creates the table in which pomegranate records the checksum of each
+// repeatable migration it has applied.
+const repeatableStoreSQL = `CREATE TABLE IF NOT EXISTS migration_repeatable (
+	name TEXT NOT NULL,
+	checksum TEXT NOT NULL,
+	time TIMESTAMP WITH TIME ZONE DEFAULT now() NOT NULL,
+	who TEXT DEFAULT CURRENT_USER NOT NULL,
+	PRIMARY KEY (name)
+);`
+
+// skippedStoreSQL creates the table in which pomegranate records migrations that were skipped
+// because they are tagged for other environments.
+const skippedStoreSQL = `CREATE TABLE IF NOT EXISTS migration_skipped (
+	name TEXT NOT NULL,
+	environment TEXT NOT NULL,
+	time TIMESTAMP WITH TIME ZONE DEFAULT now() NOT NULL,
+	PRIMARY KEY (name)
+);`
+
+// bookkeepingTables are the tables pomegranate itself creates.  They, and the objects that belong
+// to them, are left out of baselines.
+var bookkeepingTables = []string{
+	"public.migration_state",
+	"public.migration_log",
+	"public.migration_backward",
+	"public.migration_repeatable",
+	"public.migration_skipped",
+}
+
+// bookkeepingObjects are the other objects created by the init migration.
+var bookkeepingObjects = []string{
+	"public.migration_log_id_seq",
+	"public.record_migration()",
+}
+
+const baselineForwardTmpl = `BEGIN;
+-- This migration was generated by "pmg baseline" from the schema of an existing database.
+SET LOCAL check_function_bodies = false;
+
+%s
+INSERT INTO migration_state(name) VALUES ('%s');
+COMMIT;
+`
+
+const baselineBackwardTmpl = `BEGIN;
+CREATE OR REPLACE FUNCTION no_rollback() RETURNS void AS $$
+BEGIN
+  RAISE 'Will not roll back %s.  It was generated from an existing schema.';
+END;
+$$ LANGUAGE plpgsql;
+
+SELECT no_rollback();
+COMMIT;
+`
+
+const squashForwardTmpl = `BEGIN;
+-- This migration was generated by "pmg squash" from the schema produced by the migrations below,
+-- which have been moved to the archive directory.
+%s
+SET LOCAL check_function_bodies = false;
+
+` + initBookkeepingSQL + `
+%s
+INSERT INTO migration_state(name) VALUES ('%s');
+COMMIT;
+`
+
+const squashBackwardTmpl = `BEGIN;
+CREATE OR REPLACE FUNCTION no_rollback() RETURNS void AS $$
+BEGIN
+  RAISE 'Will not roll back %s.  It replaces squashed migrations.';
+END;
+$$ LANGUAGE plpgsql;
+
+SELECT no_rollback();
+COMMIT;
+`
+
+const schemaFileHeader = `-- Schema snapshot generated by pmg. DO NOT EDIT.
+-- Regenerate it with "pmg schema dump", or "pmg forward --schema-file".
+
+`
+
+// directivePrefix starts a comment line in a migration's SQL that pomegranate reads as an
+// instruction, e.g. "-- pmg:replaces 00001_init".
+const directivePrefix = "-- pmg:"
+
 const forwardTmpl = `BEGIN;
 -- vvvvvvvv PUT FORWARD MIGRATION CODE BELOW HERE vvvvvvvv
 
@@ -75,6 +180,15 @@ DELETE FROM migration_state WHERE name='%s';
 COMMIT;
 `
 
+const scriptHeaderTmpl = `-- Generated by pmg. %s migrations %s through %s.
+-- Run with: psql -f <this file>
+\set ON_ERROR_STOP on
+`
+
+const scriptMigrationTmpl = `
+-- ======== %s (%s) ========
+`
+
 const srcTmpl = `// Code generated by pmg. DO NOT EDIT.
 package {{.PackageName}} 
 {{if .GenerateTag}}// The following comment tags this file for overwriting by "go generate"
@@ -92,7 +206,9 @@ var All = []pomegranate.Migration{
   BackwardSQL: []string{
 		{{range $sql := .QuotedTemplateBackward}}{{$sql}},{{end}}
 	},
-	},{{end}}
+{{if .TestBeforeSQL}}  TestBeforeSQL: {{printf "%q" .TestBeforeSQL}},
+{{end}}{{if .TestAssertSQL}}  TestAssertSQL: {{printf "%q" .TestAssertSQL}},
+{{end}}	},{{end}}
 }
 `
 
@@ -0,0 +1,360 @@
+package pomegranate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DependsOn returns the names of the migrations that this one depends on, as listed in
+// "-- pmg:depends_on" lines in its ForwardSQL, qualified by its namespace.
+func (m Migration) DependsOn() []string {
+	names := []string{}
+	for _, value := range getDirectives("depends_on", m.ForwardSQL) {
+		for _, name := range strings.Fields(value) {
+			names = append(names, qualifyReference(m.Name, name))
+		}
+	}
+	return names
+}
+
+// hasDependencies reports whether any migration declares its dependencies, in which case the
+// migrations are treated as a graph rather than a strict line.
+func hasDependencies(allMigrations []Migration) bool {
+	for _, mig := range allMigrations {
+		if len(mig.DependsOn()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// migrationDependencies returns the names of the migrations that each migration depends on.  A
+// migration without a "-- pmg:depends_on" line depends on the one before it in name order, so sets
+// that don't declare dependencies keep their strict line.  It returns an error if a migration
+// depends on one that doesn't exist.
+func migrationDependencies(allMigrations []Migration) (map[string][]string, error) {
+	deps := map[string][]string{}
+	for i, mig := range allMigrations {
+		names := mig.DependsOn()
+		if len(names) == 0 && i > 0 {
+			names = []string{allMigrations[i-1].Name}
+		}
+		for _, name := range names {
+			if !nameInMigrationList(name, allMigrations) {
+				return nil, fmt.Errorf("migration %s depends on %s, which doesn't exist", mig.Name, name)
+			}
+		}
+		deps[mig.Name] = names
+	}
+	return deps, nil
+}
+
+// orderMigrations returns allMigrations sorted so that every migration comes after the ones it
+// depends on.  Migrations that could run in either order are sorted by name.  It returns an error
+// if a dependency is missing or the dependencies form a cycle.
+func orderMigrations(allMigrations []Migration) ([]Migration, error) {
+	deps, err := migrationDependencies(allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]Migration{}
+	waiting := map[string]int{}
+	dependants := map[string][]string{}
+	for _, mig := range allMigrations {
+		byName[mig.Name] = mig
+		waiting[mig.Name] = len(deps[mig.Name])
+		for _, dep := range deps[mig.Name] {
+			dependants[dep] = append(dependants[dep], mig.Name)
+		}
+	}
+	ready := []string{}
+	for _, mig := range allMigrations {
+		if waiting[mig.Name] == 0 {
+			ready = append(ready, mig.Name)
+		}
+	}
+	ordered := []Migration{}
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		name := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, byName[name])
+		for _, dependant := range dependants[name] {
+			waiting[dependant]--
+			if waiting[dependant] == 0 {
+				ready = append(ready, dependant)
+			}
+		}
+	}
+	if len(ordered) < len(allMigrations) {
+		return nil, fmt.Errorf("dependency cycle: %s", strings.Join(findCycle(allMigrations, deps, waiting), " -> "))
+	}
+	return ordered, nil
+}
+
+// findCycle returns the names along one dependency cycle among the migrations still waiting on
+// dependencies, starting and ending with the same name.
+func findCycle(allMigrations []Migration, deps map[string][]string, waiting map[string]int) []string {
+	name := ""
+	for _, mig := range allMigrations {
+		if waiting[mig.Name] > 0 {
+			name = mig.Name
+			break
+		}
+	}
+	// every waiting migration has a waiting dependency, so following them must loop back.
+	seen := map[string]int{}
+	path := []string{}
+	for {
+		if i, ok := seen[name]; ok {
+			return append(path[i:], name)
+		}
+		seen[name] = len(path)
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			if waiting[dep] > 0 {
+				name = dep
+				break
+			}
+		}
+	}
+}
+
+// getDAGForwardMigrations returns the migrations in allMigrations that are not in state, in
+// dependency order.  Unlike getForwardMigrations, state doesn't have to be a prefix of
+// allMigrations, but every migration in it must be known.
+func getDAGForwardMigrations(state []MigrationRecord, allMigrations []Migration) ([]Migration, error) {
+	state, err := CollapseReplacedState(state, allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	ordered, err := orderMigrations(allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range state {
+		if !nameInMigrationList(rec.Name, allMigrations) {
+			return nil, fmt.Errorf("migration %s from state is not in the static list", rec.Name)
+		}
+	}
+	pending := []Migration{}
+	for _, mig := range ordered {
+		if !nameInState(mig.Name, state) {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// getDAGForwardMigrationsToRun returns the pending migrations needed to run the one named, in
+// dependency order: the named migration and every pending migration it depends on, directly or
+// not.  If name is empty, all pending migrations are returned.
+func getDAGForwardMigrationsToRun(name string, state []MigrationRecord, allMigrations []Migration) ([]Migration, error) {
+	pending, err := getDAGForwardMigrations(state, allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return pending, nil
+	}
+	if !nameInMigrationList(name, pending) {
+		return nil, fmt.Errorf("migration '%s' not in list of un-run migrations", name)
+	}
+	deps, err := migrationDependencies(allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	needed := map[string]bool{}
+	var need func(string)
+	need = func(n string) {
+		if needed[n] {
+			return
+		}
+		needed[n] = true
+		for _, dep := range deps[n] {
+			need(dep)
+		}
+	}
+	need(name)
+	toRun := []Migration{}
+	for _, mig := range pending {
+		if needed[mig.Name] {
+			toRun = append(toRun, mig)
+		}
+	}
+	return toRun, nil
+}
+
+// checkDependencyOrder returns an error if any migration in toRun would run before a migration it
+// depends on, which must either be in state or come earlier in toRun.
+func checkDependencyOrder(state []MigrationRecord, toRun []Migration, allMigrations []Migration) error {
+	deps, err := migrationDependencies(allMigrations)
+	if err != nil {
+		return err
+	}
+	state, err = CollapseReplacedState(state, allMigrations)
+	if err != nil {
+		return err
+	}
+	done := map[string]bool{}
+	for _, rec := range state {
+		done[rec.Name] = true
+	}
+	for _, mig := range toRun {
+		for _, dep := range deps[mig.Name] {
+			if !done[dep] {
+				return fmt.Errorf("migration %s would run before %s, which it depends on", mig.Name, dep)
+			}
+		}
+		done[mig.Name] = true
+	}
+	return nil
+}
+
+// getDAGMigrationsToReverse returns the migrations to reverse to take the named migration back
+// out of state: it and every applied migration that depends on it, directly or not, each before
+// the ones it depends on.  It returns an error if the migration hasn't been run, or if an applied
+// migration that might depend on it isn't in allMigrations.
+func getDAGMigrationsToReverse(name string, state []MigrationRecord, allMigrations []Migration) ([]Migration, error) {
+	state, err := CollapseReplacedState(state, allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	names, err := getDAGNamesToReverse(name, state, allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	sources := map[string]Migration{}
+	for _, mig := range allMigrations {
+		sources[mig.Name] = mig
+	}
+	toRun := []Migration{}
+	for _, n := range names {
+		mig, ok := sources[n]
+		if !ok {
+			return nil, fmt.Errorf("migration %s from state is not in the static list", n)
+		}
+		toRun = append(toRun, mig)
+	}
+	return toRun, nil
+}
+
+// getMigrationToReverseOnly returns just the named migration, ready to be reversed.  It returns an
+// error if the migration hasn't been run, or if migrations that depend on it are still applied,
+// since they would be left without it.  Without "-- pmg:depends_on" lines, each migration depends
+// on the one before it, so only the most recent can be reversed.
+func getMigrationToReverseOnly(name string, state []MigrationRecord, allMigrations []Migration) ([]Migration, error) {
+	state, err := CollapseReplacedState(state, allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	if !nameInState(name, state) {
+		return nil, fmt.Errorf("migration %s not in state", name)
+	}
+	deps, err := migrationDependencies(allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	applied := []string{}
+	for _, mig := range allMigrations {
+		if !nameInState(mig.Name, state) {
+			continue
+		}
+		for _, dep := range deps[mig.Name] {
+			if dep == name {
+				applied = append(applied, mig.Name)
+			}
+		}
+	}
+	if len(applied) > 0 {
+		return nil, fmt.Errorf(
+			"cannot reverse %s while migrations that depend on it are applied: %s",
+			name, strings.Join(applied, ", "),
+		)
+	}
+	for _, mig := range allMigrations {
+		if mig.Name == name {
+			return []Migration{mig}, nil
+		}
+	}
+	return nil, fmt.Errorf("migration %s not found", name)
+}
+
+// getDAGNamesToReverse returns the names of the applied migrations to reverse to take the named
+// one out of the already collapsed state, in the order to reverse them.  Its applied dependants
+// come before it, in reverse dependency order.  Applied migrations that aren't in allMigrations
+// come first, most recent name first: their dependencies aren't known, so any of them named after
+// it might depend on it.  If the named migration is one of those, only they are reversed.
+func getDAGNamesToReverse(name string, state []MigrationRecord, allMigrations []Migration) ([]string, error) {
+	if !nameInState(name, state) {
+		return nil, fmt.Errorf("migration %s not in state", name)
+	}
+	ordered, err := orderMigrations(allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	deps, err := migrationDependencies(allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for i := len(state) - 1; i >= 0; i-- {
+		if n := state[i].Name; n >= name && !nameInMigrationList(n, allMigrations) {
+			names = append(names, n)
+		}
+	}
+	reverse := map[string]bool{name: true}
+	// ordered puts every migration after its dependencies, so one pass finds all the dependants
+	for _, mig := range ordered {
+		for _, dep := range deps[mig.Name] {
+			if reverse[dep] && nameInState(mig.Name, state) {
+				reverse[mig.Name] = true
+			}
+		}
+	}
+	for i := len(ordered) - 1; i >= 0; i-- {
+		if reverse[ordered[i].Name] {
+			names = append(names, ordered[i].Name)
+		}
+	}
+	return names, nil
+}
+
+// getDAGSyncMigrations works like getSyncMigrations for migrations that declare their
+// dependencies.  Since such migrations can be applied in any order that respects them, state is
+// never out of line with allMigrations; only the migrations in state that allMigrations doesn't
+// have are rolled back, using their stored backward SQL, before the pending ones are run in
+// dependency order.
+func getDAGSyncMigrations(state []MigrationRecord, allMigrations []Migration, stored []StoredMigration) ([]Migration, []Migration, error) {
+	state, err := CollapseReplacedState(state, allMigrations)
+	if err != nil {
+		return nil, nil, err
+	}
+	known := []MigrationRecord{}
+	extra := []MigrationRecord{}
+	for _, rec := range state {
+		if nameInMigrationList(rec.Name, allMigrations) {
+			known = append(known, rec)
+		} else {
+			extra = append(extra, rec)
+		}
+	}
+	storedByName := map[string]StoredMigration{}
+	for _, s := range stored {
+		storedByName[s.Name] = s
+	}
+	backward := []Migration{}
+	for i := len(extra) - 1; i >= 0; i-- {
+		s, ok := storedByName[extra[i].Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("migration %s is in state, but has neither source nor stored backward SQL", extra[i].Name)
+		}
+		backward = append(backward, Migration{Name: s.Name, BackwardSQL: s.BackwardSQL})
+	}
+	forward, err := getDAGForwardMigrations(known, allMigrations)
+	if err != nil {
+		return nil, nil, err
+	}
+	return backward, forward, nil
+}
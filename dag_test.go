@@ -0,0 +1,320 @@
+package pomegranate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// depsToMigs makes a Migration for each name, declaring the dependencies listed for it.
+func depsToMigs(names []string, deps map[string]string) []Migration {
+	migs := namesToMigs(names)
+	for i, mig := range migs {
+		if d, ok := deps[mig.Name]; ok {
+			migs[i].ForwardSQL = []string{"-- pmg:depends_on " + d + "\nSELECT 1;"}
+		}
+	}
+	return migs
+}
+
+func TestDependsOn(t *testing.T) {
+	mig := Migration{ForwardSQL: []string{"-- pmg:depends_on a b\n-- pmg:depends_on c\nSELECT 1;"}}
+	assert.Equal(t, []string{"a", "b", "c"}, mig.DependsOn())
+	assert.Equal(t, []string{}, Migration{}.DependsOn())
+	assert.False(t, hasDependencies(goodMigrations))
+}
+
+func TestOrderMigrations(t *testing.T) {
+	tt := []struct {
+		name  string
+		names []string
+		deps  map[string]string
+		order []string
+		err   string
+	}{
+		{
+			name:  "linear",
+			names: []string{"a", "b", "c"},
+			order: []string{"a", "b", "c"},
+		},
+		{
+			name:  "branches sorted by name",
+			names: []string{"1_init", "2_users", "2_billing", "3_users"},
+			deps:  map[string]string{"2_users": "1_init", "2_billing": "1_init", "3_users": "2_users"},
+			order: []string{"1_init", "2_billing", "2_users", "3_users"},
+		},
+		{
+			name:  "missing dependency",
+			names: []string{"a", "b", "c"},
+			deps:  map[string]string{"a": "c", "b": "a", "c": "c_dep"},
+			err:   "migration c depends on c_dep, which doesn't exist",
+		},
+		{
+			name:  "cycle",
+			names: []string{"a", "b", "c"},
+			deps:  map[string]string{"a": "c", "b": "a", "c": "b"},
+			err:   "dependency cycle: a -> c -> b -> a",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := orderMigrations(depsToMigs(tc.names, tc.deps))
+			if tc.err != "" {
+				assert.Equal(t, tc.err, err.Error())
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.order, migsToNames(out))
+		})
+	}
+}
+
+func TestGetDAGForwardMigrationsToRun(t *testing.T) {
+	names := []string{"1_init", "2_billing", "2_users", "3_billing", "3_users"}
+	deps := map[string]string{
+		"2_billing": "1_init",
+		"2_users":   "1_init",
+		"3_billing": "2_billing",
+		"3_users":   "2_users",
+	}
+	tt := []struct {
+		name   string
+		target string
+		state  []string
+		toRun  []string
+		err    string
+	}{
+		{
+			name:  "all pending",
+			state: []string{"1_init", "2_users"},
+			toRun: []string{"2_billing", "3_billing", "3_users"},
+		},
+		{
+			name:   "only what the target needs",
+			target: "3_billing",
+			state:  []string{"1_init"},
+			toRun:  []string{"2_billing", "3_billing"},
+		},
+		{
+			name:   "already run",
+			target: "2_users",
+			state:  []string{"1_init", "2_users"},
+			toRun:  []string{},
+		},
+		{
+			name:  "unknown migration in state",
+			state: []string{"1_init", "2_audit"},
+			err:   "migration 2_audit from state is not in the static list",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := getForwardMigrationsToRun(tc.target, namesToState(tc.state), depsToMigs(names, deps))
+			if tc.err != "" {
+				assert.Equal(t, tc.err, err.Error())
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.toRun, migsToNames(out))
+		})
+	}
+}
+
+func TestGetDAGMigrationsToReverse(t *testing.T) {
+	migs := depsToMigs(
+		[]string{"1_init", "2_billing", "2_users", "3_users", "4_reports"},
+		map[string]string{"2_billing": "1_init", "2_users": "1_init", "4_reports": "2_billing"},
+	)
+	state := namesToState([]string{"1_init", "2_billing", "2_users", "3_users", "4_reports"})
+
+	out, err := getMigrationsToReverse("2_billing", state, migs)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"4_reports", "2_billing"}, migsToNames(out))
+	out, err = getMigrationsToReverse("2_users", state, migs)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"3_users", "2_users"}, migsToNames(out))
+	out, err = getMigrationsToReverse("1_init", state, migs)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"4_reports", "3_users", "2_users", "2_billing", "1_init"}, migsToNames(out))
+	// dependants that aren't applied are left alone
+	out, err = getMigrationsToReverse("2_billing", namesToState([]string{"1_init", "2_billing", "2_users"}), migs)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2_billing"}, migsToNames(out))
+
+	_, err = getMigrationsToReverse("3_billing", state, migs)
+	assert.Equal(t, "migration 3_billing not in state", err.Error())
+	_, err = getMigrationsToReverse("2_users", namesToState([]string{"1_init", "2_users", "9_unknown"}), migs)
+	assert.Equal(t, "migration 9_unknown from state is not in the static list", err.Error())
+}
+
+func TestGetMigrationToReverseOnly(t *testing.T) {
+	migs := depsToMigs(
+		[]string{"1_init", "2_billing", "2_users", "3_users"},
+		map[string]string{"2_billing": "1_init", "2_users": "1_init"},
+	)
+	state := namesToState([]string{"1_init", "2_billing", "2_users", "3_users"})
+
+	out, err := getMigrationToReverseOnly("2_billing", state, migs)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2_billing"}, migsToNames(out))
+	_, err = getMigrationToReverseOnly("2_users", state, migs)
+	assert.Equal(t, "cannot reverse 2_users while migrations that depend on it are applied: 3_users", err.Error())
+	_, err = getMigrationToReverseOnly("1_init", state, migs)
+	assert.Equal(t, "cannot reverse 1_init while migrations that depend on it are applied: 2_billing, 2_users", err.Error())
+
+	// without dependencies, each migration depends on the one before it
+	linear := namesToMigs([]string{"a", "b", "c"})
+	_, err = getMigrationToReverseOnly("b", namesToState([]string{"a", "b", "c"}), linear)
+	assert.Equal(t, "cannot reverse b while migrations that depend on it are applied: c", err.Error())
+	out, err = getMigrationToReverseOnly("c", namesToState([]string{"a", "b", "c"}), linear)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c"}, migsToNames(out))
+}
+
+func TestGetDAGMigrationsToReverseStored(t *testing.T) {
+	migs := depsToMigs(
+		[]string{"1_init", "2_billing", "2_users", "3_users"},
+		map[string]string{"2_billing": "1_init", "2_users": "1_init"},
+	)
+	state := namesToState([]string{"1_init", "2_billing", "2_users", "3_users", "4_newer", "5_newer"})
+	stored := []StoredMigration{}
+	for _, name := range []string{"4_newer", "5_newer"} {
+		stored = append(stored, StoredMigration{Name: name, Checksum: sqlChecksum(nil)})
+	}
+
+	// migrations without source that were applied later might depend on it, so they go first
+	out, err := getMigrationsToReverseStored("2_users", state, migs, stored)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"5_newer", "4_newer", "3_users", "2_users"}, migsToNames(out))
+	out, err = getMigrationsToReverseStored("5_newer", state, migs, stored)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"5_newer"}, migsToNames(out))
+
+	_, err = getMigrationsToReverseStored("2_billing", state, migs, stored[1:])
+	assert.Equal(t, "migration 4_newer is in state, but has neither source nor stored backward SQL", err.Error())
+}
+
+func TestGetDAGSyncMigrations(t *testing.T) {
+	migs := depsToMigs(
+		[]string{"1_init", "2_billing", "2_users", "3_billing", "3_users"},
+		map[string]string{"2_billing": "1_init", "2_users": "1_init", "3_billing": "2_billing", "3_users": "2_users"},
+	)
+	stored := []StoredMigration{{Name: "2_audit"}, {Name: "4_experiment"}}
+	tt := []struct {
+		name     string
+		state    []string
+		backward []string
+		forward  []string
+		err      string
+	}{
+		{
+			name:     "not a prefix of name order",
+			state:    []string{"1_init", "2_users", "3_users"},
+			backward: []string{},
+			forward:  []string{"2_billing", "3_billing"},
+		},
+		{
+			name:     "applied migrations missing from the list",
+			state:    []string{"1_init", "2_audit", "2_users", "4_experiment"},
+			backward: []string{"4_experiment", "2_audit"},
+			forward:  []string{"2_billing", "3_billing", "3_users"},
+		},
+		{
+			name:  "nothing stored",
+			state: []string{"1_init", "2_gone"},
+			err:   "migration 2_gone is in state, but has neither source nor stored backward SQL",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			backward, forward, err := getSyncMigrations(namesToState(tc.state), migs, stored)
+			if tc.err != "" {
+				assert.Equal(t, tc.err, err.Error())
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.backward, migsToNames(backward))
+			assert.Equal(t, tc.forward, migsToNames(forward))
+		})
+	}
+}
+
+func TestGetDAGMigrationRange(t *testing.T) {
+	migs := depsToMigs(
+		[]string{"1_init", "2_billing", "2_users", "3_audit"},
+		map[string]string{"2_billing": "3_audit", "3_audit": "1_init"},
+	)
+	out, err := GetMigrationRange("", "", migs, false)
+	assert.Nil(t, err)
+	// 2_users has no depends_on line, so it depends on 2_billing
+	assert.Equal(t, []string{"1_init", "3_audit", "2_billing", "2_users"}, migsToNames(out))
+	out, err = GetMigrationRange("3_audit", "2_billing", migs, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2_billing", "3_audit"}, migsToNames(out))
+}
+
+func TestCheckDependencyOrder(t *testing.T) {
+	migs := depsToMigs(
+		[]string{"1_init", "2_billing", "2_users", "3_billing"},
+		map[string]string{"2_billing": "1_init", "2_users": "1_init", "3_billing": "2_billing"},
+	)
+	state := namesToState([]string{"1_init"})
+	assert.Nil(t, checkDependencyOrder(state, namesToMigs([]string{"2_billing", "2_users", "3_billing"}), migs))
+	err := checkDependencyOrder(state, namesToMigs([]string{"3_billing", "2_billing"}), migs)
+	assert.Equal(t, "migration 3_billing would run before 2_billing, which it depends on", err.Error())
+}
+
+func TestDependencies(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	migs := append([]Migration{}, goodMigrations[:3]...)
+	migs = append(migs, Migration{
+		Name: "00004_widgets",
+		ForwardSQL: []string{`-- pmg:depends_on 00001_init
+BEGIN;
+CREATE TABLE widgets (id SERIAL PRIMARY KEY);
+INSERT INTO migration_state(name) VALUES ('00004_widgets');
+COMMIT;
+`},
+		BackwardSQL: []string{`BEGIN;
+DROP TABLE widgets;
+DELETE FROM migration_state WHERE name='00004_widgets';
+COMMIT;
+`},
+	})
+
+	err := MigrateForwardToContext(ctx, "00002_foobar", db, migs, false)
+	assert.Nil(t, err)
+	// 00004_widgets only needs 00001_init, so 00003_foobaz is left pending
+	err = MigrateForwardToContext(ctx, "00004_widgets", db, migs, false)
+	assert.Nil(t, err)
+	state, _ := GetMigrationState(db)
+	assert.Equal(t, []string{"00001_init", "00002_foobar", "00004_widgets"}, recordNames(state))
+	err = MigrateForwardToContext(ctx, "", db, migs, false)
+	assert.Nil(t, err)
+
+	err = MigrateBackwardOnlyContext(ctx, "00002_foobar", db, migs, false)
+	assert.Equal(t, "cannot reverse 00002_foobar while migrations that depend on it are applied: 00003_foobaz", err.Error())
+	err = MigrateBackwardOnlyContext(ctx, "00004_widgets", db, migs, false)
+	assert.Nil(t, err)
+	state, _ = GetMigrationState(db)
+	assert.Equal(t, []string{"00001_init", "00002_foobar", "00003_foobaz"}, recordNames(state))
+
+	// 00004_widgets can be run again without the migrations before it in name order being
+	// rolled back, and sync leaves the graph alone
+	err = MigrateForwardToContext(ctx, "", db, migs, false)
+	assert.Nil(t, err)
+	err = MigrateToMatchContext(ctx, db, migs, false)
+	assert.Nil(t, err)
+	err = MigrateBackwardToStoredContext(ctx, "00002_foobar", db, migs, false)
+	assert.Nil(t, err)
+	state, _ = GetMigrationState(db)
+	assert.Equal(t, []string{"00001_init", "00004_widgets"}, recordNames(state))
+	err = MigrateToMatchContext(ctx, db, migs, false)
+	assert.Nil(t, err)
+	state, _ = GetMigrationState(db)
+	assert.Equal(t, []string{"00001_init", "00002_foobar", "00003_foobaz", "00004_widgets"}, recordNames(state))
+}
@@ -2,21 +2,30 @@ package pomegranate
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	// register the pq driver with the sql package.
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // Connect calls sql.Open for you, specifying the Postgres driver and printing
 // the DB name and host to stdout so you can check that you're connecting to the
 // right place before continuing.  dial MUST be in URL form.
 func Connect(dial string) (*sql.DB, error) {
+	return connect(dial, os.Stdout)
+}
+
+// connect works like Connect, but writes the database's name and host to out.
+func connect(dial string, out io.Writer) (*sql.DB, error) {
 	// Failure to set the DATABASE_URL env var or provide the dburl command line
 	// flag could result in an empty dburl here.  Catch that.
 	if dial == "" {
@@ -28,10 +37,75 @@ func Connect(dial string) (*sql.DB, error) {
 	}
 	// trim leading slash
 	dbname := strings.Trim(parsedUrl.Path, "/")
-	fmt.Printf("Connecting to database '%s' on host '%s'\n", dbname, parsedUrl.Host)
+	fmt.Fprintf(out, "Connecting to database '%s' on host '%s'\n", dbname, parsedUrl.Host)
 	return sql.Open("postgres", dial)
 }
 
+// ScratchDatabase is a temporary, empty database created on the same server as another one, for
+// building and inspecting schemas without touching real data.  Close drops it.
+type ScratchDatabase struct {
+	*sql.DB
+	Name  string
+	URL   string
+	admin *sql.DB
+}
+
+// NewScratchDatabaseContext creates a randomly named database on the server that dial points to,
+// and connects to it.  dial MUST be in URL form, and its user must be allowed to create
+// databases.
+func NewScratchDatabaseContext(ctx context.Context, dial string) (*ScratchDatabase, error) {
+	return NewScratchDatabaseFromTemplateContext(ctx, dial, "")
+}
+
+// NewScratchDatabaseFromTemplateContext works like NewScratchDatabaseContext, but creates the
+// scratch database as a copy of the named template database, which must not have any other
+// connections open.  An empty template uses the server's default.
+func NewScratchDatabaseFromTemplateContext(ctx context.Context, dial, template string) (*ScratchDatabase, error) {
+	if dial == "" {
+		return nil, errors.New("empty database url provided")
+	}
+	suffix, err := randomSuffix()
+	if err != nil {
+		return nil, fmt.Errorf("could not name scratch database: %v", err)
+	}
+	admin, err := sql.Open("postgres", dial)
+	if err != nil {
+		return nil, err
+	}
+	name := "pmg_scratch_" + suffix
+	create := "CREATE DATABASE " + name
+	if template != "" {
+		create += " TEMPLATE " + pq.QuoteIdentifier(template)
+	}
+	if _, err := admin.ExecContext(ctx, create); err != nil {
+		admin.Close()
+		return nil, fmt.Errorf("could not create scratch database: %v", err)
+	}
+	scratchURL, err := url.Parse(dial)
+	if err != nil {
+		admin.Close()
+		return nil, err
+	}
+	scratchURL.Path = "/" + name
+	db, err := sql.Open("postgres", scratchURL.String())
+	if err != nil {
+		admin.ExecContext(ctx, "DROP DATABASE "+name)
+		admin.Close()
+		return nil, err
+	}
+	return &ScratchDatabase{DB: db, Name: name, URL: scratchURL.String(), admin: admin}, nil
+}
+
+// Close closes the connection to the scratch database and drops it.
+func (s *ScratchDatabase) Close() error {
+	s.DB.Close()
+	defer s.admin.Close()
+	if _, err := s.admin.Exec("DROP DATABASE IF EXISTS " + s.Name); err != nil {
+		return fmt.Errorf("could not drop scratch database %s: %v", s.Name, err)
+	}
+	return nil
+}
+
 type Database interface {
 	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
 	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
@@ -48,14 +122,7 @@ func GetMigrationState(db Database) ([]MigrationRecord, error) {
 // an empty list.
 func GetMigrationStateContext(ctx context.Context, db Database) ([]MigrationRecord, error) {
 	// first see if the migration_state table exists
-	var exists bool
-	err := db.QueryRowContext(ctx, `
-      SELECT EXISTS (
-         SELECT 1 
-         FROM   pg_tables
-         WHERE  schemaname = 'public'
-         AND    tablename = 'migration_state'
-       );`).Scan(&exists)
+	exists, err := tableExistsContext(ctx, db, "migration_state")
 	if err != nil {
 		return nil, err
 	}
@@ -87,14 +154,7 @@ func GetMigrationLog(db Database) ([]MigrationLogRecord, error) {
 // GetMigrationLogContext returns the complete history of all migrations, forward and backward.  If the
 // migration_log table does not exist, it returns an empty list of MigrationLogRecords
 func GetMigrationLogContext(ctx context.Context, db Database) ([]MigrationLogRecord, error) {
-	var exists bool
-	err := db.QueryRowContext(ctx, `
-      SELECT EXISTS (
-         SELECT 1 
-         FROM   pg_tables
-         WHERE  schemaname = 'public'
-         AND    tablename = 'migration_log'
-       );`).Scan(&exists)
+	exists, err := tableExistsContext(ctx, db, "migration_log")
 	if err != nil {
 		return nil, err
 	}
@@ -124,12 +184,19 @@ func MigrateBackwardTo(name string, db Database, allMigrations []Migration, conf
 }
 
 // MigrateBackwardToContext will run backward migrations starting with the most recent
-// in state, and going through the one provided in `name`.
+// in state, and going through the one provided in `name`.  When the migrations declare their
+// dependencies, it reverses `name` and every applied migration that depends on it, directly or
+// not, each before the ones it depends on.
 func MigrateBackwardToContext(ctx context.Context, name string, db Database, allMigrations []Migration, confirm bool) error {
+	return MigrateBackwardToWithOptions(ctx, name, db, allMigrations, confirm, Options{})
+}
+
+// MigrateBackwardToWithOptions works like MigrateBackwardToContext, run with opts.
+func MigrateBackwardToWithOptions(ctx context.Context, name string, db Database, allMigrations []Migration, confirm bool, opts Options) error {
 	if len(allMigrations) == 0 {
 		return errors.New("no migrations provided")
 	}
-	state, err := GetMigrationStateContext(ctx, db)
+	state, err := getSetStateContext(ctx, db, allMigrations)
 	if err != nil {
 		return fmt.Errorf("could not get migration state: %v", err)
 	}
@@ -141,20 +208,255 @@ func MigrateBackwardToContext(ctx context.Context, name string, db Database, all
 	if err != nil {
 		return err
 	}
+	return runBackwardMigrationsContext(ctx, db, toRun, confirm, opts)
+}
+
+// MigrateBackwardOnlyContext runs the backward migration for just the one provided in `name`.  It
+// returns an error without running anything while any migration that depends on it is still
+// applied.  Without "-- pmg:depends_on" lines, each migration depends on the one before it, so
+// only the most recent migration can be rolled back this way.
+func MigrateBackwardOnlyContext(ctx context.Context, name string, db Database, allMigrations []Migration, confirm bool) error {
+	return MigrateBackwardOnlyWithOptions(ctx, name, db, allMigrations, confirm, Options{})
+}
+
+// MigrateBackwardOnlyWithOptions works like MigrateBackwardOnlyContext, run with opts.
+func MigrateBackwardOnlyWithOptions(ctx context.Context, name string, db Database, allMigrations []Migration, confirm bool, opts Options) error {
+	if len(allMigrations) == 0 {
+		return errors.New("no migrations provided")
+	}
+	state, err := getSetStateContext(ctx, db, allMigrations)
+	if err != nil {
+		return fmt.Errorf("could not get migration state: %v", err)
+	}
+	toRun, err := getMigrationToReverseOnly(name, state, allMigrations)
+	if err != nil {
+		return err
+	}
+	return runBackwardMigrationsContext(ctx, db, toRun, confirm, opts)
+}
+
+// MigrateBackwardToStoredContext works like MigrateBackwardToContext, but does not require
+// allMigrations to contain every migration being rolled back.  Migrations that are in state but
+// missing from allMigrations are rolled back using the BackwardSQL that was stored in the
+// database when they were applied.
+func MigrateBackwardToStoredContext(ctx context.Context, name string, db Database, allMigrations []Migration, confirm bool) error {
+	return MigrateBackwardToStoredWithOptions(ctx, name, db, allMigrations, confirm, Options{})
+}
+
+// MigrateBackwardToStoredWithOptions works like MigrateBackwardToStoredContext, run with opts.
+func MigrateBackwardToStoredWithOptions(ctx context.Context, name string, db Database, allMigrations []Migration, confirm bool, opts Options) error {
+	state, err := getSetStateContext(ctx, db, allMigrations)
+	if err != nil {
+		return fmt.Errorf("could not get migration state: %v", err)
+	}
+	if len(state) == 0 {
+		return errors.New("state is empty. cannot migrate back")
+	}
+	stored, err := GetStoredMigrationsContext(ctx, db)
+	if err != nil {
+		return fmt.Errorf("could not get stored migrations: %v", err)
+	}
+	toRun, err := getMigrationsToReverseStored(name, state, allMigrations, stored)
+	if err != nil {
+		return err
+	}
+	return runBackwardMigrationsContext(ctx, db, toRun, confirm, opts)
+}
+
+// MigrateToMatchContext makes the migrations applied to the database exactly match
+// allMigrations.  Migrations in state that come after the last one in allMigrations are rolled
+// back (using stored backward SQL if necessary), and then any migrations from allMigrations
+// missing from state are run forward.  It returns an error without changing anything if state and
+// allMigrations have diverged.  When the migrations declare their dependencies, only the
+// migrations in state that allMigrations doesn't have are rolled back, and the pending ones are
+// run in dependency order.
+func MigrateToMatchContext(ctx context.Context, db Database, allMigrations []Migration, confirm bool) error {
+	return MigrateToMatchWithOptions(ctx, db, allMigrations, confirm, Options{})
+}
+
+// MigrateToMatchWithOptions works like MigrateToMatchContext, run with opts.  opts.Repeatables
+// are applied afterwards.
+func MigrateToMatchWithOptions(ctx context.Context, db Database, allMigrations []Migration, confirm bool, opts Options) error {
+	if len(allMigrations) == 0 {
+		return errors.New("no migrations provided")
+	}
+	state, err := getSetStateContext(ctx, db, allMigrations)
+	if err != nil {
+		return fmt.Errorf("could not get migration state: %v", err)
+	}
+	stored, err := GetStoredMigrationsContext(ctx, db)
+	if err != nil {
+		return fmt.Errorf("could not get stored migrations: %v", err)
+	}
+	backward, forward, err := getSyncMigrations(state, allMigrations, stored)
+	if err != nil {
+		return err
+	}
+	if err := checkEnvironment(opts.Environment, forward); err != nil {
+		return err
+	}
+	if len(backward) == 0 && len(forward) == 0 {
+		fmt.Fprintln(opts.output(), "No migrations to run")
+		return applyRepeatablesContext(ctx, db, confirm, opts)
+	}
+	if confirm {
+		if err := getSyncConfirm(backward, forward, opts.output(), opts.input()); err != nil {
+			return err
+		}
+	}
+	if err := runBackwardMigrationsContext(ctx, db, backward, false, opts); err != nil {
+		return err
+	}
+	if err := runForwardMigrationsContext(ctx, db, forward, opts); err != nil {
+		return err
+	}
+	return applyRepeatablesContext(ctx, db, confirm, opts)
+}
+
+// GetForwardMigrationsContext returns the forward migrations that MigrateForwardToContext would
+// run, without running them.
+func GetForwardMigrationsContext(ctx context.Context, name string, db Database, allMigrations []Migration) ([]Migration, error) {
+	return GetForwardMigrationsWithOptions(ctx, name, db, allMigrations, Options{})
+}
+
+// GetForwardMigrationsWithOptions returns the forward migrations that MigrateForwardToWithOptions
+// would run with opts, without running them.
+func GetForwardMigrationsWithOptions(ctx context.Context, name string, db Database, allMigrations []Migration, opts Options) ([]Migration, error) {
+	state, err := getSetStateContext(ctx, db, allMigrations)
+	if err != nil {
+		return nil, fmt.Errorf("could not get migration state: %v", err)
+	}
+	return getPhaseForwardMigrationsToRun(opts.Phase, name, state, allMigrations)
+}
+
+// GetBackwardMigrationsContext returns the backward migrations that MigrateBackwardToContext
+// would run, most recent first, without running them.
+func GetBackwardMigrationsContext(ctx context.Context, name string, db Database, allMigrations []Migration) ([]Migration, error) {
+	if len(allMigrations) == 0 {
+		return nil, errors.New("no migrations provided")
+	}
+	state, err := getSetStateContext(ctx, db, allMigrations)
+	if err != nil {
+		return nil, fmt.Errorf("could not get migration state: %v", err)
+	}
+	if len(state) == 0 {
+		return nil, errors.New("state is empty. cannot migrate back")
+	}
+	return getMigrationsToReverse(name, state, allMigrations)
+}
+
+// GetDatabaseIdentityContext returns the name of the connected database, and the address and
+// port of the server it lives on.  Host is empty when connected over a Unix socket.
+func GetDatabaseIdentityContext(ctx context.Context, db Database) (DatabaseIdentity, error) {
+	var id DatabaseIdentity
+	err := db.QueryRowContext(ctx, `
+      SELECT current_database(),
+             coalesce(host(inet_server_addr()), ''),
+             coalesce(inet_server_port(), 0)`,
+	).Scan(&id.Name, &id.Host, &id.Port)
+	if err != nil {
+		return id, fmt.Errorf("get database identity: %v", err)
+	}
+	return id, nil
+}
+
+// MakePlanContext returns a Plan for running all forward migrations that have not yet been run, up
+// to and including the one specified by `name`.  To plan all un-run migrations, set `name` to an
+// empty string.  The Plan can be saved with WritePlanFile and later run with ApplyPlanContext.
+func MakePlanContext(ctx context.Context, name string, db Database, allMigrations []Migration) (Plan, error) {
+	return MakePlanWithOptions(ctx, name, db, allMigrations, Options{})
+}
+
+// MakePlanWithOptions works like MakePlanContext, but only plans the migrations for opts.Phase.
+func MakePlanWithOptions(ctx context.Context, name string, db Database, allMigrations []Migration, opts Options) (Plan, error) {
+	identity, err := GetDatabaseIdentityContext(ctx, db)
+	if err != nil {
+		return Plan{}, err
+	}
+	state, err := getSetStateContext(ctx, db, allMigrations)
+	if err != nil {
+		return Plan{}, fmt.Errorf("could not get migration state: %v", err)
+	}
+	toRun, err := getPhaseForwardMigrationsToRun(opts.Phase, name, state, allMigrations)
+	if err != nil {
+		return Plan{}, err
+	}
+	p := makePlan(identity, state, toRun)
+	p.Created = time.Now().UTC()
+	return p, nil
+}
+
+// ApplyPlanContext runs exactly the migrations recorded in a Plan.  It returns an error without
+// running anything if the database identity or migration state differ from when the plan was
+// made, or if the SQL in allMigrations no longer matches the SQL in the plan.
+func ApplyPlanContext(ctx context.Context, db Database, p Plan, allMigrations []Migration, confirm bool) error {
+	return ApplyPlanWithOptions(ctx, db, p, allMigrations, confirm, Options{})
+}
+
+// ApplyPlanWithOptions works like ApplyPlanContext, run with opts.
+func ApplyPlanWithOptions(ctx context.Context, db Database, p Plan, allMigrations []Migration, confirm bool, opts Options) error {
+	identity, err := GetDatabaseIdentityContext(ctx, db)
+	if err != nil {
+		return err
+	}
+	state, err := getSetStateContext(ctx, db, allMigrations)
+	if err != nil {
+		return fmt.Errorf("could not get migration state: %v", err)
+	}
+	toRun, err := verifyPlan(p, identity, state, allMigrations)
+	if err != nil {
+		return fmt.Errorf("plan is out of date: %v", err)
+	}
+	if err := checkEnvironment(opts.Environment, toRun); err != nil {
+		return err
+	}
+	if len(toRun) == 0 {
+		fmt.Fprintln(opts.output(), "No migrations to run")
+		return nil
+	}
+	if confirm {
+		if err := getConfirm(toRun, "Forward", opts.output(), opts.input()); err != nil {
+			return err
+		}
+	}
+	return runForwardMigrationsContext(ctx, db, toRun, opts)
+}
+
+func runBackwardMigrationsContext(ctx context.Context, db Database, toRun []Migration, confirm bool, opts Options) error {
+	if err := checkNamespacedMigrations(toRun); err != nil {
+		return err
+	}
 	// get confirmation on the list of backward migrations we're going to run
 	if confirm {
-		if err := getConfirm(toRun, "Backward", os.Stdin); err != nil {
+		if err := getConfirm(toRun, "Backward", opts.output(), opts.input()); err != nil {
 			return err
 		}
 	}
+	skipped, err := GetSkippedMigrationsContext(ctx, db)
+	if err != nil {
+		return err
+	}
+	wasSkipped := map[string]bool{}
+	for _, s := range skipped {
+		wasSkipped[s.Name] = true
+	}
 	// run the migrations
-	for _, mig := range toRun {
-		err = runMigrationSQLContext(ctx, db, mig.Name, mig.BackwardSQL)
+	return runWithHooksContext(ctx, opts.hooks(), Backward, toRun, func(mig Migration) error {
+		if wasSkipped[mig.Name] {
+			return unskipMigrationContext(ctx, db, mig.Name, opts.output())
+		}
+		err := runMigrationContext(ctx, db, mig, Backward, opts.output())
 		if err != nil {
 			return err
 		}
-	}
-	return nil
+		if mig.IsGo() {
+			return nil
+		}
+		if err := deleteStoredMigrationContext(ctx, db, mig.Name); err != nil {
+			fmt.Fprintf(opts.output(), "warning: could not remove stored backward SQL for %s: %v\n", mig.Name, err)
+		}
+		return nil
+	})
 }
 
 // deprecated use MigrateForwardToContext
@@ -165,47 +467,154 @@ func MigrateForwardTo(name string, db Database, allMigrations []Migration, confi
 // MigrateForwardToContext will run all forward migrations that have not yet been run, up to and including
 // the one specified by `name`.  To run all un-run migrations, set `name` to an empty string.
 func MigrateForwardToContext(ctx context.Context, name string, db Database, allMigrations []Migration, confirm bool) error {
-	state, err := GetMigrationStateContext(ctx, db)
+	return MigrateForwardToWithOptions(ctx, name, db, allMigrations, confirm, Options{})
+}
+
+// MigrateForwardToWithOptions works like MigrateForwardToContext, run with opts.  When name is
+// empty, opts.Repeatables are applied afterwards.
+func MigrateForwardToWithOptions(ctx context.Context, name string, db Database, allMigrations []Migration, confirm bool, opts Options) error {
+	state, err := getSetStateContext(ctx, db, allMigrations)
 	if err != nil {
 		return fmt.Errorf("could not get migration state: %v", err)
 	}
 
-	toRun, err := getForwardMigrationsToRun(name, state, allMigrations)
+	toRun, err := getPhaseForwardMigrationsToRun(opts.Phase, name, state, allMigrations)
 	if err != nil {
 		return err
 	}
-	if len(toRun) == 0 {
-		fmt.Println("No migrations to run")
-		return nil
+	if err := checkEnvironment(opts.Environment, toRun); err != nil {
+		return err
 	}
-	if confirm {
-		if err := getConfirm(toRun, "Forward", os.Stdin); err != nil {
+	if len(toRun) == 0 {
+		printNothingToRun(opts.output(), name, state, "run")
+	} else {
+		if confirm {
+			if err := getConfirm(toRun, "Forward", opts.output(), opts.input()); err != nil {
+				return err
+			}
+		}
+		if err := runForwardMigrationsContext(ctx, db, toRun, opts); err != nil {
 			return err
 		}
 	}
-	// run migrations
-	for _, mig := range toRun {
-		err = runMigrationSQLContext(ctx, db, mig.Name, mig.ForwardSQL)
+	if name != "" {
+		return nil
+	}
+	return applyRepeatablesContext(ctx, db, confirm, opts)
+}
+
+func runForwardMigrationsContext(ctx context.Context, db Database, toRun []Migration, opts Options) error {
+	if err := checkEnvironment(opts.Environment, toRun); err != nil {
+		return err
+	}
+	if err := checkNamespacedMigrations(toRun); err != nil {
+		return err
+	}
+	return runWithHooksContext(ctx, opts.hooks(), Forward, toRun, func(mig Migration) error {
+		if !mig.runsIn(opts.Environment) {
+			return skipMigrationContext(ctx, db, mig, opts.Environment, opts.output())
+		}
+		err := runMigrationContext(ctx, db, mig, Forward, opts.output())
 		if err != nil {
 			return err
 		}
+		if mig.IsGo() {
+			// there is no SQL to store, so it can only be rolled back from code
+			return nil
+		}
+		if err := storeMigrationContext(ctx, db, mig); err != nil {
+			return fmt.Errorf("could not store backward SQL for %s (the migration has already been run): %v", mig.Name, err)
+		}
+		return nil
+	})
+}
+
+// runMigrationSQLContext runs one direction of a migration.  The "-- pmg:require" conditions in
+// its SQL are checked first, and its "-- pmg:ensure" conditions afterward.  When the migration
+// can run in a single transaction, it is run in one of our own so that a failed ensure condition
+// rolls it back.
+func runMigrationSQLContext(ctx context.Context, db Database, name string, sqlToRun []string, out io.Writer) error {
+	fmt.Fprintf(out, "Running %s... ", name)
+	err := checkConditionsContext(ctx, db, "require", sqlToRun)
+	if err == nil {
+		beginner, ok := db.(txBeginner)
+		if ok && len(getDirectives("ensure", sqlToRun)) > 0 && nonTransactionalReason(sqlToRun) == "" {
+			err = runEnsuredMigrationSQLContext(ctx, beginner, sqlToRun)
+		} else {
+			err = execMigrationSQLContext(ctx, db, sqlToRun)
+		}
 	}
+	if err != nil {
+		fmt.Fprintln(out, "Failure :(")
+		return err
+	}
+	fmt.Fprintln(out, "Success!")
 	return nil
 }
 
-func runMigrationSQLContext(ctx context.Context, db Database, name string, sqlToRun []string) error {
-	fmt.Printf("Running %s... ", name)
+// txBeginner is implemented by *sql.DB and *sql.Conn.
+type txBeginner interface {
+	BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+}
+
+func execMigrationSQLContext(ctx context.Context, db Database, sqlToRun []string) error {
 	for _, sql := range sqlToRun {
 		_, err := db.ExecContext(ctx, sql)
 		if err != nil {
-			fmt.Println("Failure :(")
 			return fmt.Errorf("error running migration: %v", err)
 		}
 	}
-	fmt.Println("Success!")
+	if err := checkConditionsContext(ctx, db, "ensure", sqlToRun); err != nil {
+		return fmt.Errorf("%v (the migration has already been run)", err)
+	}
+	return nil
+}
+
+// runEnsuredMigrationSQLContext runs a migration's statements and checks its ensure conditions
+// in a transaction, in place of the migration's own BEGIN and COMMIT.
+func runEnsuredMigrationSQLContext(ctx context.Context, db txBeginner, sqlToRun []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range transactionStatements(sqlToRun) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("error running migration: %v", err)
+		}
+	}
+	if err := checkConditionsContext(ctx, tx, "ensure", sqlToRun); err != nil {
+		return fmt.Errorf("%v (the migration has been rolled back)", err)
+	}
+	return tx.Commit()
+}
+
+// checkConditionsContext runs the queries given by a migration's "-- pmg:<kind>" directives, and
+// returns an error for the first one that doesn't return true.
+func checkConditionsContext(ctx context.Context, db Database, kind string, sqls []string) error {
+	for _, query := range getDirectives(kind, sqls) {
+		ok, err := checkConditionContext(ctx, db, query)
+		if err != nil {
+			return fmt.Errorf("could not check %s condition %q: %v", kind, query, err)
+		}
+		if !ok {
+			return fmt.Errorf("%s condition not met: %s", kind, query)
+		}
+	}
 	return nil
 }
 
+// checkConditionContext reports whether a query returns a single true value.  False, NULL, or no
+// rows all count as the condition not being met.
+func checkConditionContext(ctx context.Context, db Database, query string) (bool, error) {
+	var ok sql.NullBool
+	err := db.QueryRowContext(ctx, query).Scan(&ok)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return ok.Valid && ok.Bool, err
+}
+
 // deprecated use FakeMigrateForwardToContext
 func FakeMigrateForwardTo(name string, db Database, allMigrations []Migration, confirm bool) error {
 	return FakeMigrateForwardToContext(context.TODO(), name, db, allMigrations, confirm)
@@ -215,32 +624,125 @@ func FakeMigrateForwardTo(name string, db Database, allMigrations []Migration, c
 // migration_state table, up to and including the one specified by `name`, without actually running
 // their ForwardSQL. To fake all un-run migrations, set `name` to an empty string.
 func FakeMigrateForwardToContext(ctx context.Context, name string, db Database, allMigrations []Migration, confirm bool) error {
-	state, err := GetMigrationStateContext(ctx, db)
+	return FakeMigrateForwardToWithOptions(ctx, name, db, allMigrations, confirm, Options{})
+}
+
+// FakeMigrateForwardToWithOptions works like FakeMigrateForwardToContext, run with opts.  Hooks
+// are called around faked migrations just as around ones that are run.
+func FakeMigrateForwardToWithOptions(ctx context.Context, name string, db Database, allMigrations []Migration, confirm bool, opts Options) error {
+	state, err := getSetStateContext(ctx, db, allMigrations)
 	if err != nil {
 		return fmt.Errorf("could not get migration state: %v", err)
 	}
 
-	toRun, err := getForwardMigrationsToRun(name, state, allMigrations)
+	toRun, err := getPhaseForwardMigrationsToRun(opts.Phase, name, state, allMigrations)
 	if err != nil {
 		return err
 	}
 	if len(toRun) == 0 {
-		fmt.Println("No migrations to fake")
+		printNothingToRun(opts.output(), name, state, "fake")
 		return nil
 	}
 	if confirm {
-		if err := getConfirm(toRun, "Forward", os.Stdin); err != nil {
+		if err := getConfirm(toRun, "Forward", opts.output(), opts.input()); err != nil {
 			return err
 		}
 	}
-	for _, m := range toRun {
-		fmt.Printf("Faking %s... ", m.Name)
+	return runWithHooksContext(ctx, opts.hooks(), Forward, toRun, func(m Migration) error {
+		fmt.Fprintf(opts.output(), "Faking %s... ", m.Name)
 		_, err := db.ExecContext(ctx, "INSERT INTO migration_state (name) VALUES ($1)", m.Name)
 		if err != nil {
-			fmt.Println("Failure :(")
+			fmt.Fprintln(opts.output(), "Failure :(")
 			return fmt.Errorf("error faking migration: %v", err)
 		}
-		fmt.Println("Success!")
+		fmt.Fprintln(opts.output(), "Success!")
+		if err := storeMigrationContext(ctx, db, m); err != nil {
+			return fmt.Errorf("could not store backward SQL for %s (the migration has already been faked): %v", m.Name, err)
+		}
+		return nil
+	})
+}
+
+// GetStoredMigrationsContext returns the backward SQL stored in the migration_backward table for
+// each applied migration.  If that table does not exist, it returns an empty list.
+func GetStoredMigrationsContext(ctx context.Context, db Database) ([]StoredMigration, error) {
+	exists, err := tableExistsContext(ctx, db, "migration_backward")
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if !exists {
+		return []StoredMigration{}, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT name, backward_sql, checksum, time FROM migration_backward ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("get stored migrations: %v", err)
+	}
+	defer rows.Close()
+	stored := []StoredMigration{}
+	for rows.Next() {
+		var sm StoredMigration
+		if err := rows.Scan(&sm.Name, pq.Array(&sm.BackwardSQL), &sm.Checksum, &sm.Time); err != nil {
+			return nil, fmt.Errorf("get stored migrations: %v", err)
+		}
+		stored = append(stored, sm)
+	}
+	return stored, rows.Err()
+}
+
+// storeMigrationContext saves a copy of the migration's BackwardSQL in the migration_backward
+// table.  The table is created by the init migration, but databases initialized by older versions
+// of pomegranate get it here the first time.
+func storeMigrationContext(ctx context.Context, db Database, mig Migration) error {
+	exists, err := tableExistsContext(ctx, db, "migration_backward")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := db.ExecContext(ctx, backwardStoreSQL); err != nil {
+			return err
+		}
+	}
+	_, err = db.ExecContext(ctx, `
+      INSERT INTO migration_backward (name, backward_sql, checksum) VALUES ($1, $2, $3)
+      ON CONFLICT (name) DO UPDATE
+      SET backward_sql = EXCLUDED.backward_sql, checksum = EXCLUDED.checksum, time = now()`,
+		mig.Name, pq.Array(mig.BackwardSQL), mig.BackwardChecksum(),
+	)
+	return err
+}
+
+// deleteStoredMigrationContext removes a migration's stored BackwardSQL once it has been rolled
+// back.
+func deleteStoredMigrationContext(ctx context.Context, db Database, name string) error {
+	exists, err := tableExistsContext(ctx, db, "migration_backward")
+	if err != nil || !exists {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "DELETE FROM migration_backward WHERE name = $1", name)
+	return err
+}
+
+// tableExistsContext reports whether the named table exists in the schema that holds
+// pomegranate's bookkeeping tables.  The init migration creates them without naming a schema, so
+// that is the current schema: public, or the tenant's schema when migrating tenants.
+func tableExistsContext(ctx context.Context, db Database, table string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `
+      SELECT EXISTS (
+         SELECT 1
+         FROM   pg_tables
+         WHERE  schemaname = current_schema()
+         AND    tablename = $1
+       );`, table).Scan(&exists)
+	return exists, err
+}
+
+// randomSuffix returns a short random string of lowercase hex digits, suitable for making unique
+// database names.
+func randomSuffix() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
@@ -1,6 +1,7 @@
 package pomegranate
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -237,6 +238,65 @@ func TestMigrateBackwardTo(t *testing.T) {
 	)
 }
 
+func TestMigrateBackwardToStored(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	err := MigrateForwardTo("", db, goodMigrations[:4], false)
+	assert.Nil(t, err)
+	stored, err := GetStoredMigrationsContext(context.Background(), db)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(stored))
+
+	// an older binary only knows about the first two migrations
+	err = MigrateBackwardToStoredContext(context.Background(), goodMigrations[2].Name, db, goodMigrations[:2], false)
+	assert.Nil(t, err)
+	state, _ := GetMigrationState(db)
+	assert.Equal(t, goodMigrations[1].Name, state[len(state)-1].Name)
+	stored, err = GetStoredMigrationsContext(context.Background(), db)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(stored))
+}
+
+func TestMigrateToMatch(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	err := MigrateToMatchContext(ctx, db, goodMigrations[:2], false)
+	assert.Nil(t, err)
+	state, _ := GetMigrationState(db)
+	assert.Equal(t, goodMigrations[1].Name, state[len(state)-1].Name)
+
+	err = MigrateToMatchContext(ctx, db, goodMigrations[:4], false)
+	assert.Nil(t, err)
+	state, _ = GetMigrationState(db)
+	assert.Equal(t, goodMigrations[3].Name, state[len(state)-1].Name)
+
+	err = MigrateToMatchContext(ctx, db, goodMigrations[:3], false)
+	assert.Nil(t, err)
+	state, _ = GetMigrationState(db)
+	assert.Equal(t, goodMigrations[2].Name, state[len(state)-1].Name)
+}
+
+func TestPlanAndApply(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	err := MigrateForwardTo(goodMigrations[1].Name, db, goodMigrations, false)
+	assert.Nil(t, err)
+	plan, err := MakePlanContext(ctx, goodMigrations[3].Name, db, goodMigrations)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(plan.Migrations))
+
+	err = ApplyPlanContext(ctx, db, plan, goodMigrations, false)
+	assert.Nil(t, err)
+	state, _ := GetMigrationState(db)
+	assert.Equal(t, goodMigrations[3].Name, state[len(state)-1].Name)
+
+	// the plan cannot be applied a second time, because state has changed.
+	err = ApplyPlanContext(ctx, db, plan, goodMigrations, false)
+	assert.Equal(t, errors.New("plan is out of date: migration state has 4 entries, but plan was made with 2"), err)
+}
+
 func TestMigrateFailure(t *testing.T) {
 	db, cleanup := freshDB(t)
 	defer cleanup()
@@ -482,3 +542,50 @@ COMMIT;
 `},
 	},
 }
+
+func TestRequireEnsure(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	err := MigrateForwardToContext(ctx, "00002_foobar", db, goodMigrations, false)
+	assert.Nil(t, err)
+
+	mig := func(conditions string) Migration {
+		return Migration{
+			Name: "00003_backfill",
+			ForwardSQL: []string{conditions + `
+BEGIN;
+ALTER TABLE foo ADD COLUMN bar TEXT;
+UPDATE foo SET bar = stuff;
+INSERT INTO migration_state(name) VALUES ('00003_backfill');
+COMMIT;
+`},
+			BackwardSQL: []string{`BEGIN;
+ALTER TABLE foo DROP COLUMN bar;
+DELETE FROM migration_state WHERE name='00003_backfill';
+COMMIT;
+`},
+		}
+	}
+	migs := func(m Migration) []Migration {
+		return append(append([]Migration{}, goodMigrations[:2]...), m)
+	}
+
+	_, err = db.Exec("INSERT INTO foo (stuff) VALUES ('a'), (NULL)")
+	assert.Nil(t, err)
+	err = MigrateForwardToContext(ctx, "", db, migs(mig("-- pmg:require SELECT count(*) = 0 FROM foo WHERE stuff IS NULL")), false)
+	assert.Equal(t, "require condition not met: SELECT count(*) = 0 FROM foo WHERE stuff IS NULL", err.Error())
+
+	err = MigrateForwardToContext(ctx, "", db, migs(mig("-- pmg:ensure SELECT count(*) = 0 FROM foo WHERE bar IS NULL")), false)
+	assert.Equal(t, "ensure condition not met: SELECT count(*) = 0 FROM foo WHERE bar IS NULL (the migration has been rolled back)", err.Error())
+	state, _ := GetMigrationState(db)
+	assert.Equal(t, goodMigrations[1].Name, state[len(state)-1].Name)
+
+	_, err = db.Exec("DELETE FROM foo WHERE stuff IS NULL")
+	assert.Nil(t, err)
+	err = MigrateForwardToContext(ctx, "", db, migs(mig(`-- pmg:require SELECT count(*) = 0 FROM foo WHERE stuff IS NULL
+-- pmg:ensure SELECT count(*) = 0 FROM foo WHERE bar IS NULL`)), false)
+	assert.Nil(t, err)
+	state, _ = GetMigrationState(db)
+	assert.Equal(t, "00003_backfill", state[len(state)-1].Name)
+}
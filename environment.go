@@ -0,0 +1,135 @@
+package pomegranate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// SkippedMigration records a migration that was skipped, rather than run, because it is tagged
+// for other environments.
+type SkippedMigration struct {
+	Name        string
+	Environment string
+	Time        time.Time
+}
+
+// Environments returns the environments that the migration is tagged for, as listed in
+// "-- pmg:env" lines in its ForwardSQL.  Untagged migrations run in every environment.
+func (m Migration) Environments() []string {
+	envs := []string{}
+	for _, value := range getDirectives("env", m.ForwardSQL) {
+		envs = append(envs, strings.Fields(value)...)
+	}
+	return envs
+}
+
+// runsIn reports whether the migration should be run in env, rather than skipped.
+func (m Migration) runsIn(env string) bool {
+	envs := m.Environments()
+	if len(envs) == 0 {
+		return true
+	}
+	for _, e := range envs {
+		if e == env {
+			return true
+		}
+	}
+	return false
+}
+
+// ScratchEnvironment is the environment that migrations are run for in scratch databases, by
+// RoundTripContext, RunMigrationTestsContext, SquashContext, CheckSchemaFileContext and the
+// pomegranatetest package.  A scratch database isn't any real environment, so migrations tagged
+// for particular environments are skipped there.
+const ScratchEnvironment = "scratch"
+
+// checkEnvironment returns an error if no environment was given and any of toRun is tagged for
+// particular environments, since there's no telling whether those should run or be skipped.
+func checkEnvironment(env string, toRun []Migration) error {
+	if env != "" {
+		return nil
+	}
+	tagged := []string{}
+	for _, mig := range toRun {
+		if len(mig.Environments()) > 0 {
+			tagged = append(tagged, mig.Name)
+		}
+	}
+	if len(tagged) > 0 {
+		return fmt.Errorf(
+			"no environment given, but these migrations are tagged for particular environments: %s",
+			strings.Join(tagged, ", "),
+		)
+	}
+	return nil
+}
+
+// skipMigrationContext records a migration in migration_state without running it.
+func skipMigrationContext(ctx context.Context, db Database, mig Migration, env string, out io.Writer) error {
+	fmt.Fprintf(out, "Skipping %s, which is only for %s... ", mig.Name, strings.Join(mig.Environments(), ", "))
+	err := runInTxContext(ctx, db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, skippedStoreSQL); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, recordForwardSQL, mig.Name); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "INSERT INTO migration_skipped (name, environment) VALUES ($1, $2)", mig.Name, env)
+		return err
+	})
+	if err != nil {
+		fmt.Fprintln(out, "Failure :(")
+		return fmt.Errorf("error skipping migration: %v", err)
+	}
+	fmt.Fprintln(out, "Success!")
+	return nil
+}
+
+// unskipMigrationContext removes the records of a skipped migration, in place of running its
+// BackwardSQL.
+func unskipMigrationContext(ctx context.Context, db Database, name string, out io.Writer) error {
+	fmt.Fprintf(out, "Removing skipped %s... ", name)
+	err := runInTxContext(ctx, db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, recordBackwardSQL, name); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "DELETE FROM migration_skipped WHERE name = $1", name)
+		return err
+	})
+	if err != nil {
+		fmt.Fprintln(out, "Failure :(")
+		return fmt.Errorf("error removing skipped migration: %v", err)
+	}
+	fmt.Fprintln(out, "Success!")
+	return nil
+}
+
+// GetSkippedMigrationsContext returns the migrations recorded in migration_state that were
+// skipped rather than run, ordered by name.
+func GetSkippedMigrationsContext(ctx context.Context, db Database) ([]SkippedMigration, error) {
+	exists, err := tableExistsContext(ctx, db, "migration_skipped")
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return []SkippedMigration{}, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT name, environment, time FROM migration_skipped ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("get skipped migrations: %v", err)
+	}
+	defer rows.Close()
+	skipped := []SkippedMigration{}
+	for rows.Next() {
+		var s SkippedMigration
+		if err := rows.Scan(&s.Name, &s.Environment, &s.Time); err != nil {
+			return nil, fmt.Errorf("get skipped migrations: %v", err)
+		}
+		skipped = append(skipped, s)
+	}
+	return skipped, rows.Err()
+}
@@ -0,0 +1,112 @@
+package pomegranate
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvironments(t *testing.T) {
+	untagged := goodMigrations[1]
+	tagged := Migration{ForwardSQL: []string{"-- pmg:env dev test\n-- pmg:env staging\nSELECT 1;"}}
+	assert.Equal(t, []string{}, untagged.Environments())
+	assert.Equal(t, []string{"dev", "test", "staging"}, tagged.Environments())
+	assert.True(t, untagged.runsIn(""))
+	assert.True(t, untagged.runsIn("prod"))
+	assert.True(t, tagged.runsIn("dev"))
+	assert.True(t, tagged.runsIn("staging"))
+	assert.False(t, tagged.runsIn("prod"))
+	assert.False(t, tagged.runsIn(""))
+}
+
+func TestCheckEnvironment(t *testing.T) {
+	untagged := Migration{Name: "00002_foo"}
+	tagged := Migration{Name: "00003_seed", ForwardSQL: []string{"-- pmg:env dev\nSELECT 1;"}}
+	assert.Nil(t, checkEnvironment("", []Migration{untagged}))
+	assert.Nil(t, checkEnvironment("prod", []Migration{untagged, tagged}))
+	assert.Equal(t,
+		"no environment given, but these migrations are tagged for particular environments: 00003_seed",
+		checkEnvironment("", []Migration{untagged, tagged}).Error(),
+	)
+}
+
+func TestSkipMigrations(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	seed := Migration{
+		Name: "00002_seed",
+		ForwardSQL: []string{`-- pmg:env dev
+BEGIN;
+INSERT INTO foo (stuff) VALUES ('dev data');
+INSERT INTO migration_state(name) VALUES ('00002_seed');
+COMMIT;
+`},
+		BackwardSQL: []string{`BEGIN;
+DELETE FROM foo WHERE stuff = 'dev data';
+DELETE FROM migration_state WHERE name='00002_seed';
+COMMIT;
+`},
+	}
+	migs := append(append([]Migration{}, goodMigrations[:2]...), seed, goodMigrations[2])
+	ctx := context.Background()
+
+	// without an environment, nothing is run or skipped
+	err := MigrateForwardToContext(ctx, "", db, migs, false)
+	assert.NotNil(t, err)
+	state, _ := GetMigrationState(db)
+	assert.Equal(t, 0, len(state))
+
+	err = MigrateForwardToWithOptions(ctx, "", db, migs, false, Options{Environment: "prod"})
+	assert.Nil(t, err)
+	state, _ = GetMigrationState(db)
+	assert.Equal(t, []string{"00001_init", "00002_foobar", "00002_seed", "00003_foobaz"}, recordNames(state))
+	skipped, err := GetSkippedMigrationsContext(ctx, db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(skipped))
+	assert.Equal(t, "00002_seed", skipped[0].Name)
+	assert.Equal(t, "prod", skipped[0].Environment)
+	var count int
+	db.QueryRow("SELECT count(*) FROM foo").Scan(&count)
+	assert.Equal(t, 0, count)
+
+	// rolling back past a skipped migration doesn't run its backward SQL
+	err = MigrateBackwardToContext(ctx, "00002_seed", db, migs, false)
+	assert.Nil(t, err)
+	state, _ = GetMigrationState(db)
+	assert.Equal(t, []string{"00001_init", "00002_foobar"}, recordNames(state))
+	skipped, _ = GetSkippedMigrationsContext(ctx, db)
+	assert.Equal(t, 0, len(skipped))
+
+	err = MigrateForwardToWithOptions(ctx, "", db, migs, false, Options{Environment: "dev"})
+	assert.Nil(t, err)
+	db.QueryRow("SELECT count(*) FROM foo").Scan(&count)
+	assert.Equal(t, 1, count)
+}
+
+// devTableMigration returns a migration, tagged for the dev environment, that creates a table.
+func devTableMigration(name string) Migration {
+	return Migration{
+		Name: name,
+		ForwardSQL: []string{fmt.Sprintf(`-- pmg:env dev
+BEGIN;
+CREATE TABLE dev_only (id INT);
+INSERT INTO migration_state(name) VALUES ('%s');
+COMMIT;
+`, name)},
+		BackwardSQL: []string{fmt.Sprintf(`BEGIN;
+DROP TABLE dev_only;
+DELETE FROM migration_state WHERE name='%s';
+COMMIT;
+`, name)},
+	}
+}
+
+func recordNames(state []MigrationRecord) []string {
+	names := []string{}
+	for _, rec := range state {
+		names = append(names, rec.Name)
+	}
+	return names
+}
@@ -2,6 +2,8 @@ package pomegranate
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go/format"
 	"io"
@@ -135,6 +137,132 @@ func ReadMigrationFiles(dir string) ([]Migration, error) {
 	return ReadMigrationFS(OsDir(dir))
 }
 
+// GetMigrationRange returns the migrations from allMigrations starting with `from` and ending with
+// `to`, inclusive.  An empty `from` starts at the first migration, and an empty `to` ends at the
+// last.  If backward is true, the migrations are returned most recent first, ready for a backward
+// script.
+func GetMigrationRange(from, to string, allMigrations []Migration, backward bool) ([]Migration, error) {
+	migs, err := getMigrationRange(from, to, allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	if backward {
+		return reverseMigrations(migs), nil
+	}
+	return migs, nil
+}
+
+// WriteScript writes the SQL for the given migrations, in order, to w as a single script that can
+// be run with psql.  If backward is true, each migration's BackwardSQL is written instead of its
+// ForwardSQL; callers are responsible for ordering the migrations most recent first in that case.
+// Migrations written in Go can't be included, and cause an error.
+func WriteScript(w io.Writer, migs []Migration, backward bool) error {
+	if len(migs) == 0 {
+		return errors.New("no migrations to write")
+	}
+	for _, mig := range migs {
+		if mig.IsGo() {
+			return fmt.Errorf("migration %s is written in Go and can't be included in a script", mig.Name)
+		}
+	}
+	direction, fileName := "Forward", "forward"
+	if backward {
+		direction, fileName = "Backward", "backward"
+	}
+	_, err := fmt.Fprintf(w, scriptHeaderTmpl, direction, migs[0].Name, migs[len(migs)-1].Name)
+	if err != nil {
+		return err
+	}
+	for _, mig := range migs {
+		sqls := mig.ForwardSQL
+		if backward {
+			sqls = mig.BackwardSQL
+		}
+		for i, sql := range sqls {
+			part := fileName + ".sql"
+			if len(sqls) > 1 {
+				part = fmt.Sprintf("%s part %d of %d", fileName, i+1, len(sqls))
+			}
+			if _, err := fmt.Fprintf(w, scriptMigrationTmpl, mig.Name, part); err != nil {
+				return err
+			}
+			if !strings.HasSuffix(sql, "\n") {
+				sql += "\n"
+			}
+			if _, err := io.WriteString(w, sql); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteScriptFile writes a script for the given migrations to fileName.  See WriteScript.
+func WriteScriptFile(fileName string, migs []Migration, backward bool) error {
+	var buf bytes.Buffer
+	if err := WriteScript(&buf, migs, backward); err != nil {
+		return fmt.Errorf("error making script: %v", err)
+	}
+	if err := ioutil.WriteFile(fileName, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing script file: %v", err)
+	}
+	fmt.Printf("Script written to %s\n", fileName)
+	return nil
+}
+
+// WritePlanFile saves a Plan as JSON to the given path.
+func WritePlanFile(fileName string, p Plan) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding plan: %v", err)
+	}
+	err = ioutil.WriteFile(fileName, append(b, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing plan file: %v", err)
+	}
+	fmt.Printf("Plan written to %s\n", fileName)
+	return nil
+}
+
+// ReadPlanFile loads a Plan saved by WritePlanFile.
+func ReadPlanFile(fileName string) (Plan, error) {
+	var p Plan
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return p, fmt.Errorf("error reading plan file: %v", err)
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return p, fmt.Errorf("error decoding plan file %s: %v", fileName, err)
+	}
+	return p, nil
+}
+
+// ReadDatabaseURLFile reads a list of database URLs, one per line, for MigrateFleetContext.  Blank
+// lines and lines starting with # are ignored.  Every other line must be a postgres:// URL, so
+// that the database can be named in output without its password.
+func ReadDatabaseURLFile(fileName string) ([]string, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading database url file: %v", err)
+	}
+	dials := []string{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !isDatabaseURL(line) {
+			// the line isn't quoted, as it may hold a password
+			return nil, fmt.Errorf("line %d of %s is not a postgres:// url", i+1, fileName)
+		}
+		dials = append(dials, line)
+	}
+	if len(dials) == 0 {
+		return nil, fmt.Errorf("no database urls in %s", fileName)
+	}
+	return dials, nil
+}
+
 // return a list of subdirs that match our pattern
 func getMigrationDirectoryNames(dir fs.ReadDirFS) ([]string, error) {
 	names := []string{}
@@ -168,6 +296,24 @@ func getLatestMigrationFileNumber(names []string) (int, error) {
 	return num, nil
 }
 
+// nextMigrationName returns the name for a new migration following `previous`, numbered the same
+// way: auto-incrementing if `previous` has a zero-padded number, or with the current time if it
+// has a timestamp.
+func nextMigrationName(previous, name string) (string, error) {
+	if len(strings.Split(previous, "_")[0]) > leadingDigits {
+		num, err := strconv.Atoi(time.Now().UTC().Format(timestampFormat))
+		if err != nil {
+			return "", fmt.Errorf("error creating timestamp: %v", err)
+		}
+		return makeStubName(num, name), nil
+	}
+	num, err := getLatestMigrationFileNumber([]string{previous})
+	if err != nil {
+		return "", err
+	}
+	return makeStubName(num+1, name), nil
+}
+
 func writeStubs(dir, name, forwardSQL, backwardSQL string) error {
 	newFolder := path.Join(dir, name)
 	err := os.Mkdir(newFolder, 0755)
@@ -187,6 +333,23 @@ func writeStubs(dir, name, forwardSQL, backwardSQL string) error {
 	return nil
 }
 
+// archiveMigrations moves the directories for the given migrations into an "archive" directory
+// inside dir, where they will no longer be read as migrations.
+func archiveMigrations(dir string, migs []Migration) error {
+	archiveDir := path.Join(dir, "archive")
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return fmt.Errorf("error creating archive directory %s: %v", archiveDir, err)
+	}
+	for _, mig := range migs {
+		err := os.Rename(path.Join(dir, mig.Name), path.Join(archiveDir, mig.Name))
+		if err != nil {
+			return fmt.Errorf("error archiving migration: %v", err)
+		}
+	}
+	fmt.Printf("%d migrations moved to %s\n", len(migs), archiveDir)
+	return nil
+}
+
 func makeStubName(numPart int, namePart string) string {
 	return fmt.Sprintf("%s_%s", zeroPad(numPart, leadingDigits), namePart)
 }
@@ -234,6 +397,12 @@ func readMigration(dir fs.ReadDirFS, migrationName string) (Migration, error) {
 	}
 
 	for _, migration := range migrationDirs { // iterate over all the migration folders
+		if migration.IsDir() && migration.Name() == "test" {
+			if err := readMigrationTest(dir, &m); err != nil {
+				return m, err
+			}
+			continue
+		}
 		if n := migration.Name(); strings.HasSuffix(n, ".sql") { // looking for "*.sql" files
 			if strings.Contains(n, "forward") {
 				m.ForwardSQL = append(m.ForwardSQL, readEntry(n))
@@ -248,6 +417,33 @@ func readMigration(dir fs.ReadDirFS, migrationName string) (Migration, error) {
 	return m, nil
 }
 
+// readMigrationTest reads the optional before.sql and assert.sql files in the migration's test
+// directory.
+func readMigrationTest(dir fs.ReadDirFS, m *Migration) error {
+	testDir := path.Join(m.Name, "test")
+	entries, err := dir.ReadDir(testDir)
+	if err != nil {
+		return fmt.Errorf("Unable to list directory: %w", err)
+	}
+	for _, entry := range entries {
+		var dest *string
+		switch entry.Name() {
+		case "before.sql":
+			dest = &m.TestBeforeSQL
+		case "assert.sql":
+			dest = &m.TestAssertSQL
+		default:
+			continue
+		}
+		b, err := fs.ReadFile(dir, path.Join(testDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("Unable to read %q: %w", entry.Name(), err)
+		}
+		*dest = string(b)
+	}
+	return nil
+}
+
 func writeGoMigrations(dir string, goFile string, packageName string, migs []Migration, generateTag bool) error {
 	tmpl, err := template.New("migrations").Parse(srcTmpl)
 	if err != nil {
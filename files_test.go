@@ -1,7 +1,9 @@
 package pomegranate
 
 import (
+	"bytes"
 	"embed"
+	"errors"
 	"fmt"
 	"io/fs"
 	"io/ioutil"
@@ -104,6 +106,17 @@ func TestNewMigrationTimestamp(t *testing.T) {
 	)
 }
 
+func TestNextMigrationName(t *testing.T) {
+	name, err := nextMigrationName("00001_init", "baseline")
+	assert.Nil(t, err)
+	assert.Equal(t, "00002_baseline", name)
+	name, err = nextMigrationName("20181106123456_init", "baseline")
+	assert.Nil(t, err)
+	assert.Regexp(t, `^\d{14}_baseline$`, name)
+	_, err = nextMigrationName("bad_init", "baseline")
+	assert.NotNil(t, err)
+}
+
 func TestReadMigrations(t *testing.T) {
 	dir, _ := ioutil.TempDir(".", "pmgtest")
 	defer os.RemoveAll(dir)
@@ -121,6 +134,9 @@ func TestReadMigrations(t *testing.T) {
 	ioutil.WriteFile(path.Join(m1, "backward.sql"), []byte("m1 backward"), 0644)
 	ioutil.WriteFile(path.Join(m2, "forward.sql"), []byte("m2 forward"), 0644)
 	ioutil.WriteFile(path.Join(m2, "backward.sql"), []byte("m2 backward"), 0644)
+	os.Mkdir(path.Join(m2, "test"), 0755)
+	ioutil.WriteFile(path.Join(m2, "test", "before.sql"), []byte("m2 before"), 0644)
+	ioutil.WriteFile(path.Join(m2, "test", "assert.sql"), []byte("m2 assert"), 0644)
 	ioutil.WriteFile(path.Join(m3, "forward.sql"), []byte("m3 forward"), 0644)
 	ioutil.WriteFile(path.Join(m3, "backward.sql"), []byte("m3 backward"), 0644)
 	ioutil.WriteFile(path.Join(m4, "forward.sql"), []byte("m4 forward"), 0644)
@@ -136,9 +152,11 @@ func TestReadMigrations(t *testing.T) {
 			BackwardSQL: []string{"m1 backward"},
 		},
 		{
-			Name:        "00002_bar",
-			ForwardSQL:  []string{"m2 forward"},
-			BackwardSQL: []string{"m2 backward"},
+			Name:          "00002_bar",
+			ForwardSQL:    []string{"m2 forward"},
+			BackwardSQL:   []string{"m2 backward"},
+			TestBeforeSQL: "m2 before",
+			TestAssertSQL: "m2 assert",
 		},
 		{
 			Name:        "00005_sos",
@@ -190,6 +208,75 @@ func TestIngestMigrations(t *testing.T) {
 	)
 }
 
+func TestPlanFile(t *testing.T) {
+	dir, _ := ioutil.TempDir(".", "pmgtest")
+	defer os.RemoveAll(dir)
+	plan := makePlan(
+		DatabaseIdentity{Name: "db", Host: "localhost", Port: 5432},
+		[]MigrationRecord{{Name: "00001_init"}},
+		[]Migration{{Name: "00002_foo", ForwardSQL: []string{"foo forward"}, BackwardSQL: []string{"foo backward"}}},
+	)
+	plan.Created = time.Date(2018, 11, 6, 12, 34, 56, 0, time.UTC)
+	fileName := path.Join(dir, "plan.json")
+	err := WritePlanFile(fileName, plan)
+	assert.Nil(t, err)
+	read, err := ReadPlanFile(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, plan, read)
+}
+
+func TestReadDatabaseURLFile(t *testing.T) {
+	dir, _ := ioutil.TempDir(".", "pmgtest")
+	defer os.RemoveAll(dir)
+	fileName := path.Join(dir, "shards.txt")
+	ioutil.WriteFile(fileName, []byte("# us-east\npostgres://db1/shard_1\n\n  postgres://db2/shard_2  \n"), 0644)
+	dials, err := ReadDatabaseURLFile(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"postgres://db1/shard_1", "postgres://db2/shard_2"}, dials)
+
+	ioutil.WriteFile(fileName, []byte("# nothing yet\n"), 0644)
+	_, err = ReadDatabaseURLFile(fileName)
+	assert.Equal(t, "no database urls in "+fileName, err.Error())
+
+	ioutil.WriteFile(fileName, []byte("postgres://db1/shard_1\nhost=db2 password=secret dbname=shard_2\n"), 0644)
+	_, err = ReadDatabaseURLFile(fileName)
+	assert.Equal(t, "line 2 of "+fileName+" is not a postgres:// url", err.Error())
+}
+
+func TestWriteScript(t *testing.T) {
+	migs := []Migration{
+		{Name: "00002_foo", ForwardSQL: []string{"foo forward;\n"}, BackwardSQL: []string{"foo backward;\n"}},
+		{Name: "00003_bar", ForwardSQL: []string{"bar forward 1;", "bar forward 2;"}, BackwardSQL: []string{"bar backward;"}},
+	}
+	var buf bytes.Buffer
+	err := WriteScript(&buf, migs, false)
+	assert.Nil(t, err)
+	assert.Equal(t, `-- Generated by pmg. Forward migrations 00002_foo through 00003_bar.
+-- Run with: psql -f <this file>
+\set ON_ERROR_STOP on
+
+-- ======== 00002_foo (forward.sql) ========
+foo forward;
+
+-- ======== 00003_bar (forward part 1 of 2) ========
+bar forward 1;
+
+-- ======== 00003_bar (forward part 2 of 2) ========
+bar forward 2;
+`, buf.String())
+
+	buf.Reset()
+	backward, err := GetMigrationRange("", "", migs, true)
+	assert.Nil(t, err)
+	err = WriteScript(&buf, backward, true)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "Backward migrations 00003_bar through 00002_foo.")
+	assert.Contains(t, buf.String(), "-- ======== 00003_bar (backward.sql) ========\nbar backward;\n")
+
+	err = WriteScript(&buf, []Migration{}, false)
+	assert.Equal(t, errors.New("no migrations to write"), err)
+}
+
 //go:embed fixtures/embed
 var embedded embed.FS
 var testMigrations = FromEmbed(embedded, "fixtures/embed")
@@ -0,0 +1,204 @@
+package pomegranate
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FleetOptions controls how MigrateFleetContext works through its databases.
+type FleetOptions struct {
+	// Concurrency is the number of databases migrated at a time.  Less than 1 means 1.
+	Concurrency int
+	// Canary migrates the first database on its own before any others, and stops if it fails.
+	Canary bool
+	// StopOnFailure stops starting new databases once one has failed.  Databases already being
+	// migrated are finished.
+	StopOnFailure bool
+	// Confirm lists the migrations that each database will run, and asks once for confirmation
+	// before any of them are migrated.
+	Confirm bool
+	// Options are used to migrate each database, including applying Repeatables.  Hooks may be
+	// called for several databases at once.  Each line of progress written to Output starts with
+	// the database it is about.
+	Options
+}
+
+// FleetResult reports what happened when a database was migrated by MigrateFleetContext.
+// Database names the database by host and name, leaving out any password in its URL.  State is
+// the database's migration state afterwards, and is nil if it couldn't be read.  Started is false
+// for databases that were never reached, because of an earlier failure or because the context
+// was cancelled.
+type FleetResult struct {
+	Database string
+	Started  bool
+	Error    error
+	Duration time.Duration
+	State    []MigrationRecord
+}
+
+// OK reports whether the database was migrated without error.
+func (r FleetResult) OK() bool {
+	return r.Started && r.Error == nil
+}
+
+// String is the RESULT column of pmg's fleet table: "ok", "failed: " and the error, or "not run"
+// for a database that was never reached.  The migration it reached is reported by Latest.
+func (r FleetResult) String() string {
+	return runStatus(r.Started, r.Error)
+}
+
+// Latest returns the name of the last migration in the database's state after it was migrated,
+// or an empty string if it has none or its state couldn't be read.
+func (r FleetResult) Latest() string {
+	if len(r.State) == 0 {
+		return ""
+	}
+	return r.State[len(r.State)-1].Name
+}
+
+// MigrateFleetContext runs all the forward migrations that have not yet been run, up to and
+// including the one specified by `name`, against each of the databases that dials point to, such
+// as the shards of a sharded database or the clusters in each region.  To run all un-run
+// migrations, set `name` to an empty string.  The results are in the same order as dials.  It
+// returns an error, without migrating any database, if the migrations to confirm can't be found
+// or they aren't confirmed.
+func MigrateFleetContext(ctx context.Context, name string, dials []string, allMigrations []Migration, opts FleetOptions) ([]FleetResult, error) {
+	results := make([]FleetResult, len(dials))
+	for i, dial := range dials {
+		results[i].Database = databaseLabel(dial)
+	}
+	if opts.Confirm {
+		if err := confirmFleetContext(ctx, name, dials, allMigrations, opts.Options); err != nil {
+			return results, err
+		}
+	}
+	var outMu sync.Mutex
+	migrate := func(dial string, result *FleetResult) {
+		out := newPrefixWriter(opts.output(), &outMu, result.Database+": ")
+		defer out.Flush()
+		dbOpts := opts.Options
+		dbOpts.Output = out
+		migrateFleetDatabaseContext(ctx, name, dial, allMigrations, dbOpts, result)
+	}
+	start := 0
+	if opts.Canary && len(dials) > 0 {
+		results[0].Started = true
+		migrate(dials[0], &results[0])
+		if !results[0].OK() {
+			return results, nil
+		}
+		start = 1
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := false
+	for i := start; i < len(dials); i++ {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+		mu.Lock()
+		stop := ctx.Err() != nil || (opts.StopOnFailure && failed)
+		mu.Unlock()
+		if stop {
+			<-slots
+			continue
+		}
+		results[i].Started = true
+		wg.Add(1)
+		go func(dial string, result *FleetResult) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			migrate(dial, result)
+			if !result.OK() {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}(dials[i], &results[i])
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// confirmFleetContext lists the migrations that each database will run, and asks for
+// confirmation, unless there are none to run.
+func confirmFleetContext(ctx context.Context, name string, dials []string, allMigrations []Migration, opts Options) error {
+	labels := []string{}
+	plans := [][]Migration{}
+	pending := false
+	for _, dial := range dials {
+		label := databaseLabel(dial)
+		toRun, err := getFleetDatabaseMigrationsContext(ctx, name, dial, allMigrations, opts)
+		if err != nil {
+			return fmt.Errorf("could not get migrations to run for %s: %v", label, err)
+		}
+		labels = append(labels, label)
+		plans = append(plans, toRun)
+		pending = pending || len(toRun) > 0
+	}
+	if !pending {
+		return nil
+	}
+	return getFleetConfirm(labels, plans, opts.output(), opts.input())
+}
+
+// getFleetDatabaseMigrationsContext returns the migrations that migrateFleetDatabaseContext would
+// run against the database that dial points to.
+func getFleetDatabaseMigrationsContext(ctx context.Context, name, dial string, allMigrations []Migration, opts Options) ([]Migration, error) {
+	db, err := connect(dial, opts.output())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return GetForwardMigrationsWithOptions(ctx, name, db, allMigrations, opts)
+}
+
+// migrateFleetDatabaseContext migrates a single database for MigrateFleetContext, and records
+// how it went in result.
+func migrateFleetDatabaseContext(ctx context.Context, name, dial string, allMigrations []Migration, opts Options, result *FleetResult) {
+	begin := time.Now()
+	defer func() { result.Duration = time.Since(begin) }()
+	db, err := connect(dial, opts.output())
+	if err != nil {
+		result.Error = err
+		return
+	}
+	defer db.Close()
+	result.Error = MigrateForwardToWithOptions(ctx, name, db, allMigrations, false, opts)
+	if state, err := getSetStateContext(ctx, db, allMigrations); err == nil {
+		result.State = state
+	}
+}
+
+// databaseLabel names the database that dial points to by its host and name, so that it can be
+// printed without the password.  Dials that aren't postgres:// URLs, like "host=db1
+// password=secret", aren't named at all.
+func databaseLabel(dial string) string {
+	if !isDatabaseURL(dial) {
+		return "unparseable database url"
+	}
+	u, _ := url.Parse(dial)
+	return u.Host + "/" + strings.Trim(u.Path, "/")
+}
+
+// isDatabaseURL reports whether dial is a postgres:// or postgresql:// URL naming a host or a
+// database.
+func isDatabaseURL(dial string) bool {
+	u, err := url.Parse(dial)
+	if err != nil || u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return false
+	}
+	return u.Host != "" || strings.Trim(u.Path, "/") != ""
+}
@@ -4,8 +4,10 @@ go 1.18
 
 require (
 	github.com/lib/pq v1.10.7
+	github.com/pganalyze/pg_query_go/v5 v5.1.0
 	github.com/stretchr/testify v1.2.1
 	github.com/urfave/cli/v2 v2.2.0
+	google.golang.org/protobuf v1.31.0
 )
 
 require (
@@ -0,0 +1,126 @@
+package pomegranate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	recordForwardSQL  = "INSERT INTO migration_state(name) VALUES ($1)"
+	recordBackwardSQL = "DELETE FROM migration_state WHERE name = $1"
+)
+
+// AddGoMigrations returns migrations with goMigrations added, ordered by name.  Go migrations are
+// named just like SQL migrations, so they can be registered next to the ones read by
+// ReadMigrationFS:
+//
+//	sqlMigrations, err := pomegranate.ReadMigrationFS(migrationDir)
+//	...
+//	all, err := pomegranate.AddGoMigrations(sqlMigrations, pomegranate.Migration{
+//		Name:         "00012_reencrypt_ssns",
+//		ForwardFunc:  reencryptSSNs,
+//		BackwardFunc: decryptSSNs,
+//	})
+//
+// Unlike SQL migrations, Go migrations don't insert their own migration_state records; pomegranate
+// does it for them.
+func AddGoMigrations(migrations []Migration, goMigrations ...Migration) ([]Migration, error) {
+	all := append([]Migration{}, migrations...)
+	names := map[string]bool{}
+	for _, mig := range migrations {
+		names[mig.Name] = true
+	}
+	for _, mig := range goMigrations {
+		if !isMigration(mig.Name) {
+			return nil, fmt.Errorf("%q is not a valid migration name", mig.Name)
+		}
+		if names[mig.Name] {
+			return nil, fmt.Errorf("migration %s is defined more than once", mig.Name)
+		}
+		if !mig.IsGo() {
+			return nil, fmt.Errorf("Go migration %s has no forward function", mig.Name)
+		}
+		if mig.ForwardFunc != nil && mig.ForwardNoTxFunc != nil {
+			return nil, fmt.Errorf("Go migration %s has both ForwardFunc and ForwardNoTxFunc", mig.Name)
+		}
+		if len(mig.ForwardSQL) > 0 || len(mig.BackwardSQL) > 0 {
+			return nil, fmt.Errorf("Go migration %s must not have SQL", mig.Name)
+		}
+		names[mig.Name] = true
+		all = append(all, mig)
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all, nil
+}
+
+// runMigrationContext runs one direction of a migration, whether it's written in SQL or Go, and
+// writes its progress to out.
+func runMigrationContext(ctx context.Context, db Database, mig Migration, direction Direction, out io.Writer) error {
+	if !mig.IsGo() {
+		sqlToRun := mig.ForwardSQL
+		if direction == Backward {
+			sqlToRun = mig.BackwardSQL
+		}
+		if namespaceOf(mig.Name) != "" {
+			return runNamespacedMigrationSQLContext(ctx, db, mig.Name, sqlToRun, direction, out)
+		}
+		return runMigrationSQLContext(ctx, db, mig.Name, sqlToRun, out)
+	}
+	fmt.Fprintf(out, "Running %s... ", mig.Name)
+	if err := runGoMigrationContext(ctx, db, mig, direction); err != nil {
+		fmt.Fprintln(out, "Failure :(")
+		return err
+	}
+	fmt.Fprintln(out, "Success!")
+	return nil
+}
+
+// runGoMigrationContext calls a Go migration's function for the direction, and records the
+// change in migration_state.
+func runGoMigrationContext(ctx context.Context, db Database, mig Migration, direction Direction) error {
+	txFunc, noTxFunc, record := mig.ForwardFunc, mig.ForwardNoTxFunc, recordForwardSQL
+	if direction == Backward {
+		txFunc, noTxFunc, record = mig.BackwardFunc, mig.BackwardNoTxFunc, recordBackwardSQL
+	}
+	switch {
+	case noTxFunc != nil:
+		if err := noTxFunc(ctx, db); err != nil {
+			return fmt.Errorf("error running migration: %v", err)
+		}
+		_, err := db.ExecContext(ctx, record, mig.Name)
+		return err
+	case txFunc != nil:
+		return runInTxContext(ctx, db, func(tx *sql.Tx) error {
+			if err := txFunc(ctx, tx); err != nil {
+				return fmt.Errorf("error running migration: %v", err)
+			}
+			_, err := tx.ExecContext(ctx, record, mig.Name)
+			return err
+		})
+	}
+	return fmt.Errorf("Go migration %s has no %s function", mig.Name, direction)
+}
+
+// runInTxContext calls f in a new transaction on db, and commits it if f returns nil.  If db is
+// already a transaction, f is called in it, and it is left to the caller to commit.
+func runInTxContext(ctx context.Context, db Database, f func(*sql.Tx) error) error {
+	if tx, ok := db.(*sql.Tx); ok {
+		return f(tx)
+	}
+	beginner, ok := db.(txBeginner)
+	if !ok {
+		return fmt.Errorf("cannot begin a transaction on %T", db)
+	}
+	tx, err := beginner.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,112 @@
+package pomegranate
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func noopMigration(ctx context.Context, tx *sql.Tx) error {
+	return nil
+}
+
+func TestAddGoMigrations(t *testing.T) {
+	sqlMigs := namesToMigs([]string{"00001_init", "00003_foo"})
+	all, err := AddGoMigrations(sqlMigs, Migration{Name: "00002_go", ForwardFunc: noopMigration})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"00001_init", "00002_go", "00003_foo"}, migsToNames(all))
+	assert.True(t, all[1].IsGo())
+	assert.False(t, all[0].IsGo())
+
+	tt := []struct {
+		desc string
+		mig  Migration
+		err  string
+	}{
+		{
+			desc: "bad name",
+			mig:  Migration{Name: "go", ForwardFunc: noopMigration},
+			err:  `"go" is not a valid migration name`,
+		},
+		{
+			desc: "duplicate",
+			mig:  Migration{Name: "00003_foo", ForwardFunc: noopMigration},
+			err:  "migration 00003_foo is defined more than once",
+		},
+		{
+			desc: "no function",
+			mig:  Migration{Name: "00002_go"},
+			err:  "Go migration 00002_go has no forward function",
+		},
+		{
+			desc: "SQL",
+			mig:  Migration{Name: "00002_go", ForwardFunc: noopMigration, BackwardSQL: []string{"SELECT 1"}},
+			err:  "Go migration 00002_go must not have SQL",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := AddGoMigrations(sqlMigs, tc.mig)
+			assert.Equal(t, tc.err, err.Error())
+		})
+	}
+}
+
+func TestWriteScriptGo(t *testing.T) {
+	err := WriteScript(&bytes.Buffer{}, []Migration{{Name: "00002_go", ForwardFunc: noopMigration}}, false)
+	assert.Equal(t, "migration 00002_go is written in Go and can't be included in a script", err.Error())
+}
+
+func TestDisplayName(t *testing.T) {
+	assert.Equal(t, "00002_go (Go)", displayName(Migration{Name: "00002_go", ForwardFunc: noopMigration}))
+	assert.Equal(t, "00002_foobar", displayName(goodMigrations[1]))
+}
+
+func TestGoMigrations(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	backfill := Migration{
+		Name: "00003_backfill",
+		ForwardFunc: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "INSERT INTO foo (stuff) VALUES ('from go')")
+			return err
+		},
+		BackwardFunc: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "DELETE FROM foo WHERE stuff = 'from go'")
+			return err
+		},
+	}
+	broken := Migration{
+		Name: "00004_broken",
+		ForwardNoTxFunc: func(ctx context.Context, db Database) error {
+			return errors.New("boom")
+		},
+	}
+	migs, err := AddGoMigrations(goodMigrations[:2], backfill, broken)
+	assert.Nil(t, err)
+
+	err = MigrateForwardToContext(ctx, "00003_backfill", db, migs, false)
+	assert.Nil(t, err)
+	state, _ := GetMigrationState(db)
+	assert.Equal(t, "00003_backfill", state[len(state)-1].Name)
+	var count int
+	db.QueryRow("SELECT count(*) FROM foo").Scan(&count)
+	assert.Equal(t, 1, count)
+
+	err = MigrateForwardToContext(ctx, "", db, migs, false)
+	assert.Equal(t, "error running migration: boom", err.Error())
+	state, _ = GetMigrationState(db)
+	assert.Equal(t, "00003_backfill", state[len(state)-1].Name)
+
+	err = MigrateBackwardToContext(ctx, "00003_backfill", db, migs, false)
+	assert.Nil(t, err)
+	state, _ = GetMigrationState(db)
+	assert.Equal(t, "00002_foobar", state[len(state)-1].Name)
+	db.QueryRow("SELECT count(*) FROM foo").Scan(&count)
+	assert.Equal(t, 0, count)
+}
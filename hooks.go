@@ -0,0 +1,86 @@
+package pomegranate
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Direction says which way migrations are being run.
+type Direction string
+
+const (
+	Forward  Direction = "forward"
+	Backward Direction = "backward"
+)
+
+// Hooks are called as migrations run, for things like pausing background workers, flushing caches
+// or emitting audit events.  Pass them in Options to MigrateForwardToWithOptions,
+// MigrateBackwardToWithOptions and the other WithOptions functions that run migrations.
+//
+// BeforeAll and AfterAll are called once around each batch of migrations run in one direction,
+// and not at all when there is nothing to run, and BeforeMigration and AfterMigration around each
+// migration.  An error returned by any of them aborts the run.  OnError is called when a
+// migration, or one of the hooks around it, fails.
+//
+// Embed NoHooks in a struct to implement only the methods you need.
+type Hooks interface {
+	BeforeAll(ctx context.Context, direction Direction, migrations []Migration) error
+	BeforeMigration(ctx context.Context, direction Direction, mig Migration) error
+	AfterMigration(ctx context.Context, direction Direction, mig Migration, duration time.Duration) error
+	AfterAll(ctx context.Context, direction Direction, migrations []Migration, duration time.Duration) error
+	OnError(ctx context.Context, direction Direction, mig Migration, err error)
+}
+
+// NoHooks implements Hooks by doing nothing.
+type NoHooks struct{}
+
+func (NoHooks) BeforeAll(context.Context, Direction, []Migration) error {
+	return nil
+}
+
+func (NoHooks) BeforeMigration(context.Context, Direction, Migration) error {
+	return nil
+}
+
+func (NoHooks) AfterMigration(context.Context, Direction, Migration, time.Duration) error {
+	return nil
+}
+
+func (NoHooks) AfterAll(context.Context, Direction, []Migration, time.Duration) error {
+	return nil
+}
+
+func (NoHooks) OnError(context.Context, Direction, Migration, error) {}
+
+// runWithHooksContext calls run for each migration, and hooks around them.
+func runWithHooksContext(ctx context.Context, hooks Hooks, direction Direction, toRun []Migration, run func(Migration) error) error {
+	if len(toRun) == 0 {
+		return nil
+	}
+	start := time.Now()
+	if err := hooks.BeforeAll(ctx, direction, toRun); err != nil {
+		return fmt.Errorf("BeforeAll hook failed: %v", err)
+	}
+	for _, mig := range toRun {
+		if err := hooks.BeforeMigration(ctx, direction, mig); err != nil {
+			err = fmt.Errorf("BeforeMigration hook failed for %s: %v", mig.Name, err)
+			hooks.OnError(ctx, direction, mig, err)
+			return err
+		}
+		migStart := time.Now()
+		if err := run(mig); err != nil {
+			hooks.OnError(ctx, direction, mig, err)
+			return err
+		}
+		if err := hooks.AfterMigration(ctx, direction, mig, time.Since(migStart)); err != nil {
+			err = fmt.Errorf("AfterMigration hook failed for %s: %v", mig.Name, err)
+			hooks.OnError(ctx, direction, mig, err)
+			return err
+		}
+	}
+	if err := hooks.AfterAll(ctx, direction, toRun, time.Since(start)); err != nil {
+		return fmt.Errorf("AfterAll hook failed: %v", err)
+	}
+	return nil
+}
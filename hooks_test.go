@@ -0,0 +1,142 @@
+package pomegranate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingHooks struct {
+	NoHooks
+	calls    []string
+	failOn   string
+	failWith error
+}
+
+func (h *recordingHooks) record(call string) error {
+	h.calls = append(h.calls, call)
+	if call == h.failOn {
+		return h.failWith
+	}
+	return nil
+}
+
+func (h *recordingHooks) BeforeAll(ctx context.Context, direction Direction, migs []Migration) error {
+	return h.record(fmt.Sprintf("BeforeAll %s %v", direction, migsToNames(migs)))
+}
+
+func (h *recordingHooks) BeforeMigration(ctx context.Context, direction Direction, mig Migration) error {
+	return h.record("BeforeMigration " + mig.Name)
+}
+
+func (h *recordingHooks) AfterMigration(ctx context.Context, direction Direction, mig Migration, d time.Duration) error {
+	return h.record("AfterMigration " + mig.Name)
+}
+
+func (h *recordingHooks) AfterAll(ctx context.Context, direction Direction, migs []Migration, d time.Duration) error {
+	return h.record("AfterAll")
+}
+
+func (h *recordingHooks) OnError(ctx context.Context, direction Direction, mig Migration, err error) {
+	h.record(fmt.Sprintf("OnError %s: %v", mig.Name, err))
+}
+
+func TestHooks(t *testing.T) {
+	migs := namesToMigs([]string{"00001_a", "00002_b"})
+	tt := []struct {
+		desc   string
+		failOn string
+		runErr string
+		err    string
+		calls  []string
+	}{
+		{
+			desc: "success",
+			calls: []string{
+				"BeforeAll forward [00001_a 00002_b]",
+				"BeforeMigration 00001_a", "run 00001_a", "AfterMigration 00001_a",
+				"BeforeMigration 00002_b", "run 00002_b", "AfterMigration 00002_b",
+				"AfterAll",
+			},
+		},
+		{
+			desc:   "migration fails",
+			runErr: "00002_b",
+			err:    "boom",
+			calls: []string{
+				"BeforeAll forward [00001_a 00002_b]",
+				"BeforeMigration 00001_a", "run 00001_a", "AfterMigration 00001_a",
+				"BeforeMigration 00002_b", "run 00002_b", "OnError 00002_b: boom",
+			},
+		},
+		{
+			desc:   "BeforeAll aborts",
+			failOn: "BeforeAll forward [00001_a 00002_b]",
+			err:    "BeforeAll hook failed: nope",
+			calls:  []string{"BeforeAll forward [00001_a 00002_b]"},
+		},
+		{
+			desc:   "BeforeMigration aborts",
+			failOn: "BeforeMigration 00001_a",
+			err:    "BeforeMigration hook failed for 00001_a: nope",
+			calls: []string{
+				"BeforeAll forward [00001_a 00002_b]",
+				"BeforeMigration 00001_a",
+				"OnError 00001_a: BeforeMigration hook failed for 00001_a: nope",
+			},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			hooks := &recordingHooks{failOn: tc.failOn, failWith: errors.New("nope")}
+			err := runWithHooksContext(context.Background(), hooks, Forward, migs, func(mig Migration) error {
+				hooks.record("run " + mig.Name)
+				if mig.Name == tc.runErr {
+					return errors.New("boom")
+				}
+				return nil
+			})
+			if tc.err == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, tc.err, err.Error())
+			}
+			assert.Equal(t, tc.calls, hooks.calls)
+		})
+	}
+}
+
+func TestNoHooks(t *testing.T) {
+	assert.Equal(t, NoHooks{}, Options{}.hooks())
+	hooks := &recordingHooks{}
+	assert.Equal(t, hooks, Options{Hooks: hooks}.hooks())
+}
+
+func TestHooksEmptyBatch(t *testing.T) {
+	hooks := &recordingHooks{}
+	err := runWithHooksContext(context.Background(), hooks, Backward, []Migration{}, func(Migration) error {
+		return errors.New("not called")
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string(nil), hooks.calls)
+}
+
+func TestFakeMigrateWithOptions(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	err := MigrateForwardToContext(ctx, "00001_init", db, goodMigrations, false)
+	assert.Nil(t, err)
+	hooks := &recordingHooks{}
+	err = FakeMigrateForwardToWithOptions(ctx, "00002_foobar", db, goodMigrations, false, Options{Hooks: hooks})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"BeforeAll forward [00002_foobar]",
+		"BeforeMigration 00002_foobar", "AfterMigration 00002_foobar",
+		"AfterAll",
+	}, hooks.calls)
+}
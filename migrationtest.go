@@ -0,0 +1,78 @@
+package pomegranate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// RunMigrationTestsContext runs the data test of every migration that has one.  Each test gets its
+// own scratch database on the server that dial points to: the migrations before the tested one
+// are run, then its TestBeforeSQL seeds data, then the migration is run forward, and finally each
+// statement in its TestAssertSQL is queried.  An assertion passes if it returns a single true
+// value; false, NULL, or no rows fail it.
+func RunMigrationTestsContext(ctx context.Context, dial string, allMigrations []Migration) ([]MigrationTestResult, error) {
+	results := []MigrationTestResult{}
+	for i, mig := range allMigrations {
+		if mig.TestBeforeSQL == "" && mig.TestAssertSQL == "" {
+			continue
+		}
+		result, err := runMigrationTestContext(ctx, dial, allMigrations[:i], mig)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// runMigrationTestContext runs a single migration's data test in a new scratch database.  Errors
+// in the test itself are recorded in the result; only failing to set up the scratch database is
+// returned as an error.
+func runMigrationTestContext(ctx context.Context, dial string, previous []Migration, mig Migration) (MigrationTestResult, error) {
+	result := MigrationTestResult{Name: mig.Name}
+	scratch, err := NewScratchDatabaseContext(ctx, dial)
+	if err != nil {
+		return result, err
+	}
+	defer scratch.Close()
+
+	opts := Options{Environment: ScratchEnvironment}
+	if err := runForwardMigrationsContext(ctx, scratch.DB, previous, opts); err != nil {
+		result.Error = fmt.Errorf("could not run earlier migrations: %v", err)
+		return result, nil
+	}
+	if strings.TrimSpace(mig.TestBeforeSQL) != "" {
+		if _, err := scratch.DB.ExecContext(ctx, mig.TestBeforeSQL); err != nil {
+			result.Error = fmt.Errorf("before.sql failed: %v", err)
+			return result, nil
+		}
+	}
+	if err := runForwardMigrationsContext(ctx, scratch.DB, []Migration{mig}, opts); err != nil {
+		result.Error = err
+		return result, nil
+	}
+	for _, assertion := range splitStatements(mig.TestAssertSQL) {
+		ok, err := checkConditionContext(ctx, scratch.DB, assertion)
+		if err != nil {
+			result.Error = fmt.Errorf("assert.sql failed: %v", err)
+			return result, nil
+		}
+		if !ok {
+			result.FailedAssertions = append(result.FailedAssertions, assertion)
+		}
+	}
+	return result, nil
+}
+
+// String returns the error that stopped the test, or the assertions from assert.sql that didn't
+// return true, separated by semicolons, or "ok" if the test passed.
+func (r MigrationTestResult) String() string {
+	switch {
+	case r.Error != nil:
+		return fmt.Sprintf("error: %v", r.Error)
+	case len(r.FailedAssertions) > 0:
+		return "failed: " + strings.Join(r.FailedAssertions, "; ")
+	}
+	return "ok"
+}
@@ -0,0 +1,52 @@
+package pomegranate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationTestResult(t *testing.T) {
+	assert.Equal(t, "ok", MigrationTestResult{Name: "00003_backfill"}.String())
+	r := MigrationTestResult{
+		Name:             "00003_backfill",
+		FailedAssertions: []string{"SELECT shouty = 'hi' FROM foo WHERE stuff = 'hi'", "SELECT NULL::bool"},
+	}
+	assert.False(t, r.OK())
+	assert.Equal(t, "failed: SELECT shouty = 'hi' FROM foo WHERE stuff = 'hi'; SELECT NULL::bool", r.String())
+	// an error stops the test, so the assertions checked before it don't tell the whole story
+	r.Error = errors.New("assert.sql failed: relation \"bar\" does not exist")
+	assert.Equal(t, "error: assert.sql failed: relation \"bar\" does not exist", r.String())
+}
+
+func TestRunMigrationTests(t *testing.T) {
+	backfill := Migration{
+		Name: "00003_backfill",
+		ForwardSQL: []string{`BEGIN;
+ALTER TABLE foo ADD COLUMN shouty TEXT;
+UPDATE foo SET shouty = upper(stuff);
+INSERT INTO migration_state(name) VALUES ('00003_backfill');
+COMMIT;
+`},
+		BackwardSQL: []string{`BEGIN;
+ALTER TABLE foo DROP COLUMN shouty;
+DELETE FROM migration_state WHERE name='00003_backfill';
+COMMIT;
+`},
+		TestBeforeSQL: "INSERT INTO foo (stuff) VALUES ('hi'), ('there');",
+		TestAssertSQL: `SELECT count(*) = 2 FROM foo WHERE shouty IS NOT NULL;
+SELECT shouty = 'HI' FROM foo WHERE stuff = 'hi';
+SELECT shouty = 'hi' FROM foo WHERE stuff = 'hi';
+SELECT NULL::bool;
+`,
+	}
+	migs := append(append([]Migration{}, goodMigrations[:2]...), backfill)
+	results, err := RunMigrationTestsContext(context.Background(), dburl, migs)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "00003_backfill", results[0].Name)
+	assert.Nil(t, results[0].Error)
+	assert.Equal(t, []string{"SELECT shouty = 'hi' FROM foo WHERE stuff = 'hi'", "SELECT NULL::bool"}, results[0].FailedAssertions)
+}
@@ -7,7 +7,12 @@
 package pomegranate
 
 import (
+	"context"
+	"database/sql"
+	"io"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -24,10 +29,37 @@ type MigrationRecord struct {
 // Migration contains the name and SQL for a migration.  Arrays of Migrations
 // are passed between many functions in the Pomegranate source.
 // SeperateForwardStatements runs SQL statements seperately, delinieated by ";"
+//
+// TestBeforeSQL and TestAssertSQL hold the migration's optional data test, read from
+// test/before.sql and test/assert.sql in its directory.  See RunMigrationTestsContext.
+//
+// Migrations written in Go set ForwardFunc and BackwardFunc, which run in a transaction, or
+// ForwardNoTxFunc and BackwardNoTxFunc, which don't, instead of ForwardSQL and BackwardSQL.  See
+// AddGoMigrations.
 type Migration struct {
-	Name        string
-	ForwardSQL  []string
-	BackwardSQL []string
+	Name             string
+	ForwardSQL       []string
+	BackwardSQL      []string
+	TestBeforeSQL    string
+	TestAssertSQL    string
+	ForwardFunc      MigrationFunc
+	BackwardFunc     MigrationFunc
+	ForwardNoTxFunc  NoTxMigrationFunc
+	BackwardNoTxFunc NoTxMigrationFunc
+}
+
+// MigrationFunc runs one direction of a Go migration inside a transaction.  Pomegranate commits
+// the transaction, after recording the migration in migration_state, if it returns nil.
+type MigrationFunc func(ctx context.Context, tx *sql.Tx) error
+
+// NoTxMigrationFunc runs one direction of a Go migration outside a transaction, for work that
+// commits as it goes, like a batched backfill.  The migration is recorded in migration_state
+// after it returns nil.
+type NoTxMigrationFunc func(ctx context.Context, db Database) error
+
+// IsGo reports whether the migration is written in Go rather than SQL.
+func (m Migration) IsGo() bool {
+	return m.ForwardFunc != nil || m.ForwardNoTxFunc != nil
 }
 
 // QuotedTemplateForward returns the ForwardSQL field of the Migration, properly escaped for easy
@@ -52,6 +84,39 @@ func (m Migration) QuotedTemplateBackward() []string {
 	return bwdSQLArr
 }
 
+// Replaces returns the names of the migrations that were squashed into this one, as listed in
+// "-- pmg:replaces" lines in its ForwardSQL, qualified by its namespace.  A database with all of
+// those migrations recorded is treated as if it had this migration recorded instead.
+func (m Migration) Replaces() []string {
+	names := []string{}
+	for _, value := range getDirectives("replaces", m.ForwardSQL) {
+		for _, name := range strings.Fields(value) {
+			names = append(names, qualifyReference(m.Name, name))
+		}
+	}
+	return names
+}
+
+// ForwardChecksum returns a hex encoded SHA-256 digest of the Migration's ForwardSQL.
+func (m Migration) ForwardChecksum() string {
+	return sqlChecksum(m.ForwardSQL)
+}
+
+// BackwardChecksum returns a hex encoded SHA-256 digest of the Migration's BackwardSQL.
+func (m Migration) BackwardChecksum() string {
+	return sqlChecksum(m.BackwardSQL)
+}
+
+// StoredMigration is the copy of a migration's BackwardSQL that pomegranate saves in the
+// migration_backward table when the migration is applied.  It allows rolling back migrations
+// whose source is no longer available, e.g. after reverting to an older binary.
+type StoredMigration struct {
+	Name        string    `db:"name"`
+	BackwardSQL []string  `db:"backward_sql"`
+	Checksum    string    `db:"checksum"`
+	Time        time.Time `db:"time"`
+}
+
 // MigrationLogRecord represents a specific migration run at a specific point in time.  Unlike
 // MigrationRecord, this is an append-only table, showing the complete history of all forward and
 // backward migrations.  It is populated automatically by a Postgres trigger created in the init
@@ -63,3 +128,174 @@ type MigrationLogRecord struct {
 	Op   string    `db:"op"`
 	Who  string    `db:"who"`
 }
+
+// DatabaseIdentity describes the database a Plan was made against, so that it is not
+// accidentally applied somewhere else.
+type DatabaseIdentity struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// PlannedMigration is a migration recorded in a Plan, along with checksums of its SQL at the time
+// the plan was made.
+type PlannedMigration struct {
+	Name             string   `json:"name"`
+	ForwardSQL       []string `json:"forward_sql"`
+	ForwardChecksum  string   `json:"forward_checksum"`
+	BackwardSQL      []string `json:"backward_sql"`
+	BackwardChecksum string   `json:"backward_checksum"`
+}
+
+// Plan is a saved, reviewable list of forward migrations to run against a specific database.  It
+// records the state of the database when it was made, and ApplyPlanContext will refuse to run it
+// if that state or the migrations' source have changed since.
+type Plan struct {
+	Version    int                `json:"version"`
+	Created    time.Time          `json:"created"`
+	Database   DatabaseIdentity   `json:"database"`
+	State      []string           `json:"state"`
+	Migrations []PlannedMigration `json:"migrations"`
+}
+
+const planVersion = 1
+
+// Schema describes the user-defined objects in a database, as read from the Postgres catalogs by
+// InspectSchemaContext.  Each list is sorted so that two databases with the same objects produce
+// identical Schemas, regardless of the order in which the objects were created.
+type Schema struct {
+	Schemas     []SchemaObject
+	Extensions  []SchemaObject
+	Types       []SchemaObject
+	Functions   []SchemaObject
+	Sequences   []SchemaObject
+	Tables      []Table
+	Constraints []SchemaObject
+	Indexes     []SchemaObject
+	Views       []SchemaObject
+	Triggers    []SchemaObject
+	Grants      []SchemaObject
+}
+
+// SchemaObject is a single database object and the DDL that creates it.  Table is set for objects
+// that belong to a table, like constraints, indexes and triggers.
+type SchemaObject struct {
+	Name       string
+	Table      string
+	Definition string
+}
+
+// Table is a table in a Schema.  Its Columns are in the order they appear in the table.
+type Table struct {
+	Name    string
+	Columns []Column
+}
+
+// Column is a column in a Table.  Default holds the column's default expression, or its identity
+// or generated column clause, if any.
+type Column struct {
+	Name    string
+	Type    string
+	NotNull bool
+	Default string
+}
+
+// SchemaDiff is a single difference between an expected and an actual Schema.  Change is
+// "missing" for objects that are only in the expected Schema, "extra" for objects that are only in
+// the actual Schema, and "changed" for objects whose definitions differ.
+type SchemaDiff struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Change   string `json:"change"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+// MigrationTestResult reports the outcome of a migration's data test.  Error is set if the test
+// could not be run to completion, and FailedAssertions lists the queries from assert.sql that did
+// not return true.
+type MigrationTestResult struct {
+	Name             string
+	Error            error
+	FailedAssertions []string
+}
+
+// OK reports whether the migration's data test passed.
+func (r MigrationTestResult) OK() bool {
+	return r.Error == nil && len(r.FailedAssertions) == 0
+}
+
+// RepeatableMigration is SQL that is re-applied whenever it changes, after all the versioned
+// migrations have run, like the definition of a view or function.  Repeatable migrations are
+// read from the repeatable directory next to the versioned migrations, one per .sql file.
+type RepeatableMigration struct {
+	Name string
+	SQL  string
+}
+
+// Checksum returns a hex encoded SHA-256 digest of the migration's SQL.
+func (r RepeatableMigration) Checksum() string {
+	return sqlChecksum([]string{r.SQL})
+}
+
+// RepeatableRecord records the checksum of a repeatable migration when it was last applied.
+type RepeatableRecord struct {
+	Name     string
+	Checksum string
+	Time     time.Time
+	Who      string
+}
+
+// Options changes how the WithOptions functions, like MigrateForwardToWithOptions, run
+// migrations.  The zero value runs them the same way as the functions without options.
+type Options struct {
+	// Hooks are called around the migrations that are run.  Nil means NoHooks.
+	Hooks Hooks
+	// Environment is the environment migrations are run for, like "dev" or "prod".  Migrations
+	// tagged with "-- pmg:env" lines in their ForwardSQL only run in the environments they list,
+	// and are skipped everywhere else.  Untagged migrations run in every environment.  Running a
+	// tagged migration without an Environment is an error.
+	//
+	// A skipped migration is still recorded in migration_state, so the migrations after it can
+	// run, and in migration_skipped, so that migrating backward past it doesn't run its
+	// BackwardSQL.
+	Environment string
+	// Phase is the part of a deploy that migrations are run for.  In the PreDeploy phase, only
+	// PreDeploy migrations are run, and only those that don't depend on a PostDeploy migration
+	// that is still pending.  In the PostDeploy phase, all pending migrations are run, as the
+	// PreDeploy ones must come first anyway.  Without a phase, all pending migrations are run.
+	Phase Phase
+	// Repeatables are applied, as by ApplyRepeatableMigrationsContext, after migrating forward
+	// to the latest migration.  They are not applied when migrating to a named migration, or in
+	// the PreDeploy phase.
+	Repeatables []RepeatableMigration
+	// Output is where progress, like "Running 00002_foobar... Success!", is written.  Nil means
+	// os.Stdout.
+	Output io.Writer
+	// Input is where the answer to a confirmation prompt is read from.  Nil means os.Stdin.
+	Input io.Reader
+}
+
+// hooks returns the Hooks to call, or NoHooks if none were given.
+func (o Options) hooks() Hooks {
+	if o.Hooks == nil {
+		return NoHooks{}
+	}
+	return o.Hooks
+}
+
+// output returns the writer to write progress to, or os.Stdout if none was given.
+func (o Options) output() io.Writer {
+	if o.Output == nil {
+		return os.Stdout
+	}
+	return o.Output
+}
+
+// input returns the reader to read confirmations from, or os.Stdin if none was given.
+func (o Options) input() io.Reader {
+	if o.Input == nil {
+		return os.Stdin
+	}
+	return o.Input
+}
@@ -0,0 +1,146 @@
+package pomegranate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// namespaceSeparator separates a migration set's namespace from the names of its migrations.
+const namespaceSeparator = "/"
+
+// MigrationSet is a named set of migrations that is migrated independently of the others in the
+// same database, like the migrations embedded in a shared library.  Its migrations are recorded
+// in migration_state with their names qualified by the namespace, like "audit/00001_events", so
+// each set has its own sequence.  The migration_state table itself is created by the
+// application's own, unnamespaced, init migration, which must be run first.
+type MigrationSet struct {
+	Namespace  string
+	Migrations []Migration
+}
+
+// NewMigrationSet reads the migrations in each of the sources with ReadMigrationFS, and combines
+// them, ordered by name, into a set with the given namespace.  Namespaces may not contain "/".
+func NewMigrationSet(namespace string, sources ...fs.ReadDirFS) (MigrationSet, error) {
+	set := MigrationSet{Namespace: namespace, Migrations: []Migration{}}
+	if strings.Contains(namespace, namespaceSeparator) {
+		return set, fmt.Errorf("namespace %q must not contain %q", namespace, namespaceSeparator)
+	}
+	seen := map[string]bool{}
+	for _, source := range sources {
+		migs, err := ReadMigrationFS(source)
+		if err != nil {
+			return set, err
+		}
+		for _, mig := range migs {
+			if seen[mig.Name] {
+				return set, fmt.Errorf("migration %s is defined more than once", mig.Name)
+			}
+			seen[mig.Name] = true
+			set.Migrations = append(set.Migrations, mig)
+		}
+	}
+	sort.SliceStable(set.Migrations, func(i, j int) bool { return set.Migrations[i].Name < set.Migrations[j].Name })
+	return set, nil
+}
+
+// Qualified returns the set's migrations with their names qualified by its namespace, ready to be
+// passed to MigrateForwardToContext and the other functions that take a list of migrations.  The
+// migration names in their "-- pmg:replaces" and "-- pmg:depends_on" lines are read as names in
+// the same set.  A set without a namespace is returned unchanged.
+//
+// Since a set's SQL doesn't know the namespace it will be run under, pomegranate records its
+// migrations in migration_state itself, as it does for Go migrations, so their SQL must not
+// insert into or delete from migration_state.
+func (s MigrationSet) Qualified() []Migration {
+	if s.Namespace == "" {
+		return s.Migrations
+	}
+	migs := []Migration{}
+	for _, mig := range s.Migrations {
+		mig.Name = s.Namespace + namespaceSeparator + mig.Name
+		migs = append(migs, mig)
+	}
+	return migs
+}
+
+// getSetStateContext returns the migration state of the set that allMigrations belong to: the
+// records qualified by their namespace, or the unqualified records if they have none.  It returns
+// an error if allMigrations come from more than one set.
+func getSetStateContext(ctx context.Context, db Database, allMigrations []Migration) ([]MigrationRecord, error) {
+	namespace := ""
+	for i, mig := range allMigrations {
+		if i == 0 {
+			namespace = namespaceOf(mig.Name)
+		} else if namespaceOf(mig.Name) != namespace {
+			return nil, fmt.Errorf("migrations %s and %s are in different migration sets", allMigrations[0].Name, mig.Name)
+		}
+	}
+	state, err := GetMigrationStateContext(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return filterStateByNamespace(state, namespace), nil
+}
+
+// checkNamespacedMigrations returns an error if any of the namespaced SQL migrations in toRun
+// changes migration_state itself, which would record it under its unqualified name.
+func checkNamespacedMigrations(toRun []Migration) error {
+	for _, mig := range toRun {
+		if namespaceOf(mig.Name) == "" || mig.IsGo() {
+			continue
+		}
+		for _, sqls := range [][]string{mig.ForwardSQL, mig.BackwardSQL} {
+			if stmt := migrationStateStatement(sqls); stmt != "" {
+				return fmt.Errorf("migration %s must not change migration_state, since pomegranate records migrations in a namespaced set itself: %s", mig.Name, stmt)
+			}
+		}
+	}
+	return nil
+}
+
+// runNamespacedMigrationSQLContext runs one direction of a migration from a namespaced set, and
+// records it in migration_state under its qualified name.  When the migration can run in a single
+// transaction, the record is written in the same one.
+func runNamespacedMigrationSQLContext(ctx context.Context, db Database, name string, sqlToRun []string, direction Direction, out io.Writer) error {
+	fmt.Fprintf(out, "Running %s... ", name)
+	if err := execNamespacedMigrationSQLContext(ctx, db, name, sqlToRun, direction); err != nil {
+		fmt.Fprintln(out, "Failure :(")
+		return err
+	}
+	fmt.Fprintln(out, "Success!")
+	return nil
+}
+
+func execNamespacedMigrationSQLContext(ctx context.Context, db Database, name string, sqlToRun []string, direction Direction) error {
+	record := recordForwardSQL
+	if direction == Backward {
+		record = recordBackwardSQL
+	}
+	if err := checkConditionsContext(ctx, db, "require", sqlToRun); err != nil {
+		return err
+	}
+	if nonTransactionalReason(sqlToRun) != "" {
+		if err := execMigrationSQLContext(ctx, db, sqlToRun); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, record, name)
+		return err
+	}
+	return runInTxContext(ctx, db, func(tx *sql.Tx) error {
+		for _, stmt := range transactionStatements(sqlToRun) {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("error running migration: %v", err)
+			}
+		}
+		if err := checkConditionsContext(ctx, tx, "ensure", sqlToRun); err != nil {
+			return fmt.Errorf("%v (the migration has been rolled back)", err)
+		}
+		_, err := tx.ExecContext(ctx, record, name)
+		return err
+	})
+}
@@ -0,0 +1,112 @@
+package pomegranate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMigrationSet(t *testing.T) {
+	dir1, _ := ioutil.TempDir(".", "pmgtest")
+	defer os.RemoveAll(dir1)
+	dir2, _ := ioutil.TempDir(".", "pmgtest")
+	defer os.RemoveAll(dir2)
+	for dir, name := range map[string]string{dir1: "00002_b", dir2: "00001_a"} {
+		os.Mkdir(path.Join(dir, name), 0755)
+		ioutil.WriteFile(path.Join(dir, name, "forward.sql"), []byte(name+" forward"), 0644)
+		ioutil.WriteFile(path.Join(dir, name, "backward.sql"), []byte(name+" backward"), 0644)
+	}
+
+	set, err := NewMigrationSet("audit", OsDir(dir1), OsDir(dir2))
+	assert.Nil(t, err)
+	assert.Equal(t, "audit", set.Namespace)
+	assert.Equal(t, []string{"00001_a", "00002_b"}, migsToNames(set.Migrations))
+
+	_, err = NewMigrationSet("audit", OsDir(dir1), OsDir(dir1))
+	assert.Equal(t, "migration 00002_b is defined more than once", err.Error())
+	_, err = NewMigrationSet("a/b", OsDir(dir1))
+	assert.Equal(t, `namespace "a/b" must not contain "/"`, err.Error())
+}
+
+func TestQualified(t *testing.T) {
+	forward := []string{"-- pmg:replaces 00001_events 00002_ids\n-- pmg:depends_on 00001_events auth/00001_users\nCREATE TABLE events ();\nINSERT INTO events(kind) VALUES ('00003_squashed');"}
+	set := MigrationSet{Namespace: "audit", Migrations: []Migration{{
+		Name:        "00003_squashed",
+		ForwardSQL:  forward,
+		BackwardSQL: []string{"DROP TABLE events;"},
+	}}}
+	migs := set.Qualified()
+	assert.Equal(t, "audit/00003_squashed", migs[0].Name)
+	// the SQL, including data that happens to look like a migration name, is left alone
+	assert.Equal(t, forward, migs[0].ForwardSQL)
+	assert.Equal(t, []string{"audit/00001_events", "audit/00002_ids"}, migs[0].Replaces())
+	assert.Equal(t, []string{"audit/00001_events", "auth/00001_users"}, migs[0].DependsOn())
+	// the set itself is unchanged
+	assert.Equal(t, "00003_squashed", set.Migrations[0].Name)
+	assert.Equal(t, []string{"00001_events", "00002_ids"}, set.Migrations[0].Replaces())
+
+	assert.Equal(t, goodMigrations, MigrationSet{Migrations: goodMigrations}.Qualified())
+}
+
+func TestCheckNamespacedMigrations(t *testing.T) {
+	ok := Migration{Name: "audit/00001_events", ForwardSQL: []string{"CREATE TABLE events ();\nINSERT INTO events SELECT name FROM migration_state;"}}
+	assert.Nil(t, checkNamespacedMigrations([]Migration{ok}))
+	// unnamespaced migrations record themselves
+	assert.Nil(t, checkNamespacedMigrations(goodMigrations))
+
+	for _, stmt := range []string{
+		"INSERT INTO migration_state(name) VALUES ('00001_events')",
+		"delete from public.migration_state where name = '00001_events'",
+		"UPDATE migration_state SET name = 'x'",
+	} {
+		bad := Migration{Name: "audit/00001_events", BackwardSQL: []string{"BEGIN;\nDROP TABLE events;\n" + stmt + ";\nCOMMIT;"}}
+		err := checkNamespacedMigrations([]Migration{ok, bad})
+		assert.Equal(t, "migration audit/00001_events must not change migration_state, since pomegranate records migrations in a namespaced set itself: "+stmt, err.Error())
+	}
+}
+
+func TestFilterStateByNamespace(t *testing.T) {
+	state := namesToState([]string{"00001_init", "audit/00001_events", "00002_foo", "auth/00001_users"})
+	assert.Equal(t, namesToState([]string{"00001_init", "00002_foo"}), filterStateByNamespace(state, ""))
+	assert.Equal(t, namesToState([]string{"audit/00001_events"}), filterStateByNamespace(state, "audit"))
+	assert.Equal(t, []MigrationRecord{}, filterStateByNamespace(state, "billing"))
+}
+
+func TestMigrationSets(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	err := MigrateForwardToContext(ctx, "00002_foobar", db, goodMigrations, false)
+	assert.Nil(t, err)
+
+	audit := MigrationSet{Namespace: "audit", Migrations: []Migration{{
+		Name: "00001_events",
+		ForwardSQL: []string{`BEGIN;
+CREATE TABLE audit_events (id SERIAL PRIMARY KEY);
+COMMIT;
+`},
+		BackwardSQL: []string{`BEGIN;
+DROP TABLE audit_events;
+COMMIT;
+`},
+	}}}
+	err = MigrateForwardToContext(ctx, "", db, audit.Qualified(), false)
+	assert.Nil(t, err)
+	_, err = getSetStateContext(ctx, db, append(audit.Qualified(), goodMigrations...))
+	assert.Equal(t, "migrations audit/00001_events and 00001_init are in different migration sets", err.Error())
+
+	// the unnamespaced migrations carry on as if the audit set wasn't there
+	err = MigrateForwardToContext(ctx, "00003_foobaz", db, goodMigrations, false)
+	assert.Nil(t, err)
+	state, _ := GetMigrationState(db)
+	assert.Equal(t, []string{"00001_init", "00002_foobar", "00003_foobaz", "audit/00001_events"}, recordNames(state))
+
+	err = MigrateBackwardToContext(ctx, "audit/00001_events", db, audit.Qualified(), false)
+	assert.Nil(t, err)
+	state, _ = GetMigrationState(db)
+	assert.Equal(t, []string{"00001_init", "00002_foobar", "00003_foobaz"}, recordNames(state))
+}
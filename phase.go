@@ -0,0 +1,83 @@
+package pomegranate
+
+import (
+	"fmt"
+)
+
+// Phase is the part of a deploy that a migration belongs to, for expand/contract releases.
+type Phase string
+
+const (
+	// PreDeploy migrations run before the new code ships, like adding a column.  Migrations
+	// without a "-- pmg:phase" line are PreDeploy.
+	PreDeploy Phase = "pre"
+	// PostDeploy migrations run once the old code is gone, like dropping a column it still reads.
+	PostDeploy Phase = "post"
+)
+
+// Phase returns the phase of a deploy that the migration belongs to, as given by a
+// "-- pmg:phase" line in its ForwardSQL, or PreDeploy if it has none.
+func (m Migration) Phase() Phase {
+	phases := getDirectives("phase", m.ForwardSQL)
+	if len(phases) == 0 {
+		return PreDeploy
+	}
+	return Phase(phases[0])
+}
+
+// getPhaseMigrations returns the migrations in toRun that should run in phase.  toRun must be in
+// the order the migrations will run, and state the migrations already run.  It returns an error if
+// phase, or the phase of any migration in toRun, is not PreDeploy or PostDeploy.
+func getPhaseMigrations(phase Phase, toRun []Migration, state []MigrationRecord, allMigrations []Migration) ([]Migration, error) {
+	for _, mig := range toRun {
+		if p := mig.Phase(); p != PreDeploy && p != PostDeploy {
+			return nil, fmt.Errorf("migration %s has unknown phase %q", mig.Name, p)
+		}
+	}
+	switch phase {
+	case "", PostDeploy:
+		return toRun, nil
+	case PreDeploy:
+	default:
+		return nil, fmt.Errorf("unknown phase %q; use %q or %q", phase, PreDeploy, PostDeploy)
+	}
+	state, err := CollapseReplacedState(state, allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	deps, err := migrationDependencies(allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	satisfied := map[string]bool{}
+	for _, rec := range state {
+		satisfied[rec.Name] = true
+	}
+	inPhase := []Migration{}
+	for _, mig := range toRun {
+		if mig.Phase() != phase {
+			continue
+		}
+		ready := true
+		for _, dep := range deps[mig.Name] {
+			if !satisfied[dep] {
+				ready = false
+			}
+		}
+		if ready {
+			satisfied[mig.Name] = true
+			inPhase = append(inPhase, mig)
+		}
+	}
+	return inPhase, nil
+}
+
+// getPhaseForwardMigrationsToRun works like getForwardMigrationsToRun, but only returns the
+// migrations for phase.
+func getPhaseForwardMigrationsToRun(phase Phase, name string, state []MigrationRecord, allMigrations []Migration) ([]Migration, error) {
+	toRun, err := getForwardMigrationsToRun(name, state, allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	return getPhaseMigrations(phase, toRun, state, allMigrations)
+}
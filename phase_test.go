@@ -0,0 +1,113 @@
+package pomegranate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// phasesToMigs makes a Migration for each name, tagged with the phase listed for it.
+func phasesToMigs(names []string, phases map[string]string) []Migration {
+	migs := namesToMigs(names)
+	for i, mig := range migs {
+		if p, ok := phases[mig.Name]; ok {
+			migs[i].ForwardSQL = []string{"-- pmg:phase " + p + "\nSELECT 1;"}
+		}
+	}
+	return migs
+}
+
+func TestMigrationPhase(t *testing.T) {
+	assert.Equal(t, PreDeploy, Migration{}.Phase())
+	assert.Equal(t, PostDeploy, Migration{ForwardSQL: []string{"-- pmg:phase post\nSELECT 1;"}}.Phase())
+}
+
+func TestGetPhaseMigrations(t *testing.T) {
+	tt := []struct {
+		name   string
+		phase  Phase
+		names  []string
+		phases map[string]string
+		deps   map[string]string
+		toRun  []string
+		err    string
+	}{
+		{
+			name:   "no phase",
+			names:  []string{"a", "b", "c"},
+			phases: map[string]string{"b": "post"},
+			toRun:  []string{"a", "b", "c"},
+		},
+		{
+			name:   "pre stops at the first post",
+			phase:  PreDeploy,
+			names:  []string{"a", "b", "c"},
+			phases: map[string]string{"b": "post"},
+			toRun:  []string{"a"},
+		},
+		{
+			name:   "post runs everything",
+			phase:  PostDeploy,
+			names:  []string{"a", "b", "c"},
+			phases: map[string]string{"b": "post"},
+			toRun:  []string{"a", "b", "c"},
+		},
+		{
+			name:   "pre runs branches that don't need the post",
+			phase:  PreDeploy,
+			names:  []string{"a", "b", "c"},
+			phases: map[string]string{"b": "post"},
+			deps:   map[string]string{"c": "a"},
+			toRun:  []string{"a", "c"},
+		},
+		{
+			name:  "unknown phase",
+			phase: "during",
+			names: []string{"a"},
+			err:   `unknown phase "during"; use "pre" or "post"`,
+		},
+		{
+			name:   "unknown migration phase",
+			names:  []string{"a"},
+			phases: map[string]string{"a": "later"},
+			err:    `migration a has unknown phase "later"`,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			migs := phasesToMigs(tc.names, tc.phases)
+			for i, mig := range migs {
+				if d, ok := tc.deps[mig.Name]; ok {
+					migs[i].ForwardSQL = append(migs[i].ForwardSQL, "-- pmg:depends_on "+d)
+				}
+			}
+			out, err := getPhaseMigrations(tc.phase, migs, []MigrationRecord{}, migs)
+			if tc.err != "" {
+				assert.Equal(t, tc.err, err.Error())
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.toRun, migsToNames(out))
+		})
+	}
+}
+
+func TestPhases(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	migs := append([]Migration{}, goodMigrations[:4]...)
+	migs[2].ForwardSQL = []string{"-- pmg:phase post\n" + migs[2].ForwardSQL[0]}
+
+	err := MigrateForwardToWithOptions(ctx, "", db, migs, false, Options{Phase: PreDeploy})
+	assert.Nil(t, err)
+	state, _ := GetMigrationState(db)
+	assert.Equal(t, []string{"00001_init", "00002_foobar"}, recordNames(state))
+
+	err = MigrateForwardToWithOptions(ctx, "", db, migs, false, Options{Phase: PostDeploy})
+	assert.Nil(t, err)
+	state, _ = GetMigrationState(db)
+	assert.Equal(t, migsToNames(migs), recordNames(state))
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -31,6 +34,43 @@ func main() {
 		Usage:   "database url",
 		EnvVars: []string{"DATABASE_URL"},
 	}
+	schemaFileFlag := &cli.StringFlag{
+		Name:    "schema-file",
+		Usage:   "schema snapshot file to regenerate after migrating",
+		EnvVars: []string{"PMG_SCHEMA_FILE"},
+	}
+	envFlag := &cli.StringFlag{
+		Name:    "env",
+		Usage:   "environment to run migrations for; migrations tagged for other environments are skipped",
+		EnvVars: []string{"PMG_ENV"},
+	}
+	phaseFlag := &cli.StringFlag{
+		Name:  "phase",
+		Usage: "deploy phase to run migrations for: pre, or post; by default all pending migrations are run",
+	}
+	fleetFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "dburl-file",
+			Usage: "file listing database urls, one per line, to migrate instead of --dburl",
+		},
+		&cli.IntFlag{
+			Name:  "parallel",
+			Value: 1,
+			Usage: "number of databases from --dburl-file to migrate at a time",
+		},
+		&cli.BoolFlag{
+			Name:  "canary",
+			Usage: "migrate the first database in --dburl-file on its own first, and stop if it fails",
+		},
+		&cli.BoolFlag{
+			Name:  "continue-on-failure",
+			Usage: "keep migrating the other databases in --dburl-file after one fails",
+		},
+	}
+	namespaceFlag := &cli.StringFlag{
+		Name:  "namespace",
+		Usage: "namespace of the migration set in dir, for migrating it independently of others",
+	}
 	timestampFlag := &cli.BoolFlag{
 		Name:  "ts",
 		Usage: "To use timestamps for the number part of the migration name",
@@ -84,6 +124,44 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "baseline",
+			Usage: "create a migration from an existing database's schema, and record it as run",
+			Flags: []cli.Flag{dirFlag, dbFlag},
+			Action: func(c *cli.Context) error {
+				db, err := pomegranate.Connect(c.String("dburl"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				err = pomegranate.BaselineContext(c.Context, c.String("dir"), db, true)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				fmt.Println("Done")
+				return nil
+			},
+		},
+		{
+			Name:  "squash",
+			Usage: "replace old migrations with a single migration creating the schema they produce",
+			Flags: []cli.Flag{
+				dirFlag,
+				dbFlag,
+				&cli.StringFlag{
+					Name:     "through",
+					Usage:    "last migration to squash",
+					Required: true,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				err := pomegranate.SquashContext(c.Context, c.String("dir"), c.String("through"), c.String("dburl"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				fmt.Println("Done")
+				return nil
+			},
+		},
 		{
 			Name:  "ingest",
 			Usage: "convert .sql migrations to migrations.go file",
@@ -120,7 +198,7 @@ func main() {
 		{
 			Name:  "forward",
 			Usage: "Migrate forward to latest migration",
-			Flags: []cli.Flag{dirFlag, dbFlag},
+			Flags: append([]cli.Flag{dirFlag, dbFlag, namespaceFlag, schemaFileFlag, envFlag, phaseFlag}, fleetFlags...),
 			Action: func(c *cli.Context) error {
 				return forward(c, "")
 			},
@@ -128,9 +206,9 @@ func main() {
 		{
 			Name:  "forwardto",
 			Usage: "Migrate forward to specified migration",
-			Flags: []cli.Flag{dirFlag, dbFlag},
+			Flags: append([]cli.Flag{dirFlag, dbFlag, namespaceFlag, schemaFileFlag, envFlag, phaseFlag}, fleetFlags...),
 			Action: func(c *cli.Context) error {
-				migrateTo, err := getArg(c, 0, "migration name")
+				migrateTo, err := getMigrationNameArg(c)
 				if err != nil {
 					return cli.NewExitError(err, 1)
 				}
@@ -140,9 +218,9 @@ func main() {
 		{
 			Name:  "fakeforwardto",
 			Usage: "Fake migrating forward to specified migration",
-			Flags: []cli.Flag{dirFlag, dbFlag},
+			Flags: []cli.Flag{dirFlag, dbFlag, namespaceFlag},
 			Action: func(c *cli.Context) error {
-				migrateTo, err := getArg(c, 0, "migration name")
+				migrateTo, err := getMigrationNameArg(c)
 				if err != nil {
 					return cli.NewExitError(err, 1)
 				}
@@ -150,8 +228,7 @@ func main() {
 				if err != nil {
 					return cli.NewExitError(err, 1)
 				}
-				dir := c.String("dir")
-				allMigrations, err := pomegranate.ReadMigrationFiles(dir)
+				allMigrations, err := readMigrations(c)
 				if err != nil {
 					return cli.NewExitError(err, 1)
 				}
@@ -166,22 +243,43 @@ func main() {
 		{
 			Name:  "backwardto",
 			Usage: "Migrate backward to specified migration",
-			Flags: []cli.Flag{dirFlag, dbFlag},
+			Flags: []cli.Flag{
+				dirFlag,
+				dbFlag,
+				namespaceFlag,
+				&cli.BoolFlag{
+					Name:  "stored",
+					Usage: "Use backward SQL stored in the database for migrations missing from dir",
+				},
+				&cli.BoolFlag{
+					Name:  "only",
+					Usage: "Roll back just the named migration, refusing while migrations that depend on it are applied",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				migrateTo, err := getArg(c, 0, "migration name")
+				migrateTo, err := getMigrationNameArg(c)
 				if err != nil {
 					return cli.NewExitError(err, 1)
 				}
+				if c.Bool("only") && c.Bool("stored") {
+					return cli.NewExitError("--only and --stored cannot be used together", 1)
+				}
 				db, err := pomegranate.Connect(c.String("dburl"))
 				if err != nil {
 					return cli.NewExitError(err, 1)
 				}
-				dir := c.String("dir")
-				allMigrations, err := pomegranate.ReadMigrationFiles(dir)
+				allMigrations, err := readMigrations(c)
 				if err != nil {
 					return cli.NewExitError(err, 1)
 				}
-				err = pomegranate.MigrateBackwardTo(migrateTo, db, allMigrations, true)
+				switch {
+				case c.Bool("only"):
+					err = pomegranate.MigrateBackwardOnlyContext(c.Context, migrateTo, db, allMigrations, true)
+				case c.Bool("stored"):
+					err = pomegranate.MigrateBackwardToStoredContext(c.Context, migrateTo, db, allMigrations, true)
+				default:
+					err = pomegranate.MigrateBackwardTo(migrateTo, db, allMigrations, true)
+				}
 				if err != nil {
 					return cli.NewExitError(err, 1)
 				}
@@ -189,6 +287,674 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "sync",
+			Usage: "Migrate backward and/or forward until the database matches dir",
+			Flags: []cli.Flag{dirFlag, dbFlag, namespaceFlag, envFlag},
+			Action: func(c *cli.Context) error {
+				db, err := pomegranate.Connect(c.String("dburl"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				allMigrations, err := readMigrations(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				repeatables, err := readRepeatables(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				opts := migrationOptions(c)
+				opts.Repeatables = repeatables
+				err = pomegranate.MigrateToMatchWithOptions(c.Context, db, allMigrations, true, opts)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				fmt.Println("Done")
+				return nil
+			},
+		},
+		{
+			Name:  "tenants",
+			Usage: "Migrate forward every tenant schema, each with its own migration state",
+			Flags: []cli.Flag{
+				dirFlag,
+				dbFlag,
+				namespaceFlag,
+				envFlag,
+				phaseFlag,
+				&cli.StringFlag{
+					Name:  "schema-pattern",
+					Usage: "LIKE pattern matching the tenant schemas, e.g. 'tenant_%'",
+				},
+				&cli.StringFlag{
+					Name:  "schema-query",
+					Usage: "query returning the names of the tenant schemas",
+				},
+				&cli.IntFlag{
+					Name:  "concurrency",
+					Value: 4,
+					Usage: "number of tenants to migrate at a time",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				db, err := pomegranate.Connect(c.String("dburl"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				allMigrations, err := readMigrations(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				var schemas []string
+				switch {
+				case c.String("schema-pattern") != "" && c.String("schema-query") != "":
+					return cli.NewExitError("use only one of --schema-pattern and --schema-query", 1)
+				case c.String("schema-pattern") != "":
+					schemas, err = pomegranate.GetTenantSchemasContext(c.Context, db, c.String("schema-pattern"))
+				case c.String("schema-query") != "":
+					schemas, err = pomegranate.QueryTenantSchemasContext(c.Context, db, c.String("schema-query"))
+				default:
+					return cli.NewExitError("--schema-pattern or --schema-query is required", 1)
+				}
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				repeatables, err := readRepeatables(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				opts := migrationOptions(c)
+				opts.Repeatables = repeatables
+				results := pomegranate.MigrateTenantsWithOptions(c.Context, db, schemas, allMigrations, c.Int("concurrency"), opts)
+				w := new(tabwriter.Writer)
+				w.Init(os.Stdout, 5, 0, 1, ' ', tabwriter.Debug)
+				fmt.Fprintln(w, "SCHEMA\t RESULT\t TIME")
+				succeeded, failed, notRun := 0, 0, 0
+				for _, r := range results {
+					switch {
+					case r.OK():
+						succeeded++
+					case r.Started:
+						failed++
+					default:
+						notRun++
+					}
+					fmt.Fprintf(w, "%s\t %s\t %s\n", r.Schema, r, r.Duration.Round(time.Millisecond))
+				}
+				w.Flush()
+				fmt.Printf("%d succeeded, %d failed, %d not run\n", succeeded, failed, notRun)
+				if failed+notRun > 0 {
+					return cli.NewExitError("not every tenant was migrated", 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "rehearse",
+			Usage:     "Run the forward migrations in a transaction that is rolled back, and report timings and locks",
+			ArgsUsage: "[migration name]",
+			Flags: []cli.Flag{
+				dirFlag,
+				dbFlag,
+				namespaceFlag,
+				envFlag,
+				phaseFlag,
+				&cli.BoolFlag{
+					Name:  "statements",
+					Usage: "show the time taken by each statement",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				db, err := pomegranate.Connect(c.String("dburl"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				allMigrations, err := readMigrations(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				results, err := pomegranate.RehearseWithOptions(
+					c.Context, qualifyName(c, c.Args().Get(0)), db, allMigrations, migrationOptions(c),
+				)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				if len(results) == 0 {
+					fmt.Println("No migrations to run")
+					return nil
+				}
+				w := new(tabwriter.Writer)
+				w.Init(os.Stdout, 5, 0, 1, ' ', tabwriter.Debug)
+				fmt.Fprintln(w, "NAME\t RESULT\t TIME\t LOCKS")
+				failed := false
+				for _, r := range results {
+					failed = failed || !r.OK()
+					fmt.Fprintf(w, "%s\t %s\t %s\t %s\n", r.Name, r, r.Duration.Round(time.Millisecond), strings.Join(r.Locks, ", "))
+					if c.Bool("statements") {
+						for _, s := range r.Statements {
+							fmt.Fprintf(w, "\t   %s\t %s\t\n", strings.Join(strings.Fields(s.SQL), " "), s.Duration.Round(time.Millisecond))
+						}
+					}
+				}
+				w.Flush()
+				fmt.Println("Rolled back")
+				if failed {
+					return cli.NewExitError("rehearsal failed", 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "plan",
+			Usage:     "Save the forward migrations that would be run to a plan file",
+			ArgsUsage: "[migration name]",
+			Flags: []cli.Flag{
+				dirFlag,
+				dbFlag,
+				namespaceFlag,
+				phaseFlag,
+				&cli.StringFlag{
+					Name:  "out",
+					Value: "plan.json",
+					Usage: "plan file to be written",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				db, err := pomegranate.Connect(c.String("dburl"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				allMigrations, err := readMigrations(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				plan, err := pomegranate.MakePlanWithOptions(c.Context, qualifyName(c, c.Args().Get(0)), db, allMigrations, migrationOptions(c))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				fmt.Println("Forward migrations that will be run:")
+				for _, m := range plan.Migrations {
+					fmt.Println(m.Name)
+				}
+				err = pomegranate.WritePlanFile(c.String("out"), plan)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "apply",
+			Usage:     "Run the migrations in a plan file, if nothing has changed since it was made",
+			ArgsUsage: "<plan file>",
+			Flags:     []cli.Flag{dirFlag, dbFlag, namespaceFlag, envFlag},
+			Action: func(c *cli.Context) error {
+				planFile, err := getArg(c, 0, "plan file")
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				plan, err := pomegranate.ReadPlanFile(planFile)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				db, err := pomegranate.Connect(c.String("dburl"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				allMigrations, err := readMigrations(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				err = pomegranate.ApplyPlanWithOptions(c.Context, db, plan, allMigrations, true, migrationOptions(c))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				fmt.Println("Done")
+				return nil
+			},
+		},
+		{
+			Name:  "script",
+			Usage: "Write migrations to a single script that can be run with psql",
+			Flags: []cli.Flag{
+				dirFlag,
+				dbFlag,
+				namespaceFlag,
+				&cli.StringFlag{
+					Name:  "from",
+					Usage: "first migration to include; omit to use the database's state",
+				},
+				&cli.StringFlag{
+					Name:  "to",
+					Usage: "last migration to include",
+				},
+				&cli.BoolFlag{
+					Name:  "backward",
+					Usage: "write backward migrations instead of forward",
+				},
+				&cli.StringFlag{
+					Name:  "out",
+					Value: "script.sql",
+					Usage: "script file to be written",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				allMigrations, err := readMigrations(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				from, to, backward := qualifyName(c, c.String("from")), qualifyName(c, c.String("to")), c.Bool("backward")
+				var migs []pomegranate.Migration
+				if from != "" || c.String("dburl") == "" {
+					migs, err = pomegranate.GetMigrationRange(from, to, allMigrations, backward)
+				} else {
+					migs, err = scriptMigrationsFromState(c, to, backward, allMigrations)
+				}
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				err = pomegranate.WriteScriptFile(c.String("out"), migs, backward)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "schema",
+			Usage: "Work with a schema snapshot file",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "dump",
+					Usage: "Write a snapshot of the database's schema",
+					Flags: []cli.Flag{
+						dbFlag,
+						&cli.StringFlag{
+							Name:  "out",
+							Value: "schema.sql",
+							Usage: "schema file to be written",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						db, err := pomegranate.Connect(c.String("dburl"))
+						if err != nil {
+							return cli.NewExitError(err, 1)
+						}
+						err = pomegranate.WriteSchemaFileContext(c.Context, db, c.String("out"))
+						if err != nil {
+							return cli.NewExitError(err, 1)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "check",
+					Usage: "Fail if the snapshot does not match the schema produced by running all migrations",
+					Flags: []cli.Flag{
+						dirFlag,
+						dbFlag,
+						&cli.StringFlag{
+							Name:  "file",
+							Value: "schema.sql",
+							Usage: "schema file to check",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						allMigrations, err := pomegranate.ReadMigrationFiles(c.String("dir"))
+						if err != nil {
+							return cli.NewExitError(err, 1)
+						}
+						err = pomegranate.CheckSchemaFileContext(c.Context, c.String("file"), c.String("dburl"), allMigrations)
+						if err != nil {
+							return cli.NewExitError(err, 1)
+						}
+						fmt.Printf("%s is up to date\n", c.String("file"))
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "drift",
+			Usage: "Compare the database's schema to the schema its recorded migrations produce",
+			Flags: []cli.Flag{
+				dirFlag,
+				dbFlag,
+				&cli.StringFlag{
+					Name:     "scratch-dburl",
+					Usage:    "database url for the server to build the expected schema on; not the production server",
+					Required: true,
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "print differences as JSON",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				db, err := pomegranate.Connect(c.String("dburl"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				allMigrations, err := pomegranate.ReadMigrationFiles(c.String("dir"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				diffs, err := pomegranate.DetectDriftContext(c.Context, db, c.String("scratch-dburl"), allMigrations)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				if c.Bool("json") {
+					enc := json.NewEncoder(os.Stdout)
+					enc.SetIndent("", "  ")
+					if err := enc.Encode(diffs); err != nil {
+						return cli.NewExitError(err, 1)
+					}
+				} else {
+					printSchemaDiffs(diffs)
+				}
+				if len(diffs) > 0 {
+					return cli.NewExitError(fmt.Sprintf("%d differences found", len(diffs)), 1)
+				}
+				fmt.Println("No drift found")
+				return nil
+			},
+		},
+		{
+			Name:      "analyze",
+			Usage:     "Check migrations for statements that take heavy locks or rewrite tables",
+			ArgsUsage: "[migration name...]",
+			Flags:     []cli.Flag{dirFlag},
+			Action: func(c *cli.Context) error {
+				allMigrations, err := pomegranate.ReadMigrationFiles(c.String("dir"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				migs := allMigrations
+				if c.NArg() > 0 {
+					migs = []pomegranate.Migration{}
+					for _, name := range c.Args().Slice() {
+						mig, err := findMigration(name, allMigrations)
+						if err != nil {
+							return cli.NewExitError(err, 1)
+						}
+						migs = append(migs, mig)
+					}
+				}
+				fmt.Printf("Analyzing with the %s\n", pomegranate.Analyzer)
+				findings := pomegranate.AnalyzeMigrations(migs)
+				for _, f := range findings {
+					fmt.Printf("%s (%s): %s\n", f.Migration, f.Direction, f.Rule)
+					fmt.Printf("    %s\n", strings.Join(strings.Fields(f.Statement), " "))
+					fmt.Printf("    %s\n", f.Problem)
+					fmt.Printf("    %s\n\n", f.Suggestion)
+				}
+				if len(findings) > 0 {
+					return cli.NewExitError(fmt.Sprintf("%d problems found", len(findings)), 1)
+				}
+				fmt.Println("No problems found")
+				return nil
+			},
+		},
+		{
+			Name:  "roundtrip",
+			Usage: "Check that every migration's backward SQL undoes its forward SQL, in a scratch database",
+			Flags: []cli.Flag{dirFlag, dbFlag},
+			Action: func(c *cli.Context) error {
+				allMigrations, err := pomegranate.ReadMigrationFiles(c.String("dir"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				results, err := pomegranate.RoundTripScratchContext(c.Context, c.String("dburl"), allMigrations)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				w := new(tabwriter.Writer)
+				w.Init(os.Stdout, 5, 0, 1, ' ', tabwriter.Debug)
+				fmt.Fprintln(w, "NAME\t RESULT")
+				failures := 0
+				for _, r := range results {
+					if !r.OK() {
+						failures++
+					}
+					fmt.Fprintf(w, "%s\t %s\n", r.Name, r)
+				}
+				w.Flush()
+				if failures > 0 {
+					return cli.NewExitError(fmt.Sprintf("%d migrations failed to round trip", failures), 1)
+				}
+				if len(results) < len(allMigrations) {
+					return cli.NewExitError("round trip stopped early", 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "test",
+			Usage: "Run each migration's data test from its test/ directory, in scratch databases",
+			Flags: []cli.Flag{dirFlag, dbFlag},
+			Action: func(c *cli.Context) error {
+				allMigrations, err := pomegranate.ReadMigrationFiles(c.String("dir"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				results, err := pomegranate.RunMigrationTestsContext(c.Context, c.String("dburl"), allMigrations)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				if len(results) == 0 {
+					fmt.Println("No migrations have tests")
+					return nil
+				}
+				w := new(tabwriter.Writer)
+				w.Init(os.Stdout, 5, 0, 1, ' ', tabwriter.Debug)
+				fmt.Fprintln(w, "NAME\t RESULT")
+				failures := 0
+				for _, r := range results {
+					if !r.OK() {
+						failures++
+					}
+					fmt.Fprintf(w, "%s\t %s\n", r.Name, r)
+				}
+				w.Flush()
+				if failures > 0 {
+					return cli.NewExitError(fmt.Sprintf("%d migration tests failed", failures), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "show which migrations in dir have been run, including repeatable migrations",
+			Flags: []cli.Flag{dirFlag, dbFlag, namespaceFlag},
+			Action: func(c *cli.Context) error {
+				db, err := pomegranate.Connect(c.String("dburl"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				allMigrations, err := readMigrations(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				repeatables, err := readRepeatables(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				state, err := pomegranate.GetMigrationStateContext(c.Context, db)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				// databases that ran migrations since squashed show the squashed one as applied
+				state, err = pomegranate.CollapseReplacedState(state, allMigrations)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				records, err := pomegranate.GetRepeatableStateContext(c.Context, db)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				skipped, err := pomegranate.GetSkippedMigrationsContext(c.Context, db)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				skippedIn := map[string]string{}
+				for _, s := range skipped {
+					skippedIn[s.Name] = s.Environment
+				}
+				w := new(tabwriter.Writer)
+				w.Init(os.Stdout, 5, 0, 1, ' ', tabwriter.Debug)
+				fmt.Fprintln(w, "NAME\t STATUS\t WHEN")
+				applied := map[string]pomegranate.MigrationRecord{}
+				for _, rec := range state {
+					applied[rec.Name] = rec
+				}
+				for _, m := range allMigrations {
+					rec, ok := applied[m.Name]
+					env, wasSkipped := skippedIn[m.Name]
+					switch {
+					case ok && wasSkipped:
+						fmt.Fprintf(w, "%s\t skipped in %q\t %s\n", m.Name, env, rec.Time)
+					case ok:
+						fmt.Fprintf(w, "%s\t applied\t %s\n", m.Name, rec.Time)
+					case m.Phase() == pomegranate.PostDeploy:
+						fmt.Fprintf(w, "%s\t waiting for post-deploy\t \n", m.Name)
+					default:
+						fmt.Fprintf(w, "%s\t pending\t \n", m.Name)
+					}
+				}
+				// list the migrations recorded from other sets, or no longer in dir, too
+				inDir := map[string]bool{}
+				for _, m := range allMigrations {
+					inDir[m.Name] = true
+				}
+				for _, rec := range state {
+					if !inDir[rec.Name] {
+						fmt.Fprintf(w, "%s\t applied, not in dir\t %s\n", rec.Name, rec.Time)
+					}
+				}
+				repeatableRecords := map[string]pomegranate.RepeatableRecord{}
+				for _, rec := range records {
+					repeatableRecords[rec.Name] = rec
+				}
+				for _, r := range repeatables {
+					name := "repeatable/" + r.Name
+					rec, ok := repeatableRecords[r.Name]
+					switch {
+					case !ok:
+						fmt.Fprintf(w, "%s\t pending\t \n", name)
+					case rec.Checksum != r.Checksum():
+						fmt.Fprintf(w, "%s\t changed\t %s\n", name, rec.Time)
+					default:
+						fmt.Fprintf(w, "%s\t applied\t %s\n", name, rec.Time)
+					}
+				}
+				w.Flush()
+				return nil
+			},
+		},
+		{
+			Name:  "check",
+			Usage: "exit with an error unless every migration in dir has been run",
+			Flags: []cli.Flag{
+				dirFlag,
+				dbFlag,
+				namespaceFlag,
+				&cli.DurationFlag{
+					Name:  "wait",
+					Usage: "how long to wait for another process to run the migrations",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				db, err := pomegranate.Connect(c.String("dburl"))
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				allMigrations, err := readMigrations(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				if wait := c.Duration("wait"); wait > 0 {
+					ctx, cancel := context.WithTimeout(c.Context, wait)
+					defer cancel()
+					err = pomegranate.WaitForMigrationsContext(ctx, db, allMigrations, time.Second)
+				} else {
+					err = pomegranate.CheckUpToDateContext(c.Context, db, allMigrations)
+				}
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				fmt.Println("Up to date")
+				return nil
+			},
+		},
+		{
+			Name:  "compare",
+			Usage: "show which migrations in dir have been run in each of several environments",
+			Flags: []cli.Flag{
+				dirFlag,
+				namespaceFlag,
+				&cli.StringSliceFlag{
+					Name:  "env",
+					Usage: "environment to compare, as name=dburl; may be repeated",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				allMigrations, err := readMigrations(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				if len(c.StringSlice("env")) == 0 {
+					return cli.NewExitError("at least one --env name=dburl is required", 1)
+				}
+				envs := []pomegranate.EnvironmentState{}
+				for _, arg := range c.StringSlice("env") {
+					name, dial, ok := strings.Cut(arg, "=")
+					if !ok {
+						return cli.NewExitError(fmt.Sprintf("--env %q should be name=dburl", arg), 1)
+					}
+					db, err := pomegranate.Connect(dial)
+					if err != nil {
+						return cli.NewExitError(err, 1)
+					}
+					env, err := pomegranate.GetEnvironmentStateContext(c.Context, name, db, allMigrations)
+					db.Close()
+					if err != nil {
+						return cli.NewExitError(err, 1)
+					}
+					envs = append(envs, env)
+				}
+				comparisons, err := pomegranate.CompareEnvironments(allMigrations, envs)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				w := new(tabwriter.Writer)
+				w.Init(os.Stdout, 5, 0, 1, ' ', tabwriter.Debug)
+				header := "NAME"
+				for _, env := range envs {
+					header += "\t " + strings.ToUpper(env.Environment)
+				}
+				fmt.Fprintln(w, header)
+				for _, comp := range comparisons {
+					row := comp.Name
+					if !comp.OnDisk {
+						row += " (not on disk)"
+					}
+					for _, ec := range comp.Environments {
+						switch {
+						case ec.OutOfOrder:
+							row += "\t applied out of order"
+						case ec.Applied:
+							row += "\t applied"
+						default:
+							row += "\t -"
+						}
+					}
+					fmt.Fprintln(w, row)
+				}
+				w.Flush()
+				return nil
+			},
+		},
 		{
 			Name:  "state",
 			Usage: "show the migration state",
@@ -245,23 +1011,152 @@ func main() {
 // forward takes the cli context, a migration name to migrate to, and makes it
 // happen.  It's used by both the `forward` and `forwardto` commands.
 func forward(c *cli.Context, name string) error {
+	if c.String("dburl-file") != "" {
+		return forwardFleet(c, name)
+	}
 	db, err := pomegranate.Connect(c.String("dburl"))
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
-	dir := c.String("dir")
-	allMigrations, err := pomegranate.ReadMigrationFiles(dir)
+	allMigrations, err := readMigrations(c)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
-	err = pomegranate.MigrateForwardTo(name, db, allMigrations, true)
+	repeatables, err := readRepeatables(c)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
+	opts := migrationOptions(c)
+	opts.Repeatables = repeatables
+	err = pomegranate.MigrateForwardToWithOptions(c.Context, name, db, allMigrations, true, opts)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	if schemaFile := c.String("schema-file"); schemaFile != "" {
+		err = pomegranate.WriteSchemaFileContext(c.Context, db, schemaFile)
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+	}
 	fmt.Println("Done")
 	return nil
 }
 
+// forwardFleet migrates each of the databases listed in --dburl-file, for the `forward` and
+// `forwardto` commands, and prints which databases reached which migration.
+func forwardFleet(c *cli.Context, name string) error {
+	dials, err := pomegranate.ReadDatabaseURLFile(c.String("dburl-file"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	allMigrations, err := readMigrations(c)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	repeatables, err := readRepeatables(c)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	opts := migrationOptions(c)
+	opts.Repeatables = repeatables
+	results, err := pomegranate.MigrateFleetContext(c.Context, name, dials, allMigrations, pomegranate.FleetOptions{
+		Concurrency:   c.Int("parallel"),
+		Canary:        c.Bool("canary"),
+		StopOnFailure: !c.Bool("continue-on-failure"),
+		Confirm:       true,
+		Options:       opts,
+	})
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 5, 0, 1, ' ', tabwriter.Debug)
+	fmt.Fprintln(w, "DATABASE\t RESULT\t REACHED\t TIME")
+	failed := false
+	for _, r := range results {
+		failed = failed || !r.OK()
+		fmt.Fprintf(w, "%s\t %s\t %s\t %s\n", r.Database, r, r.Latest(), r.Duration.Round(time.Millisecond))
+	}
+	w.Flush()
+	fmt.Println()
+
+	// a matrix of migrations against databases, with an x where the migration has been run
+	w.Init(os.Stdout, 5, 0, 1, ' ', tabwriter.Debug)
+	header := "MIGRATION"
+	for _, r := range results {
+		header += "\t " + r.Database
+	}
+	fmt.Fprintln(w, header)
+	for _, m := range allMigrations {
+		row := m.Name
+		for _, r := range results {
+			switch {
+			case r.State == nil:
+				row += "\t ?"
+			case migrationRecorded(m.Name, r.State):
+				row += "\t x"
+			default:
+				row += "\t "
+			}
+		}
+		fmt.Fprintln(w, row)
+	}
+	w.Flush()
+	if failed {
+		return cli.NewExitError("not every database was migrated", 1)
+	}
+	return nil
+}
+
+// migrationRecorded reports whether the named migration is in state.
+func migrationRecorded(name string, state []pomegranate.MigrationRecord) bool {
+	for _, rec := range state {
+		if rec.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptMigrationsFromState returns the migrations that `forwardto` or `backwardto` would run
+// against the database, for the `script` command.
+func scriptMigrationsFromState(c *cli.Context, to string, backward bool, allMigrations []pomegranate.Migration) ([]pomegranate.Migration, error) {
+	db, err := pomegranate.Connect(c.String("dburl"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if backward {
+		if to == "" {
+			return nil, errors.New("--to is required to write a backward script from the database's state")
+		}
+		return pomegranate.GetBackwardMigrationsContext(c.Context, to, db, allMigrations)
+	}
+	return pomegranate.GetForwardMigrationsContext(c.Context, to, db, allMigrations)
+}
+
+// printSchemaDiffs prints a table of schema differences, followed by the expected and actual
+// definitions of the objects that changed.
+func printSchemaDiffs(diffs []pomegranate.SchemaDiff) {
+	if len(diffs) == 0 {
+		return
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 5, 0, 1, ' ', tabwriter.Debug)
+	fmt.Fprintln(w, "KIND\t NAME\t CHANGE")
+	for _, d := range diffs {
+		fmt.Fprintf(w, "%s\t %s\t %s\n", d.Kind, d.Name, d.Change)
+	}
+	w.Flush()
+	for _, d := range diffs {
+		if d.Change != "changed" {
+			continue
+		}
+		fmt.Printf("\n%s %s\n  expected: %s\n  actual:   %s\n", d.Kind, d.Name, d.Expected, d.Actual)
+	}
+}
+
 // get arg from position specified by idx. If empty, then prompt for it.
 func getArg(c *cli.Context, idx int, prompt string) (string, error) {
 	arg := c.Args().Get(0)
@@ -277,3 +1172,63 @@ func getArg(c *cli.Context, idx int, prompt string) (string, error) {
 	arg = strings.TrimSpace(arg)
 	return arg, nil
 }
+
+func findMigration(name string, allMigrations []pomegranate.Migration) (pomegranate.Migration, error) {
+	for _, mig := range allMigrations {
+		if mig.Name == name {
+			return mig, nil
+		}
+	}
+	return pomegranate.Migration{}, fmt.Errorf("migration %s not found", name)
+}
+
+// migrationOptions returns the options for running migrations for the environment given by
+// --env, and the deploy phase given by --phase.
+func migrationOptions(c *cli.Context) pomegranate.Options {
+	return pomegranate.Options{
+		Environment: c.String("env"),
+		Phase:       pomegranate.Phase(c.String("phase")),
+	}
+}
+
+// readMigrations reads the migrations in the command's --dir, qualified by its --namespace.
+func readMigrations(c *cli.Context) ([]pomegranate.Migration, error) {
+	set, err := pomegranate.NewMigrationSet(c.String("namespace"), pomegranate.OsDir(c.String("dir")))
+	if err != nil {
+		return nil, err
+	}
+	return set.Qualified(), nil
+}
+
+// readRepeatables reads the repeatable migrations in the command's --dir, qualified by its
+// --namespace.
+func readRepeatables(c *cli.Context) ([]pomegranate.RepeatableMigration, error) {
+	repeatables, err := pomegranate.ReadRepeatableMigrationFiles(c.String("dir"))
+	if err != nil {
+		return nil, err
+	}
+	for i := range repeatables {
+		repeatables[i].Name = qualifyName(c, repeatables[i].Name)
+	}
+	return repeatables, nil
+}
+
+// qualifyName qualifies a migration name given on the command line by the command's --namespace,
+// unless it is empty or already qualified.
+func qualifyName(c *cli.Context, name string) string {
+	namespace := c.String("namespace")
+	if namespace == "" || name == "" || strings.Contains(name, "/") {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// getMigrationNameArg gets the migration name argument, or prompts for it, and qualifies it by the
+// command's --namespace.
+func getMigrationNameArg(c *cli.Context) (string, error) {
+	name, err := getArg(c, 0, "migration name")
+	if err != nil {
+		return "", err
+	}
+	return qualifyName(c, name), nil
+}
@@ -0,0 +1,191 @@
+// Package pomegranatetest provides helpers for integration tests that need a database with
+// pomegranate migrations applied.
+//
+// The first call to NewTestDB for a given set of migrations runs them into a template database.
+// Every call then clones that template with CREATE DATABASE ... TEMPLATE, which is much faster than
+// running the migrations again, and drops the clone when the test finishes:
+//
+//	func TestCustomers(t *testing.T) {
+//		db := pomegranatetest.NewTestDB(t, migrations.All)
+//		...
+//	}
+//
+// Go migrations can change without anything in their Migration changing, so sets that include one
+// aren't cached in a template: each call runs the migrations into its database afresh.
+//
+// The Postgres server is taken from the PMG_TEST_DATABASE_URL environment variable, falling back
+// to DATABASE_URL.  Its user must be allowed to create databases.
+package pomegranatetest
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/nav-inc/pomegranate"
+)
+
+var (
+	templatesMu sync.Mutex
+	templates   = map[string]string{}
+)
+
+// NewTestDB returns a connection to a new, uniquely named database with all the given migrations
+// applied, followed by any repeatable migrations.  The database is closed and dropped when the
+// test and its subtests complete.
+func NewTestDB(t testing.TB, migrations []pomegranate.Migration, repeatables ...pomegranate.RepeatableMigration) *sql.DB {
+	t.Helper()
+	dial := os.Getenv("PMG_TEST_DATABASE_URL")
+	if dial == "" {
+		dial = os.Getenv("DATABASE_URL")
+	}
+	if dial == "" {
+		t.Fatal("pomegranatetest: set PMG_TEST_DATABASE_URL or DATABASE_URL to a Postgres server url")
+	}
+	return NewTestDBURL(t, dial, migrations, repeatables...)
+}
+
+// NewTestDBURL works like NewTestDB, but creates the database on the server that dial points to.
+func NewTestDBURL(t testing.TB, dial string, migrations []pomegranate.Migration, repeatables ...pomegranate.RepeatableMigration) *sql.DB {
+	t.Helper()
+	ctx := context.Background()
+	scratch, err := newScratchDatabase(ctx, dial, migrations, repeatables)
+	if err != nil {
+		t.Fatalf("pomegranatetest: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := scratch.Close(); err != nil {
+			t.Errorf("pomegranatetest: %v", err)
+		}
+	})
+	return scratch.DB
+}
+
+// newScratchDatabase returns a new database with the migrations and repeatables applied, cloned
+// from a template unless any of the migrations is a Go migration.
+func newScratchDatabase(ctx context.Context, dial string, migrations []pomegranate.Migration, repeatables []pomegranate.RepeatableMigration) (*pomegranate.ScratchDatabase, error) {
+	if !hasGoMigration(migrations) {
+		template, err := templateDatabase(ctx, dial, migrations, repeatables)
+		if err != nil {
+			return nil, err
+		}
+		return pomegranate.NewScratchDatabaseFromTemplateContext(ctx, dial, template)
+	}
+	scratch, err := pomegranate.NewScratchDatabaseContext(ctx, dial)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(ctx, scratch.DB, migrations, repeatables); err != nil {
+		scratch.Close()
+		return nil, fmt.Errorf("could not run migrations in test database: %v", err)
+	}
+	return scratch, nil
+}
+
+// templateDatabase returns the name of a database with the migrations applied, creating it if it
+// doesn't already exist.  Template names are derived from the migrations' SQL, so a template left
+// by an earlier test run is reused as long as the migrations and repeatables haven't changed.
+func templateDatabase(ctx context.Context, dial string, migrations []pomegranate.Migration, repeatables []pomegranate.RepeatableMigration) (string, error) {
+	if len(migrations) == 0 {
+		return "", errors.New("no migrations provided")
+	}
+	name := templateName(migrations, repeatables)
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	if _, ok := templates[dial+" "+name]; ok {
+		return name, nil
+	}
+
+	admin, err := sql.Open("postgres", dial)
+	if err != nil {
+		return "", err
+	}
+	defer admin.Close()
+	var exists bool
+	err = admin.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", name).Scan(&exists)
+	if err != nil {
+		return "", fmt.Errorf("could not look for template database: %v", err)
+	}
+	if !exists {
+		if err := createTemplate(ctx, admin, dial, name, migrations, repeatables); err != nil {
+			return "", err
+		}
+	}
+	templates[dial+" "+name] = name
+	return name, nil
+}
+
+// createTemplate runs the migrations in a scratch database, then renames it to name.  Other test
+// processes may be doing the same thing at the same time, so losing the race to rename is fine.
+func createTemplate(ctx context.Context, admin *sql.DB, dial, name string, migrations []pomegranate.Migration, repeatables []pomegranate.RepeatableMigration) error {
+	building := name + "_building_" + fmt.Sprint(os.Getpid())
+	if _, err := admin.ExecContext(ctx, "CREATE DATABASE "+pq.QuoteIdentifier(building)); err != nil {
+		return fmt.Errorf("could not create template database: %v", err)
+	}
+	buildingURL, err := url.Parse(dial)
+	if err != nil {
+		return err
+	}
+	buildingURL.Path = "/" + building
+	db, err := sql.Open("postgres", buildingURL.String())
+	if err != nil {
+		return err
+	}
+	err = migrate(ctx, db, migrations, repeatables)
+	// the template can't be renamed or copied while anything is connected to it
+	db.Close()
+	if err != nil {
+		admin.ExecContext(ctx, "DROP DATABASE IF EXISTS "+pq.QuoteIdentifier(building))
+		return fmt.Errorf("could not run migrations in template database: %v", err)
+	}
+	_, err = admin.ExecContext(ctx, fmt.Sprintf(
+		"ALTER DATABASE %s RENAME TO %s", pq.QuoteIdentifier(building), pq.QuoteIdentifier(name),
+	))
+	if err != nil {
+		admin.ExecContext(ctx, "DROP DATABASE IF EXISTS "+pq.QuoteIdentifier(building))
+		if !strings.Contains(err.Error(), "already exists") {
+			return fmt.Errorf("could not rename template database: %v", err)
+		}
+	}
+	return nil
+}
+
+// migrate runs all the migrations against db, followed by the repeatables.
+func migrate(ctx context.Context, db *sql.DB, migrations []pomegranate.Migration, repeatables []pomegranate.RepeatableMigration) error {
+	opts := pomegranate.Options{
+		Environment: pomegranate.ScratchEnvironment,
+		Repeatables: repeatables,
+	}
+	return pomegranate.MigrateForwardToWithOptions(ctx, "", db, migrations, false, opts)
+}
+
+// templateName returns a database name unique to the names and SQL of the migrations and
+// repeatables.
+func templateName(migrations []pomegranate.Migration, repeatables []pomegranate.RepeatableMigration) string {
+	h := sha256.New()
+	for _, mig := range migrations {
+		fmt.Fprintf(h, "%s\x00%s\x00", mig.Name, mig.ForwardChecksum())
+	}
+	for _, r := range repeatables {
+		fmt.Fprintf(h, "repeatable %s\x00%s\x00", r.Name, r.Checksum())
+	}
+	return "pmg_template_" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func hasGoMigration(migrations []pomegranate.Migration) bool {
+	for _, mig := range migrations {
+		if mig.IsGo() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package pomegranate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// RehearsalResult reports what happened when a migration was rehearsed by RehearseContext.
+// Refused is set, and nothing was run, if the migration can't be rehearsed inside a transaction.
+// Skipped is set if the migration would be skipped in the environment given in Options.  Locks
+// lists the relation locks the migration took, as "<mode> <schema>.<relation>".
+type RehearsalResult struct {
+	Name       string
+	Refused    string
+	Skipped    bool
+	Error      error
+	Duration   time.Duration
+	Statements []StatementTiming
+	Locks      []string
+}
+
+// StatementTiming records how long a single statement took to run.
+type StatementTiming struct {
+	SQL      string
+	Duration time.Duration
+}
+
+// OK reports whether the migration was rehearsed without error.  A migration that would be
+// skipped is OK, since skipping it is what the real run would do.
+func (r RehearsalResult) OK() bool {
+	return r.Refused == "" && r.Error == nil
+}
+
+// String says why the migration couldn't be rehearsed, or how it failed, or that it would be
+// skipped.  Otherwise it returns "ok"; the timings and locks are reported separately.
+func (r RehearsalResult) String() string {
+	switch {
+	case r.Refused != "":
+		return "refused: " + r.Refused
+	case r.Error != nil:
+		return fmt.Sprintf("failed: %v", r.Error)
+	case r.Skipped:
+		return "skipped: tagged for other environments"
+	}
+	return "ok"
+}
+
+// rehearsalLocksSQL lists the relation locks held by the current connection, outside the system
+// catalogs.
+const rehearsalLocksSQL = `SELECT DISTINCT l.mode || ' ' || n.nspname || '.' || c.relname
+FROM pg_locks l
+JOIN pg_class c ON c.oid = l.relation
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE l.pid = pg_backend_pid() AND l.locktype = 'relation' AND l.granted
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'
+ORDER BY 1;`
+
+// RehearseContext runs the forward migrations that have not yet been run, up to and including the
+// one specified by `name`, inside a single transaction that is always rolled back.  The BEGIN and
+// COMMIT statements in each migration's SQL are left out so the migrations can't commit.  Each
+// migration's require and ensure conditions are checked, its time is measured, and the locks it
+// took are listed.  Rehearsal stops at the first migration that fails or can't be rehearsed,
+// because the ones after it would depend on it.
+//
+// The locks are real while the rehearsal runs, so rehearsing against a busy database can block
+// other sessions just as the migration would.
+func RehearseContext(ctx context.Context, name string, db *sql.DB, allMigrations []Migration) ([]RehearsalResult, error) {
+	return RehearseWithOptions(ctx, name, db, allMigrations, Options{})
+}
+
+// RehearseWithOptions works like RehearseContext, rehearsing the migrations that
+// MigrateForwardToWithOptions would run with opts.  Hooks are not called, and Repeatables are
+// not rehearsed.
+func RehearseWithOptions(ctx context.Context, name string, db *sql.DB, allMigrations []Migration, opts Options) ([]RehearsalResult, error) {
+	toRun, err := GetForwardMigrationsWithOptions(ctx, name, db, allMigrations, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkEnvironment(opts.Environment, toRun); err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	env := opts.Environment
+	held := map[string]bool{}
+	results := []RehearsalResult{}
+	for _, mig := range toRun {
+		result := RehearsalResult{Name: mig.Name}
+		if !mig.runsIn(env) {
+			result.Skipped = true
+			if _, err := tx.ExecContext(ctx, recordForwardSQL, mig.Name); err != nil {
+				result.Error = err
+				return append(results, result), nil
+			}
+			results = append(results, result)
+			continue
+		}
+		if mig.ForwardNoTxFunc != nil {
+			result.Refused = "Go migration runs outside a transaction"
+		} else {
+			result.Refused = nonTransactionalReason(mig.ForwardSQL)
+		}
+		if result.Refused != "" {
+			return append(results, result), nil
+		}
+		if result.Error = checkConditionsContext(ctx, tx, "require", mig.ForwardSQL); result.Error != nil {
+			return append(results, result), nil
+		}
+		start := time.Now()
+		if mig.IsGo() {
+			result.Error = runGoMigrationContext(ctx, tx, mig, Forward)
+		}
+		for _, stmt := range transactionStatements(mig.ForwardSQL) {
+			stmtStart := time.Now()
+			_, err := tx.ExecContext(ctx, stmt)
+			result.Statements = append(result.Statements, StatementTiming{SQL: stmt, Duration: time.Since(stmtStart)})
+			if err != nil {
+				result.Error = err
+				break
+			}
+		}
+		result.Duration = time.Since(start)
+		if result.Error == nil {
+			result.Error = checkConditionsContext(ctx, tx, "ensure", mig.ForwardSQL)
+		}
+		if result.Error != nil {
+			return append(results, result), nil
+		}
+		locks, err := getRehearsalLocksContext(ctx, tx)
+		if err != nil {
+			return results, fmt.Errorf("could not list locks: %v", err)
+		}
+		for _, lock := range locks {
+			if !held[lock] {
+				result.Locks = append(result.Locks, lock)
+				held[lock] = true
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func getRehearsalLocksContext(ctx context.Context, db Database) ([]string, error) {
+	rows, err := db.QueryContext(ctx, rehearsalLocksSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	locks := []string{}
+	for rows.Next() {
+		var lock string
+		if err := rows.Scan(&lock); err != nil {
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, rows.Err()
+}
@@ -0,0 +1,62 @@
+package pomegranate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRehearsalResult(t *testing.T) {
+	refused := RehearsalResult{Name: "00005_index", Refused: "CREATE INDEX CONCURRENTLY can't run inside a transaction"}
+	assert.False(t, refused.OK())
+	assert.Equal(t, "refused: CREATE INDEX CONCURRENTLY can't run inside a transaction", refused.String())
+
+	seed := RehearsalResult{Name: "00006_seed", Skipped: true}
+	assert.True(t, seed.OK())
+	assert.Equal(t, "skipped: tagged for other environments", seed.String())
+
+	r := RehearsalResult{
+		Name:       "00003_foobaz",
+		Error:      errors.New("lock timeout"),
+		Statements: []StatementTiming{{SQL: "ALTER TABLE foo ADD COLUMN bar TEXT", Duration: time.Second}},
+	}
+	assert.False(t, r.OK())
+	assert.Equal(t, "failed: lock timeout", r.String())
+}
+
+func TestRehearse(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	err := MigrateForwardToContext(ctx, "00002_foobar", db, goodMigrations, false)
+	assert.Nil(t, err)
+
+	results, err := RehearseContext(ctx, "00004_fooquux", db, goodMigrations)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"00003_foobaz", "00004_fooquux"}, rehearsalNames(results))
+	for _, r := range results {
+		assert.True(t, r.OK(), r.String())
+	}
+	assert.Equal(t, 2, len(results[0].Statements))
+	assert.Contains(t, results[0].Locks, "AccessExclusiveLock public.foo")
+
+	// nothing was committed
+	state, _ := GetMigrationState(db)
+	assert.Equal(t, goodMigrations[1].Name, state[len(state)-1].Name)
+
+	results, err = RehearseContext(ctx, "", db, goodMigrations)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, "refused: multi-file migrations run each file separately", results[2].String())
+}
+
+func rehearsalNames(results []RehearsalResult) []string {
+	names := []string{}
+	for _, r := range results {
+		names = append(names, r.Name)
+	}
+	return names
+}
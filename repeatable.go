@@ -0,0 +1,143 @@
+package pomegranate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// repeatableDir is the directory, next to the versioned migrations, that holds repeatable
+// migrations.
+const repeatableDir = "repeatable"
+
+// ReadRepeatableMigrationFS reads the repeatable migrations in the repeatable directory of
+// migFolder, ordered by name.  Each .sql file is one repeatable migration, named for the file
+// without its extension.  It returns no migrations if there is no repeatable directory.
+func ReadRepeatableMigrationFS(migFolder fs.ReadDirFS) ([]RepeatableMigration, error) {
+	files, err := migFolder.ReadDir(repeatableDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []RepeatableMigration{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing repeatable migrations: %w", err)
+	}
+	migs := []RepeatableMigration{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		b, err := fs.ReadFile(migFolder, path.Join(repeatableDir, name))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read %q: %w", name, err)
+		}
+		migs = append(migs, RepeatableMigration{Name: strings.TrimSuffix(name, ".sql"), SQL: string(b)})
+	}
+	return migs, nil
+}
+
+// ReadRepeatableMigrationFiles reads the repeatable migrations in the repeatable directory inside
+// dir.  See ReadRepeatableMigrationFS.
+func ReadRepeatableMigrationFiles(dir string) ([]RepeatableMigration, error) {
+	return ReadRepeatableMigrationFS(OsDir(dir))
+}
+
+// GetRepeatableStateContext returns the records of the repeatable migrations that have been
+// applied to db, ordered by name.
+func GetRepeatableStateContext(ctx context.Context, db Database) ([]RepeatableRecord, error) {
+	exists, err := tableExistsContext(ctx, db, "migration_repeatable")
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return []RepeatableRecord{}, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT name, checksum, time, who FROM migration_repeatable ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("get repeatable state: %v", err)
+	}
+	defer rows.Close()
+	records := []RepeatableRecord{}
+	for rows.Next() {
+		var rec RepeatableRecord
+		if err := rows.Scan(&rec.Name, &rec.Checksum, &rec.Time, &rec.Who); err != nil {
+			return nil, fmt.Errorf("get repeatable state: %v", err)
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// applyRepeatablesContext applies opts.Repeatables after a forward run to the latest migration.
+// Repeatable migrations may depend on any versioned one, so they aren't applied in the PreDeploy
+// phase, when some of those may still be waiting.
+func applyRepeatablesContext(ctx context.Context, db Database, confirm bool, opts Options) error {
+	if len(opts.Repeatables) == 0 || opts.Phase == PreDeploy {
+		return nil
+	}
+	return applyRepeatableMigrationsContext(ctx, db, opts.Repeatables, confirm, opts)
+}
+
+// ApplyRepeatableMigrationsContext runs each repeatable migration that is new or has changed
+// since it was last applied to db, in name order.  Each runs in its own transaction, along with
+// recording its checksum.  Call it after migrating forward to the latest versioned migration.
+func ApplyRepeatableMigrationsContext(ctx context.Context, db Database, repeatables []RepeatableMigration, confirm bool) error {
+	return applyRepeatableMigrationsContext(ctx, db, repeatables, confirm, Options{})
+}
+
+func applyRepeatableMigrationsContext(ctx context.Context, db Database, repeatables []RepeatableMigration, confirm bool, opts Options) error {
+	out := opts.output()
+	records, err := GetRepeatableStateContext(ctx, db)
+	if err != nil {
+		return fmt.Errorf("could not get repeatable migration state: %v", err)
+	}
+	toRun := getChangedRepeatables(records, repeatables)
+	if len(toRun) == 0 {
+		fmt.Fprintln(out, "No repeatable migrations to run")
+		return nil
+	}
+	for _, r := range toRun {
+		if reason := nonTransactionalReason([]string{r.SQL}); reason != "" {
+			return fmt.Errorf("repeatable migration %s: %s", r.Name, reason)
+		}
+	}
+	if confirm {
+		migs := []Migration{}
+		for _, r := range toRun {
+			migs = append(migs, Migration{Name: r.Name})
+		}
+		if err := getConfirm(migs, "Repeatable", out, opts.input()); err != nil {
+			return err
+		}
+	}
+	if _, err := db.ExecContext(ctx, repeatableStoreSQL); err != nil {
+		return err
+	}
+	for _, r := range toRun {
+		fmt.Fprintf(out, "Running %s... ", r.Name)
+		err := runInTxContext(ctx, db, func(tx *sql.Tx) error {
+			for _, stmt := range transactionStatements([]string{r.SQL}) {
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return fmt.Errorf("error running repeatable migration %s: %v", r.Name, err)
+				}
+			}
+			_, err := tx.ExecContext(ctx, `
+      INSERT INTO migration_repeatable (name, checksum) VALUES ($1, $2)
+      ON CONFLICT (name) DO UPDATE
+      SET checksum = EXCLUDED.checksum, time = now(), who = CURRENT_USER`,
+				r.Name, r.Checksum(),
+			)
+			return err
+		})
+		if err != nil {
+			fmt.Fprintln(out, "Failure :(")
+			return err
+		}
+		fmt.Fprintln(out, "Success!")
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package pomegranate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadRepeatableMigrations(t *testing.T) {
+	dir, _ := ioutil.TempDir(".", "pmgtest")
+	defer os.RemoveAll(dir)
+
+	migs, err := ReadRepeatableMigrationFiles(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []RepeatableMigration{}, migs)
+
+	os.Mkdir(path.Join(dir, "repeatable"), 0755)
+	ioutil.WriteFile(path.Join(dir, "repeatable", "02_view.sql"), []byte("view"), 0644)
+	ioutil.WriteFile(path.Join(dir, "repeatable", "01_func.sql"), []byte("func"), 0644)
+	ioutil.WriteFile(path.Join(dir, "repeatable", "README"), []byte("not sql"), 0644)
+	migs, err = ReadRepeatableMigrationFiles(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []RepeatableMigration{{Name: "01_func", SQL: "func"}, {Name: "02_view", SQL: "view"}}, migs)
+}
+
+func TestGetChangedRepeatables(t *testing.T) {
+	repeatables := []RepeatableMigration{
+		{Name: "a", SQL: "same"},
+		{Name: "b", SQL: "new"},
+		{Name: "c", SQL: "changed"},
+	}
+	records := []RepeatableRecord{
+		{Name: "a", Checksum: RepeatableMigration{SQL: "same"}.Checksum()},
+		{Name: "c", Checksum: RepeatableMigration{SQL: "original"}.Checksum()},
+		{Name: "d", Checksum: "removed"},
+	}
+	changed := getChangedRepeatables(records, repeatables)
+	assert.Equal(t, []RepeatableMigration{repeatables[1], repeatables[2]}, changed)
+}
+
+func TestApplyRepeatableMigrations(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	err := MigrateForwardToContext(ctx, "00002_foobar", db, goodMigrations, false)
+	assert.Nil(t, err)
+
+	view := RepeatableMigration{Name: "foo_view", SQL: "BEGIN;\nCREATE OR REPLACE VIEW foo_view AS SELECT id FROM foo;\nCOMMIT;\n"}
+	err = ApplyRepeatableMigrationsContext(ctx, db, []RepeatableMigration{view}, false)
+	assert.Nil(t, err)
+	records, err := GetRepeatableStateContext(ctx, db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, view.Checksum(), records[0].Checksum)
+
+	// unchanged, so nothing runs
+	assert.Nil(t, ApplyRepeatableMigrationsContext(ctx, db, []RepeatableMigration{view}, false))
+
+	view.SQL = "CREATE OR REPLACE VIEW foo_view AS SELECT id, stuff FROM foo;"
+	err = ApplyRepeatableMigrationsContext(ctx, db, []RepeatableMigration{view}, false)
+	assert.Nil(t, err)
+	records, _ = GetRepeatableStateContext(ctx, db)
+	assert.Equal(t, view.Checksum(), records[0].Checksum)
+
+	// a failure leaves the old checksum in place
+	broken := RepeatableMigration{Name: "foo_view", SQL: "CREATE OR REPLACE VIEW foo_view AS SELECT nope FROM foo;"}
+	err = ApplyRepeatableMigrationsContext(ctx, db, []RepeatableMigration{broken}, false)
+	assert.NotNil(t, err)
+	records, _ = GetRepeatableStateContext(ctx, db)
+	assert.Equal(t, view.Checksum(), records[0].Checksum)
+}
+
+func TestMigrateForwardRepeatables(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	view := RepeatableMigration{Name: "foo_view", SQL: "CREATE OR REPLACE VIEW foo_view AS SELECT id FROM foo;"}
+	opts := Options{Repeatables: []RepeatableMigration{view}}
+
+	// not applied when migrating to a named migration
+	err := MigrateForwardToWithOptions(ctx, "00002_foobar", db, goodMigrations, false, opts)
+	assert.Nil(t, err)
+	records, _ := GetRepeatableStateContext(ctx, db)
+	assert.Equal(t, 0, len(records))
+
+	err = MigrateForwardToWithOptions(ctx, "", db, goodMigrations, false, opts)
+	assert.Nil(t, err)
+	records, _ = GetRepeatableStateContext(ctx, db)
+	assert.Equal(t, 1, len(records))
+}
@@ -0,0 +1,133 @@
+package pomegranate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// RoundTripResult reports what happened when a migration was run forward, backward, and forward
+// again by RoundTripContext.  Residue lists the differences between the schema before the
+// migration was run and the schema after it was rolled back.
+type RoundTripResult struct {
+	Name          string
+	Skipped       bool
+	ForwardError  error
+	BackwardError error
+	ReapplyError  error
+	Residue       []SchemaDiff
+}
+
+// OK reports whether the migration round-tripped cleanly, or was skipped.
+func (r RoundTripResult) OK() bool {
+	return r.ForwardError == nil && r.BackwardError == nil && r.ReapplyError == nil && len(r.Residue) == 0
+}
+
+// RoundTripContext checks every migration's BackwardSQL against db, which should be an empty
+// database.  Each migration is run forward, then backward, and the schema is compared to the
+// schema from before it was run; then it is run forward again so the next migration can be
+// checked.  Migrations whose backward SQL deliberately refuses to run (like init's) are only run
+// forward.  It stops early if a migration cannot be run forward.  It is suitable for calling from
+// a Go test, with a database from NewScratchDatabaseContext:
+//
+//	results, err := pomegranate.RoundTripContext(ctx, scratch.DB, migrations)
+func RoundTripContext(ctx context.Context, db *sql.DB, allMigrations []Migration) ([]RoundTripResult, error) {
+	// use a single connection, so a failed migration's aborted transaction can be rolled back
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	opts := Options{Environment: ScratchEnvironment}
+	results := []RoundTripResult{}
+	for _, mig := range allMigrations {
+		result := RoundTripResult{Name: mig.Name}
+		before, err := InspectSchemaContext(ctx, conn)
+		if err != nil {
+			return results, err
+		}
+		if result.ForwardError = runForwardMigrationsContext(ctx, conn, []Migration{mig}, opts); result.ForwardError != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+			return append(results, result), nil
+		}
+		if refusesRollback(mig) {
+			result.Skipped = true
+			results = append(results, result)
+			continue
+		}
+		if result.BackwardError = runBackwardMigrationsContext(ctx, conn, []Migration{mig}, false, opts); result.BackwardError != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+		}
+		state, err := getSetStateContext(ctx, conn, allMigrations)
+		if err != nil {
+			return results, err
+		}
+		if nameInState(mig.Name, state) {
+			if result.BackwardError == nil {
+				result.Residue = append(result.Residue, SchemaDiff{
+					Kind: "migration_state", Name: mig.Name, Change: "extra",
+				})
+			}
+			// the migration is still applied, so there's nothing to re-apply
+			results = append(results, result)
+			continue
+		}
+		after, err := InspectSchemaContext(ctx, conn)
+		if err != nil {
+			return results, err
+		}
+		result.Residue = append(result.Residue, diffSchemas(before.withoutBookkeeping(), after.withoutBookkeeping())...)
+		if result.ReapplyError = runForwardMigrationsContext(ctx, conn, []Migration{mig}, opts); result.ReapplyError != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+			return append(results, result), nil
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// RoundTripScratchContext runs RoundTripContext in a new scratch database on the server that dial
+// points to, and drops it afterward.
+func RoundTripScratchContext(ctx context.Context, dial string, allMigrations []Migration) ([]RoundTripResult, error) {
+	scratch, err := NewScratchDatabaseContext(ctx, dial)
+	if err != nil {
+		return nil, err
+	}
+	defer scratch.Close()
+	return RoundTripContext(ctx, scratch.DB, allMigrations)
+}
+
+// refusesRollback reports whether a migration's backward SQL is one of pomegranate's templates
+// that deliberately raises an error, like the init migration's.
+func refusesRollback(mig Migration) bool {
+	for _, sql := range mig.BackwardSQL {
+		if strings.Contains(sql, "SELECT no_rollback();") {
+			return true
+		}
+	}
+	return false
+}
+
+// String names the first step of the round trip that went wrong, in the order they ran, with its
+// error or the objects the backward SQL left behind.  Otherwise it says whether the backward SQL
+// was skipped, or returns "ok".
+func (r RoundTripResult) String() string {
+	switch {
+	case r.ForwardError != nil:
+		return fmt.Sprintf("forward failed: %v", r.ForwardError)
+	case r.BackwardError != nil:
+		return fmt.Sprintf("backward failed: %v", r.BackwardError)
+	case len(r.Residue) > 0:
+		names := []string{}
+		for _, d := range r.Residue {
+			names = append(names, fmt.Sprintf("%s %s %s", d.Kind, d.Name, d.Change))
+		}
+		return "backward left residue: " + strings.Join(names, ", ")
+	case r.ReapplyError != nil:
+		return fmt.Sprintf("forward failed after backward: %v", r.ReapplyError)
+	case r.Skipped:
+		return "skipped: backward refuses to run"
+	}
+	return "ok"
+}
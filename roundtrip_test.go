@@ -0,0 +1,63 @@
+package pomegranate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTripResult(t *testing.T) {
+	// init's backward SQL refuses to run, which isn't a failure
+	initResult := RoundTripResult{Name: "00001_init", Skipped: true}
+	assert.True(t, initResult.OK())
+	assert.Equal(t, "skipped: backward refuses to run", initResult.String())
+
+	residue := []SchemaDiff{
+		{Kind: "table", Name: "public.leaky", Change: "extra"},
+		{Kind: "index", Name: "public.leaky_id", Change: "extra"},
+	}
+	r := RoundTripResult{Name: "00005_leaky", Residue: residue}
+	assert.False(t, r.OK())
+	assert.Equal(t, "backward left residue: table public.leaky extra, index public.leaky_id extra", r.String())
+	// residue is found before the migration is run forward again, so it's reported first
+	r.ReapplyError = errors.New("relation \"leaky\" already exists")
+	assert.Equal(t, "backward left residue: table public.leaky extra, index public.leaky_id extra", r.String())
+	r.Residue = nil
+	assert.False(t, r.OK())
+	assert.Equal(t, "forward failed after backward: relation \"leaky\" already exists", r.String())
+}
+
+func TestRefusesRollback(t *testing.T) {
+	assert.True(t, refusesRollback(goodMigrations[0]))
+	assert.False(t, refusesRollback(goodMigrations[1]))
+}
+
+func TestRoundTrip(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	leaky := Migration{
+		Name: "00005_leaky",
+		ForwardSQL: []string{`BEGIN;
+CREATE TABLE leaky (id INT);
+CREATE INDEX leaky_id ON leaky (id);
+INSERT INTO migration_state(name) VALUES ('00005_leaky');
+COMMIT;
+`},
+		BackwardSQL: []string{`BEGIN;
+DELETE FROM migration_state WHERE name='00005_leaky';
+COMMIT;
+`},
+	}
+	migs := append(append([]Migration{}, goodMigrations[:4]...), leaky)
+	results, err := RoundTripContext(context.Background(), db, migs)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(results))
+	assert.True(t, results[0].Skipped)
+	for _, r := range results[:4] {
+		assert.True(t, r.OK(), r.String())
+	}
+	assert.False(t, results[4].OK())
+	assert.Equal(t, "backward left residue: table public.leaky extra, index public.leaky_id extra", results[4].String())
+}
@@ -0,0 +1,756 @@
+package pomegranate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// userObjectFilter limits catalog queries to objects in user schemas.  The namespace must be
+// aliased as n.
+const userObjectFilter = `n.nspname NOT IN ('pg_catalog', 'information_schema')
+	AND n.nspname NOT LIKE 'pg\_%'`
+
+// notFromExtension excludes objects created by extensions.  %s is the oid column of the object.
+const notFromExtension = `NOT EXISTS (
+		SELECT 1 FROM pg_depend d WHERE d.objid = %s AND d.deptype = 'e'
+	)`
+
+// InspectSchemaContext reads the schemas, extensions, types, functions, sequences, tables,
+// constraints, indexes, views, triggers and grants in the database from the Postgres catalogs.
+// Types are enums, domains and composite types.  Objects in system schemas, and objects created by
+// extensions, are left out.  Objects are sorted by name, except that types come after the types
+// they are built from, and views after the views they select from.
+func InspectSchemaContext(ctx context.Context, db Database) (Schema, error) {
+	var s Schema
+	var err error
+	if s.Schemas, err = inspectObjects(ctx, db, `
+      SELECT quote_ident(n.nspname), '', 'CREATE SCHEMA ' || quote_ident(n.nspname) || ';'
+      FROM pg_namespace n
+      WHERE `+userObjectFilter+`
+      AND n.nspname <> 'public'
+      AND `+fmt.Sprintf(notFromExtension, "n.oid")); err != nil {
+		return s, fmt.Errorf("inspect schemas: %v", err)
+	}
+	if s.Extensions, err = inspectObjects(ctx, db, `
+      SELECT quote_ident(e.extname), '',
+             'CREATE EXTENSION IF NOT EXISTS ' || quote_ident(e.extname) ||
+             ' WITH SCHEMA ' || quote_ident(n.nspname) || ';'
+      FROM pg_extension e
+      JOIN pg_namespace n ON n.oid = e.extnamespace
+      WHERE e.extname <> 'plpgsql'`); err != nil {
+		return s, fmt.Errorf("inspect extensions: %v", err)
+	}
+	if s.Types, err = inspectObjects(ctx, db, `
+      SELECT quote_ident(n.nspname) || '.' || quote_ident(t.typname),
+             '',
+             CASE t.typtype
+               WHEN 'e' THEN
+                 'CREATE TYPE ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname) || ' AS ENUM (' ||
+                 coalesce((
+                   SELECT string_agg(quote_literal(e.enumlabel), ', ' ORDER BY e.enumsortorder)
+                   FROM pg_enum e WHERE e.enumtypid = t.oid
+                 ), '') || ');'
+               WHEN 'd' THEN
+                 'CREATE DOMAIN ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname) ||
+                 ' AS ' || format_type(t.typbasetype, t.typtypmod) ||
+                 coalesce(' DEFAULT ' || t.typdefault, '') ||
+                 CASE WHEN t.typnotnull THEN ' NOT NULL' ELSE '' END ||
+                 coalesce((
+                   SELECT string_agg(' CONSTRAINT ' || quote_ident(co.conname) || ' ' ||
+                                     pg_get_constraintdef(co.oid), '' ORDER BY co.conname)
+                   FROM pg_constraint co WHERE co.contypid = t.oid AND co.contype = 'c'
+                 ), '') || ';'
+               ELSE
+                 'CREATE TYPE ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname) || ' AS (' ||
+                 coalesce((
+                   SELECT string_agg(quote_ident(a.attname) || ' ' || format_type(a.atttypid, a.atttypmod),
+                                     ', ' ORDER BY a.attnum)
+                   FROM pg_attribute a
+                   WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped
+                 ), '') || ');'
+             END
+      FROM pg_type t
+      JOIN pg_namespace n ON n.oid = t.typnamespace
+      LEFT JOIN pg_class c ON c.oid = t.typrelid
+      WHERE `+userObjectFilter+`
+      AND (t.typtype IN ('e', 'd') OR (t.typtype = 'c' AND c.relkind = 'c'))
+      AND `+fmt.Sprintf(notFromExtension, "t.oid")); err != nil {
+		return s, fmt.Errorf("inspect types: %v", err)
+	}
+	typeDeps, err := inspectDependencies(ctx, db, typeDependenciesQuery)
+	if err != nil {
+		return s, fmt.Errorf("inspect type dependencies: %v", err)
+	}
+	s.Types = orderByDependencies(s.Types, typeDeps)
+	if s.Functions, err = inspectObjects(ctx, db, `
+      SELECT quote_ident(n.nspname) || '.' || quote_ident(p.proname) ||
+             '(' || pg_get_function_identity_arguments(p.oid) || ')',
+             '',
+             pg_get_functiondef(p.oid) || ';'
+      FROM pg_proc p
+      JOIN pg_namespace n ON n.oid = p.pronamespace
+      WHERE `+userObjectFilter+`
+      AND p.prokind IN ('f', 'p')
+      AND `+fmt.Sprintf(notFromExtension, "p.oid")); err != nil {
+		return s, fmt.Errorf("inspect functions: %v", err)
+	}
+	if s.Sequences, err = inspectObjects(ctx, db, `
+      SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+             '',
+             'CREATE SEQUENCE ' || quote_ident(n.nspname) || '.' || quote_ident(c.relname) ||
+             ' AS ' || format_type(s.seqtypid, NULL) ||
+             ' INCREMENT BY ' || s.seqincrement ||
+             ' MINVALUE ' || s.seqmin ||
+             ' MAXVALUE ' || s.seqmax ||
+             ' START WITH ' || s.seqstart ||
+             ' CACHE ' || s.seqcache ||
+             CASE WHEN s.seqcycle THEN ' CYCLE' ELSE '' END || ';'
+      FROM pg_sequence s
+      JOIN pg_class c ON c.oid = s.seqrelid
+      JOIN pg_namespace n ON n.oid = c.relnamespace
+      WHERE `+userObjectFilter+`
+      AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = c.oid AND d.deptype = 'i')
+      AND `+fmt.Sprintf(notFromExtension, "c.oid")); err != nil {
+		return s, fmt.Errorf("inspect sequences: %v", err)
+	}
+	if s.Tables, err = inspectTables(ctx, db); err != nil {
+		return s, fmt.Errorf("inspect tables: %v", err)
+	}
+	if s.Constraints, err = inspectObjects(ctx, db, `
+      SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname) || '.' || quote_ident(co.conname),
+             quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+             'ALTER TABLE ' || quote_ident(n.nspname) || '.' || quote_ident(c.relname) ||
+             ' ADD CONSTRAINT ' || quote_ident(co.conname) || ' ' || pg_get_constraintdef(co.oid) || ';'
+      FROM pg_constraint co
+      JOIN pg_class c ON c.oid = co.conrelid
+      JOIN pg_namespace n ON n.oid = c.relnamespace
+      WHERE `+userObjectFilter+`
+      AND co.contype IN ('p', 'u', 'c', 'f', 'x')
+      AND `+fmt.Sprintf(notFromExtension, "c.oid")); err != nil {
+		return s, fmt.Errorf("inspect constraints: %v", err)
+	}
+	// foreign keys can only be created once the keys they reference exist
+	sort.SliceStable(s.Constraints, func(i, j int) bool {
+		return !isForeignKey(s.Constraints[i]) && isForeignKey(s.Constraints[j])
+	})
+	if s.Indexes, err = inspectObjects(ctx, db, `
+      SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+             quote_ident(tn.nspname) || '.' || quote_ident(t.relname),
+             pg_get_indexdef(i.indexrelid) || ';'
+      FROM pg_index i
+      JOIN pg_class c ON c.oid = i.indexrelid
+      JOIN pg_namespace n ON n.oid = c.relnamespace
+      JOIN pg_class t ON t.oid = i.indrelid
+      JOIN pg_namespace tn ON tn.oid = t.relnamespace
+      WHERE `+userObjectFilter+`
+      AND NOT EXISTS (
+        SELECT 1 FROM pg_constraint co
+        WHERE co.conindid = i.indexrelid AND co.contype IN ('p', 'u', 'x')
+      )
+      AND `+fmt.Sprintf(notFromExtension, "t.oid")); err != nil {
+		return s, fmt.Errorf("inspect indexes: %v", err)
+	}
+	if s.Views, err = inspectObjects(ctx, db, `
+      SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+             '',
+             CASE c.relkind WHEN 'm' THEN 'CREATE MATERIALIZED VIEW ' ELSE 'CREATE VIEW ' END ||
+             quote_ident(n.nspname) || '.' || quote_ident(c.relname) || ' AS' || chr(10) ||
+             pg_get_viewdef(c.oid)
+      FROM pg_class c
+      JOIN pg_namespace n ON n.oid = c.relnamespace
+      WHERE `+userObjectFilter+`
+      AND c.relkind IN ('v', 'm')
+      AND `+fmt.Sprintf(notFromExtension, "c.oid")); err != nil {
+		return s, fmt.Errorf("inspect views: %v", err)
+	}
+	viewDeps, err := inspectDependencies(ctx, db, viewDependenciesQuery)
+	if err != nil {
+		return s, fmt.Errorf("inspect view dependencies: %v", err)
+	}
+	s.Views = orderByDependencies(s.Views, viewDeps)
+	if s.Triggers, err = inspectObjects(ctx, db, `
+      SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname) || '.' || quote_ident(t.tgname),
+             quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+             pg_get_triggerdef(t.oid) || ';'
+      FROM pg_trigger t
+      JOIN pg_class c ON c.oid = t.tgrelid
+      JOIN pg_namespace n ON n.oid = c.relnamespace
+      WHERE `+userObjectFilter+`
+      AND NOT t.tgisinternal
+      AND `+fmt.Sprintf(notFromExtension, "c.oid")); err != nil {
+		return s, fmt.Errorf("inspect triggers: %v", err)
+	}
+	if s.Grants, err = inspectObjects(ctx, db, `
+      SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname) || ' ' || a.privilege_type ||
+             ' TO ' || coalesce(quote_ident(r.rolname), 'PUBLIC'),
+             quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+             'GRANT ' || a.privilege_type ||
+             CASE c.relkind WHEN 'S' THEN ' ON SEQUENCE ' ELSE ' ON TABLE ' END ||
+             quote_ident(n.nspname) || '.' || quote_ident(c.relname) ||
+             ' TO ' || coalesce(quote_ident(r.rolname), 'PUBLIC') ||
+             CASE WHEN a.is_grantable THEN ' WITH GRANT OPTION' ELSE '' END || ';'
+      FROM pg_class c
+      JOIN pg_namespace n ON n.oid = c.relnamespace
+      CROSS JOIN LATERAL aclexplode(c.relacl) a
+      LEFT JOIN pg_roles r ON r.oid = a.grantee
+      WHERE `+userObjectFilter+`
+      AND c.relkind IN ('r', 'p', 'v', 'm', 'S')
+      AND a.grantee <> c.relowner
+      AND `+fmt.Sprintf(notFromExtension, "c.oid")); err != nil {
+		return s, fmt.Errorf("inspect grants: %v", err)
+	}
+	return s, nil
+}
+
+// inspectObjects runs a catalog query returning name, table and definition columns, and returns
+// the results sorted by name.
+func inspectObjects(ctx context.Context, db Database, query string) ([]SchemaObject, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	objects := []SchemaObject{}
+	for rows.Next() {
+		var o SchemaObject
+		if err := rows.Scan(&o.Name, &o.Table, &o.Definition); err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+// viewDependenciesQuery returns, for each view, the other views it selects from, as recorded in
+// pg_depend against the view's rewrite rule.
+const viewDependenciesQuery = `
+      SELECT DISTINCT quote_ident(vn.nspname) || '.' || quote_ident(v.relname),
+             quote_ident(rn.nspname) || '.' || quote_ident(r.relname)
+      FROM pg_rewrite w
+      JOIN pg_depend d ON d.classid = 'pg_rewrite'::regclass AND d.objid = w.oid
+      JOIN pg_class v ON v.oid = w.ev_class
+      JOIN pg_namespace vn ON vn.oid = v.relnamespace
+      JOIN pg_class r ON d.refclassid = 'pg_class'::regclass AND r.oid = d.refobjid
+      JOIN pg_namespace rn ON rn.oid = r.relnamespace
+      WHERE v.relkind IN ('v', 'm')
+      AND r.relkind IN ('v', 'm')
+      AND r.oid <> v.oid`
+
+// typeDependenciesQuery returns, for each type, the other types it is built from: a domain's base
+// type, or the types of a composite type's attributes.  A dependency on an array type is returned
+// as one on its element type.
+const typeDependenciesQuery = `
+      SELECT DISTINCT quote_ident(n.nspname) || '.' || quote_ident(t.typname),
+             quote_ident(rn.nspname) || '.' || quote_ident(r.typname)
+      FROM pg_type t
+      JOIN pg_namespace n ON n.oid = t.typnamespace
+      JOIN pg_depend d ON (d.classid = 'pg_type'::regclass AND d.objid = t.oid)
+                       OR (d.classid = 'pg_class'::regclass AND d.objid = t.typrelid)
+      JOIN pg_type dt ON d.refclassid = 'pg_type'::regclass AND dt.oid = d.refobjid
+      JOIN pg_type r ON r.oid = CASE WHEN dt.typcategory = 'A' THEN dt.typelem ELSE dt.oid END
+      JOIN pg_namespace rn ON rn.oid = r.typnamespace
+      WHERE t.typtype IN ('d', 'c')
+      AND r.oid <> t.oid`
+
+// inspectDependencies runs a catalog query returning pairs of object names, each object and one it
+// depends on, and returns the dependencies of each object.
+func inspectDependencies(ctx context.Context, db Database, query string) (map[string][]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deps := map[string][]string{}
+	for rows.Next() {
+		var name, dep string
+		if err := rows.Scan(&name, &dep); err != nil {
+			return nil, err
+		}
+		deps[name] = append(deps[name], dep)
+	}
+	return deps, rows.Err()
+}
+
+// orderByDependencies returns objects sorted so that each comes after the objects it depends on,
+// and by name otherwise.  Dependencies on objects that aren't in the list are ignored, and any
+// objects left in a cycle are put at the end by name.
+func orderByDependencies(objects []SchemaObject, deps map[string][]string) []SchemaObject {
+	byName := map[string]SchemaObject{}
+	for _, o := range objects {
+		byName[o.Name] = o
+	}
+	waiting := map[string]int{}
+	dependants := map[string][]string{}
+	for _, o := range objects {
+		for _, dep := range deps[o.Name] {
+			if _, ok := byName[dep]; ok {
+				waiting[o.Name]++
+				dependants[dep] = append(dependants[dep], o.Name)
+			}
+		}
+	}
+	ready := []string{}
+	for _, o := range objects {
+		if waiting[o.Name] == 0 {
+			ready = append(ready, o.Name)
+		}
+	}
+	ordered := []SchemaObject{}
+	done := map[string]bool{}
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		name := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, byName[name])
+		done[name] = true
+		for _, d := range dependants[name] {
+			waiting[d]--
+			if waiting[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	for _, o := range objects {
+		if !done[o.Name] {
+			ordered = append(ordered, o)
+		}
+	}
+	return ordered
+}
+
+func inspectTables(ctx context.Context, db Database) ([]Table, error) {
+	rows, err := db.QueryContext(ctx, `
+      SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+             quote_ident(a.attname),
+             format_type(a.atttypid, a.atttypmod),
+             a.attnotnull,
+             CASE
+               WHEN a.attidentity = 'a' THEN 'GENERATED ALWAYS AS IDENTITY'
+               WHEN a.attidentity = 'd' THEN 'GENERATED BY DEFAULT AS IDENTITY'
+               WHEN a.attgenerated = 's' THEN 'GENERATED ALWAYS AS (' || pg_get_expr(ad.adbin, ad.adrelid) || ') STORED'
+               WHEN ad.adbin IS NOT NULL THEN 'DEFAULT ' || pg_get_expr(ad.adbin, ad.adrelid)
+               ELSE ''
+             END
+      FROM pg_class c
+      JOIN pg_namespace n ON n.oid = c.relnamespace
+      JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped
+      LEFT JOIN pg_attrdef ad ON ad.adrelid = c.oid AND ad.adnum = a.attnum
+      WHERE `+userObjectFilter+`
+      AND c.relkind IN ('r', 'p')
+      AND `+fmt.Sprintf(notFromExtension, "c.oid")+`
+      ORDER BY 1, a.attnum`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := []Table{}
+	for rows.Next() {
+		var tableName string
+		var col Column
+		if err := rows.Scan(&tableName, &col.Name, &col.Type, &col.NotNull, &col.Default); err != nil {
+			return nil, err
+		}
+		if len(tables) == 0 || tables[len(tables)-1].Name != tableName {
+			tables = append(tables, Table{Name: tableName, Columns: []Column{}})
+		}
+		t := &tables[len(tables)-1]
+		t.Columns = append(t.Columns, col)
+	}
+	return tables, rows.Err()
+}
+
+func isForeignKey(o SchemaObject) bool {
+	return strings.Contains(o.Definition, " FOREIGN KEY ")
+}
+
+// SQL returns DDL that recreates the objects in the Schema.  Objects are written in an order that
+// allows them to be created in a fresh database, with function bodies checked only when called.
+func (s Schema) SQL() string {
+	sections := [][]string{
+		objectDefinitions(s.Schemas),
+		objectDefinitions(s.Extensions),
+		objectDefinitions(s.Types),
+		objectDefinitions(s.Functions),
+		objectDefinitions(s.Sequences),
+		tableDefinitions(s.Tables),
+		objectDefinitions(s.Constraints),
+		objectDefinitions(s.Indexes),
+		objectDefinitions(s.Views),
+		objectDefinitions(s.Triggers),
+		objectDefinitions(s.Grants),
+	}
+	var b strings.Builder
+	for _, section := range sections {
+		for _, def := range section {
+			b.WriteString(def)
+			b.WriteString("\n\n")
+		}
+	}
+	return b.String()
+}
+
+// Empty reports whether the Schema has no objects in it.
+func (s Schema) Empty() bool {
+	return len(s.Schemas)+len(s.Extensions)+len(s.Types)+len(s.Functions)+len(s.Sequences)+
+		len(s.Tables)+len(s.Constraints)+len(s.Indexes)+len(s.Views)+len(s.Triggers)+
+		len(s.Grants) == 0
+}
+
+// SQL returns the CREATE TABLE statement for the Table.
+func (t Table) SQL() string {
+	cols := []string{}
+	for _, c := range t.Columns {
+		cols = append(cols, "\t"+c.SQL())
+	}
+	return fmt.Sprintf("CREATE TABLE %s (\n%s\n);", t.Name, strings.Join(cols, ",\n"))
+}
+
+// SQL returns the Column's definition, as it would appear in a CREATE TABLE statement.
+func (c Column) SQL() string {
+	parts := []string{c.Name, c.Type}
+	if c.Default != "" {
+		parts = append(parts, c.Default)
+	}
+	if c.NotNull {
+		parts = append(parts, "NOT NULL")
+	}
+	return strings.Join(parts, " ")
+}
+
+func objectDefinitions(objects []SchemaObject) []string {
+	defs := []string{}
+	for _, o := range objects {
+		defs = append(defs, o.Definition)
+	}
+	return defs
+}
+
+func tableDefinitions(tables []Table) []string {
+	defs := []string{}
+	for _, t := range tables {
+		defs = append(defs, t.SQL())
+	}
+	return defs
+}
+
+// withoutBookkeeping returns a copy of the Schema without the tables and other objects created by
+// pomegranate's init migration.
+func (s Schema) withoutBookkeeping() Schema {
+	skip := map[string]bool{}
+	for _, name := range append(bookkeepingTables, bookkeepingObjects...) {
+		skip[name] = true
+	}
+	keep := func(objects []SchemaObject) []SchemaObject {
+		kept := []SchemaObject{}
+		for _, o := range objects {
+			if !skip[o.Name] && !skip[o.Table] {
+				kept = append(kept, o)
+			}
+		}
+		return kept
+	}
+	tables := []Table{}
+	for _, t := range s.Tables {
+		if !skip[t.Name] {
+			tables = append(tables, t)
+		}
+	}
+	return Schema{
+		Schemas:     keep(s.Schemas),
+		Extensions:  keep(s.Extensions),
+		Types:       keep(s.Types),
+		Functions:   keep(s.Functions),
+		Sequences:   keep(s.Sequences),
+		Tables:      tables,
+		Constraints: keep(s.Constraints),
+		Indexes:     keep(s.Indexes),
+		Views:       keep(s.Views),
+		Triggers:    keep(s.Triggers),
+		Grants:      keep(s.Grants),
+	}
+}
+
+// BaselineContext adopts an existing database into pomegranate.  The directory must contain an
+// init migration (see InitMigration) and nothing else, and the database must not have any
+// migrations recorded.  BaselineContext writes the database's current schema to a new migration
+// after init, then, in a single transaction, runs the init migration to create pomegranate's
+// tables and records the baseline migration as run without running it.  If the transaction fails,
+// the baseline migration's directory is removed again.
+func BaselineContext(ctx context.Context, dir string, db Database, confirm bool) error {
+	beginner, ok := db.(txBeginner)
+	if !ok {
+		return fmt.Errorf("cannot begin a transaction on %T", db)
+	}
+	names, err := getMigrationDirectoryNames(OsDir(dir))
+	if err != nil {
+		return fmt.Errorf("error making baseline migration: %v", err)
+	}
+	if len(names) != 1 {
+		return fmt.Errorf(
+			"baseline needs a directory containing only an init migration, but %s has %d migrations",
+			dir, len(names),
+		)
+	}
+	state, err := GetMigrationStateContext(ctx, db)
+	if err != nil {
+		return fmt.Errorf("could not get migration state: %v", err)
+	}
+	if len(state) > 0 {
+		return fmt.Errorf("database already has %d migrations recorded", len(state))
+	}
+	schema, err := InspectSchemaContext(ctx, db)
+	if err != nil {
+		return err
+	}
+	initName := names[0]
+	name, err := nextMigrationName(initName, "baseline")
+	if err != nil {
+		return fmt.Errorf("error making baseline migration: %v", err)
+	}
+	if confirm {
+		fmt.Printf("Baseline will run %s and record %s as run without running it.\n", initName, name)
+		fmt.Print("Continue? (y/n) ")
+		if err := readConfirm(os.Stdin); err != nil {
+			return err
+		}
+	}
+	forwardSQL := fmt.Sprintf(baselineForwardTmpl, schema.withoutBookkeeping().SQL(), name)
+	backwardSQL := fmt.Sprintf(baselineBackwardTmpl, name)
+	if err := writeStubs(dir, name, forwardSQL, backwardSQL); err != nil {
+		return fmt.Errorf("error making baseline migration: %v", err)
+	}
+	allMigrations, err := ReadMigrationFiles(dir)
+	if err == nil {
+		err = runBaselineContext(ctx, beginner, allMigrations[0], allMigrations[1])
+	}
+	if err != nil {
+		if rmErr := os.RemoveAll(path.Join(dir, name)); rmErr != nil {
+			return fmt.Errorf("%v (and could not remove %s: %v)", err, name, rmErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// runBaselineContext runs the init migration and records the baseline migration as run, storing
+// the backward SQL of both, in one transaction.
+func runBaselineContext(ctx context.Context, db txBeginner, initMig, baseline Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	fmt.Printf("Running %s... ", initMig.Name)
+	for _, stmt := range transactionStatements(initMig.ForwardSQL) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			fmt.Println("Failure :(")
+			return fmt.Errorf("error running migration: %v", err)
+		}
+	}
+	fmt.Println("Success!")
+	fmt.Printf("Faking %s... ", baseline.Name)
+	if _, err := tx.ExecContext(ctx, "INSERT INTO migration_state (name) VALUES ($1)", baseline.Name); err != nil {
+		fmt.Println("Failure :(")
+		return fmt.Errorf("error faking migration: %v", err)
+	}
+	fmt.Println("Success!")
+	for _, mig := range []Migration{initMig, baseline} {
+		if err := storeMigrationContext(ctx, tx, mig); err != nil {
+			return fmt.Errorf("could not store backward SQL for %s: %v", mig.Name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// SquashContext replaces the migrations in dir, from the first up to and including `through`, with
+// a single migration that creates the schema they produce.  The schema is built by running the
+// migrations for ScratchEnvironment in a scratch database on the server that dial points to.  The squashed migration
+// directories are moved to an "archive" directory inside dir.  Only the schema is carried over, so
+// SquashContext refuses to squash migrations that insert, update, delete or copy data.  Databases
+// that already have all of the squashed migrations recorded are treated as if they had the new
+// migration recorded instead; see Migration.Replaces.
+func SquashContext(ctx context.Context, dir, through, dial string) error {
+	allMigrations, err := ReadMigrationFiles(dir)
+	if err != nil {
+		return err
+	}
+	squashed, err := getMigrationRange("", through, allMigrations)
+	if err != nil {
+		return err
+	}
+	if len(squashed) < 2 {
+		return fmt.Errorf("nothing to squash through %s", through)
+	}
+	replaces := []string{}
+	for _, mig := range squashed {
+		if len(mig.Replaces()) > 0 {
+			return fmt.Errorf("%s is already a squashed migration, and cannot be squashed again", mig.Name)
+		}
+		if stmt := dataStatement(mig.ForwardSQL); stmt != "" {
+			return fmt.Errorf("%s changes data, which the squashed migration would not carry over: %s", mig.Name, stmt)
+		}
+		replaces = append(replaces, directivePrefix+"replaces "+mig.Name)
+	}
+
+	scratch, err := NewScratchDatabaseContext(ctx, dial)
+	if err != nil {
+		return err
+	}
+	defer scratch.Close()
+	if err := MigrateForwardToWithOptions(ctx, through, scratch, allMigrations, false, Options{Environment: ScratchEnvironment}); err != nil {
+		return fmt.Errorf("could not run migrations in scratch database: %v", err)
+	}
+	schema, err := InspectSchemaContext(ctx, scratch)
+	if err != nil {
+		return err
+	}
+
+	name := strings.Split(through, "_")[0] + "_squashed"
+	forwardSQL := fmt.Sprintf(squashForwardTmpl, strings.Join(replaces, "\n"), schema.withoutBookkeeping().SQL(), name)
+	backwardSQL := fmt.Sprintf(squashBackwardTmpl, name)
+	if err := writeStubs(dir, name, forwardSQL, backwardSQL); err != nil {
+		return fmt.Errorf("error making squashed migration: %v", err)
+	}
+	return archiveMigrations(dir, squashed)
+}
+
+// DumpSchemaContext returns a snapshot of the database's schema, without pomegranate's own tables.
+// The snapshot is deterministic, so it can be checked in and compared between databases.
+func DumpSchemaContext(ctx context.Context, db Database) (string, error) {
+	schema, err := InspectSchemaContext(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	return schemaFileHeader + schema.withoutBookkeeping().SQL(), nil
+}
+
+// WriteSchemaFileContext writes a snapshot of the database's schema to fileName.  See
+// DumpSchemaContext.
+func WriteSchemaFileContext(ctx context.Context, db Database, fileName string) error {
+	dump, err := DumpSchemaContext(ctx, db)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fileName, []byte(dump), 0644); err != nil {
+		return fmt.Errorf("error writing schema file: %v", err)
+	}
+	fmt.Printf("Schema written to %s\n", fileName)
+	return nil
+}
+
+// CheckSchemaFileContext runs allMigrations for ScratchEnvironment in a scratch database on the
+// server that dial points to, and returns an error if the resulting schema does not match the
+// snapshot in fileName.
+func CheckSchemaFileContext(ctx context.Context, fileName, dial string, allMigrations []Migration) error {
+	expected, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return fmt.Errorf("error reading schema file: %v", err)
+	}
+	scratch, err := NewScratchDatabaseContext(ctx, dial)
+	if err != nil {
+		return err
+	}
+	defer scratch.Close()
+	if err := MigrateForwardToWithOptions(ctx, "", scratch, allMigrations, false, Options{Environment: ScratchEnvironment}); err != nil {
+		return fmt.Errorf("could not run migrations in scratch database: %v", err)
+	}
+	actual, err := DumpSchemaContext(ctx, scratch)
+	if err != nil {
+		return err
+	}
+	if line, want, got, differ := firstDifference(string(expected), actual); differ {
+		return fmt.Errorf(
+			"%s does not match the schema produced by the migrations, starting at line %d:\n  file:       %s\n  migrations: %s",
+			fileName, line, want, got,
+		)
+	}
+	return nil
+}
+
+// DetectDriftContext compares the schema of the database to the schema its recorded migrations
+// should have produced.  The expected schema is built by running exactly the migrations recorded
+// in the database's state, taken from allMigrations, in the order they were recorded, in a scratch
+// database on the server that dial points to.  Migrations that the database skipped, because they
+// are tagged for other environments, are skipped in the scratch database too.  It returns the
+// differences, ignoring pomegranate's own tables.
+func DetectDriftContext(ctx context.Context, db Database, dial string, allMigrations []Migration) ([]SchemaDiff, error) {
+	if dial == "" {
+		return nil, errors.New("a scratch database url is required to detect drift")
+	}
+	state, err := getSetStateContext(ctx, db, allMigrations)
+	if err != nil {
+		return nil, fmt.Errorf("could not get migration state: %v", err)
+	}
+	state, err = CollapseReplacedState(state, allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	if len(state) == 0 {
+		return nil, errors.New("state is empty. no migrations to compare against")
+	}
+	toRun, err := getStateMigrations(state, allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	skipped, err := GetSkippedMigrationsContext(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	skippedIn := map[string]string{}
+	for _, sk := range skipped {
+		skippedIn[sk.Name] = sk.Environment
+	}
+	actual, err := InspectSchemaContext(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	scratch, err := NewScratchDatabaseContext(ctx, dial)
+	if err != nil {
+		return nil, err
+	}
+	defer scratch.Close()
+	for _, mig := range toRun {
+		if env, ok := skippedIn[mig.Name]; ok {
+			err = skipMigrationContext(ctx, scratch, mig, env, os.Stdout)
+		} else {
+			err = runMigrationContext(ctx, scratch, mig, Forward, os.Stdout)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not run migrations in scratch database: %v", err)
+		}
+	}
+	expected, err := InspectSchemaContext(ctx, scratch)
+	if err != nil {
+		return nil, err
+	}
+	return diffSchemas(expected.withoutBookkeeping(), actual.withoutBookkeeping()), nil
+}
+
+// getStateMigrations returns the migrations from allMigrations that are recorded in state, in
+// state order.  It returns an error if any of them is missing from allMigrations.
+func getStateMigrations(state []MigrationRecord, allMigrations []Migration) ([]Migration, error) {
+	byName := map[string]Migration{}
+	for _, mig := range allMigrations {
+		byName[mig.Name] = mig
+	}
+	migs := []Migration{}
+	for _, rec := range state {
+		mig, ok := byName[rec.Name]
+		if !ok {
+			return nil, fmt.Errorf("migration %s from state is not in the static list", rec.Name)
+		}
+		migs = append(migs, mig)
+	}
+	return migs, nil
+}
@@ -0,0 +1,314 @@
+package pomegranate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testSchema = Schema{
+	Schemas:   []SchemaObject{{Name: "billing", Definition: "CREATE SCHEMA billing;"}},
+	Types:     []SchemaObject{{Name: "public.mood", Definition: "CREATE TYPE public.mood AS ENUM ('happy', 'sad');"}},
+	Sequences: []SchemaObject{{Name: "public.migration_log_id_seq", Definition: "CREATE SEQUENCE public.migration_log_id_seq;"}},
+	Tables: []Table{
+		{
+			Name: "public.migration_state",
+			Columns: []Column{
+				{Name: "name", Type: "text", NotNull: true},
+			},
+		},
+		{
+			Name: "public.people",
+			Columns: []Column{
+				{Name: "id", Type: "bigint", NotNull: true, Default: "GENERATED BY DEFAULT AS IDENTITY"},
+				{Name: "name", Type: "text", Default: "DEFAULT ''::text"},
+			},
+		},
+	},
+	Constraints: []SchemaObject{
+		{
+			Name:       "public.migration_state.migration_state_pkey",
+			Table:      "public.migration_state",
+			Definition: "ALTER TABLE public.migration_state ADD CONSTRAINT migration_state_pkey PRIMARY KEY (name);",
+		},
+		{
+			Name:       "public.people.people_pkey",
+			Table:      "public.people",
+			Definition: "ALTER TABLE public.people ADD CONSTRAINT people_pkey PRIMARY KEY (id);",
+		},
+	},
+}
+
+func TestSchemaSQL(t *testing.T) {
+	assert.Equal(t, `CREATE SCHEMA billing;
+
+CREATE TYPE public.mood AS ENUM ('happy', 'sad');
+
+CREATE SEQUENCE public.migration_log_id_seq;
+
+CREATE TABLE public.migration_state (
+	name text NOT NULL
+);
+
+CREATE TABLE public.people (
+	id bigint GENERATED BY DEFAULT AS IDENTITY NOT NULL,
+	name text DEFAULT ''::text
+);
+
+ALTER TABLE public.migration_state ADD CONSTRAINT migration_state_pkey PRIMARY KEY (name);
+
+ALTER TABLE public.people ADD CONSTRAINT people_pkey PRIMARY KEY (id);
+
+`, testSchema.SQL())
+}
+
+func TestSchemaWithoutBookkeeping(t *testing.T) {
+	s := testSchema.withoutBookkeeping()
+	assert.Equal(t, testSchema.Schemas, s.Schemas)
+	assert.Equal(t, testSchema.Types, s.Types)
+	assert.Equal(t, []SchemaObject{}, s.Sequences)
+	assert.Equal(t, testSchema.Tables[1:], s.Tables)
+	assert.Equal(t, testSchema.Constraints[1:], s.Constraints)
+	assert.False(t, s.Empty())
+	assert.True(t, Schema{}.Empty())
+}
+
+func TestOrderByDependencies(t *testing.T) {
+	views := []SchemaObject{{Name: "public.a"}, {Name: "public.b"}, {Name: "public.c"}, {Name: "public.d"}}
+	deps := map[string][]string{
+		"public.a": {"public.c"},
+		"public.b": {"public.other_schema_view"},
+		"public.c": {"public.d"},
+	}
+	names := []string{}
+	for _, v := range orderByDependencies(views, deps) {
+		names = append(names, v.Name)
+	}
+	assert.Equal(t, []string{"public.b", "public.d", "public.c", "public.a"}, names)
+}
+
+func TestInspectSchemaViewOrder(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	_, err := db.Exec(`
+		CREATE TABLE people (id INT, name TEXT);
+		CREATE VIEW z_people AS SELECT id, name FROM people;
+		CREATE VIEW a_names AS SELECT name FROM z_people;`)
+	assert.Nil(t, err)
+	s, err := InspectSchemaContext(context.Background(), db)
+	assert.Nil(t, err)
+	assert.Equal(t, "public.z_people", s.Views[0].Name)
+	assert.Equal(t, "public.a_names", s.Views[1].Name)
+}
+
+func TestInspectSchemaTypes(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	_, err := db.Exec(`
+		CREATE TYPE z_mood AS ENUM ('sad', 'happy');
+		CREATE DOMAIN a_cheerful AS z_mood DEFAULT 'happy' NOT NULL CONSTRAINT not_sad CHECK (VALUE <> 'sad');
+		CREATE TYPE b_pair AS (left_mood a_cheerful, moods z_mood[]);
+		CREATE TABLE people (id INT, mood z_mood);`)
+	assert.Nil(t, err)
+	s, err := InspectSchemaContext(context.Background(), db)
+	assert.Nil(t, err)
+	// the people table's row type is not a type of its own
+	assert.Equal(t, []SchemaObject{
+		{Name: "public.z_mood", Definition: "CREATE TYPE public.z_mood AS ENUM ('sad', 'happy');"},
+		{Name: "public.a_cheerful", Definition: "CREATE DOMAIN public.a_cheerful AS z_mood DEFAULT 'happy'::z_mood NOT NULL CONSTRAINT not_sad CHECK ((VALUE <> 'sad'::z_mood));"},
+		{Name: "public.b_pair", Definition: "CREATE TYPE public.b_pair AS (left_mood a_cheerful, moods z_mood[]);"},
+	}, s.Types)
+}
+
+func TestInspectSchema(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	err := MigrateForwardTo("", db, goodMigrations[:3], false)
+	assert.Nil(t, err)
+	s, err := InspectSchemaContext(context.Background(), db)
+	assert.Nil(t, err)
+	tableNames := []string{}
+	for _, t := range s.Tables {
+		tableNames = append(tableNames, t.Name)
+	}
+	assert.Equal(t, []string{
+		"public.foo",
+		"public.migration_backward",
+		"public.migration_log",
+		"public.migration_state",
+	}, tableNames)
+	assert.Equal(t, []Column{
+		{Name: "id", Type: "integer", NotNull: true, Default: "DEFAULT nextval('foo_id_seq'::regclass)"},
+		{Name: "stuff", Type: "text"},
+		{Name: "bar", Type: "text"},
+	}, s.Tables[0].Columns)
+}
+
+func TestBaseline(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	dir, _ := ioutil.TempDir(".", "pmgtest")
+	defer os.RemoveAll(dir)
+	_, err := db.Exec(`
+		CREATE TYPE tier AS ENUM ('free', 'paid');
+		CREATE DOMAIN email AS TEXT CHECK (VALUE LIKE '%@%');
+		CREATE TABLE customers (id SERIAL PRIMARY KEY, email email NOT NULL UNIQUE, tier tier NOT NULL DEFAULT 'free');`)
+	assert.Nil(t, err)
+	err = InitMigration(dir)
+	assert.Nil(t, err)
+
+	err = BaselineContext(context.Background(), dir, db, false)
+	assert.Nil(t, err)
+	f, _ := ioutil.ReadFile(path.Join(dir, "00002_baseline", "forward.sql"))
+	assert.Contains(t, string(f), "CREATE TABLE public.customers (")
+	assert.Contains(t, string(f), "CREATE TYPE public.tier AS ENUM ('free', 'paid');")
+	assert.Contains(t, string(f), "CREATE DOMAIN public.email AS text")
+	assert.NotContains(t, string(f), "migration_log")
+	state, _ := GetMigrationState(db)
+	assert.Equal(t, []string{"00001_init", "00002_baseline"}, []string{state[0].Name, state[1].Name})
+
+	// the baseline migration recreates the schema, types included, in an empty database
+	fresh, freshCleanup := freshDB(t)
+	defer freshCleanup()
+	migs, err := ReadMigrationFiles(dir)
+	assert.Nil(t, err)
+	err = MigrateForwardTo("", fresh, migs, false)
+	assert.Nil(t, err)
+	_, err = fresh.Exec("INSERT INTO customers (email, tier) VALUES ('a@example.com', 'paid')")
+	assert.Nil(t, err)
+}
+
+func TestSquash(t *testing.T) {
+	dir, _ := ioutil.TempDir(".", "pmgtest")
+	defer os.RemoveAll(dir)
+	for _, mig := range goodMigrations[:4] {
+		err := writeStubs(dir, mig.Name, mig.ForwardSQL[0], mig.BackwardSQL[0])
+		assert.Nil(t, err)
+	}
+	// a database that ran the original migrations
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	err := MigrateForwardTo(goodMigrations[2].Name, db, goodMigrations, false)
+	assert.Nil(t, err)
+
+	err = SquashContext(context.Background(), dir, goodMigrations[2].Name, dburl)
+	assert.Nil(t, err)
+	migs, err := ReadMigrationFiles(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"00003_squashed", "00004_fooquux"}, migsToNames(migs))
+	assert.Equal(t, migsToNames(goodMigrations[:3]), migs[0].Replaces())
+	_, err = os.Stat(path.Join(dir, "archive", goodMigrations[0].Name))
+	assert.Nil(t, err)
+
+	// the squashed migration builds a fresh database...
+	fresh, freshCleanup := freshDB(t)
+	defer freshCleanup()
+	err = MigrateForwardTo("", fresh, migs, false)
+	assert.Nil(t, err)
+
+	// ...and databases that ran the originals carry on from where they were
+	err = MigrateForwardTo("", db, migs, false)
+	assert.Nil(t, err)
+	state, _ := GetMigrationState(db)
+	assert.Equal(t, goodMigrations[3].Name, state[len(state)-1].Name)
+}
+
+func TestSquashEnvironmentTagged(t *testing.T) {
+	dir, _ := ioutil.TempDir(".", "pmgtest")
+	defer os.RemoveAll(dir)
+	devTable := devTableMigration("00004_dev_table")
+	for _, mig := range append(append([]Migration{}, goodMigrations[:3]...), devTable) {
+		err := writeStubs(dir, mig.Name, mig.ForwardSQL[0], mig.BackwardSQL[0])
+		assert.Nil(t, err)
+	}
+	err := SquashContext(context.Background(), dir, devTable.Name, dburl)
+	assert.Nil(t, err)
+	f, _ := ioutil.ReadFile(path.Join(dir, "00004_squashed", "forward.sql"))
+	assert.Contains(t, string(f), "CREATE TABLE public.foo (")
+	assert.NotContains(t, string(f), "dev_only")
+}
+
+func TestSquashRefusesDataChanges(t *testing.T) {
+	dir, _ := ioutil.TempDir(".", "pmgtest")
+	defer os.RemoveAll(dir)
+	for _, mig := range goodMigrations[:2] {
+		err := writeStubs(dir, mig.Name, mig.ForwardSQL[0], mig.BackwardSQL[0])
+		assert.Nil(t, err)
+	}
+	err := writeStubs(dir, "00003_seed", "BEGIN;\nINSERT INTO foo (stuff) VALUES ('x');\nINSERT INTO migration_state(name) VALUES ('00003_seed');\nCOMMIT;\n", "")
+	assert.Nil(t, err)
+	err = SquashContext(context.Background(), dir, "00003_seed", "")
+	assert.Equal(t, "00003_seed changes data, which the squashed migration would not carry over: INSERT INTO foo (stuff) VALUES ('x')", err.Error())
+}
+
+func TestGetStateMigrations(t *testing.T) {
+	// in DAG mode, state order need not match the static list
+	migs := depsToMigs([]string{"a", "b", "c", "d"}, map[string]string{"b": "a", "c": "a", "d": "c"})
+	got, err := getStateMigrations(namesToState([]string{"a", "c", "b"}), migs)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "c", "b"}, migsToNames(got))
+	_, err = getStateMigrations(namesToState([]string{"a", "x"}), migs)
+	assert.Equal(t, "migration x from state is not in the static list", err.Error())
+}
+
+func TestSchemaFile(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	dir, _ := ioutil.TempDir(".", "pmgtest")
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	err := MigrateForwardTo("", db, goodMigrations[:3], false)
+	assert.Nil(t, err)
+	fileName := path.Join(dir, "schema.sql")
+	err = WriteSchemaFileContext(ctx, db, fileName)
+	assert.Nil(t, err)
+	f, _ := ioutil.ReadFile(fileName)
+	assert.Contains(t, string(f), "CREATE TABLE public.foo (")
+	assert.NotContains(t, string(f), "migration_state")
+
+	err = CheckSchemaFileContext(ctx, fileName, dburl, goodMigrations[:3])
+	assert.Nil(t, err)
+	err = CheckSchemaFileContext(ctx, fileName, dburl, goodMigrations[:4])
+	assert.NotNil(t, err)
+	// migrations tagged for other environments are skipped in the scratch database
+	err = CheckSchemaFileContext(ctx, fileName, dburl, append(append([]Migration{}, goodMigrations[:3]...), devTableMigration("00004_dev_table")))
+	assert.Nil(t, err)
+}
+
+func TestDetectDrift(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	err := MigrateForwardTo(goodMigrations[2].Name, db, goodMigrations, false)
+	assert.Nil(t, err)
+	diffs, err := DetectDriftContext(ctx, db, dburl, goodMigrations)
+	assert.Nil(t, err)
+	assert.Equal(t, []SchemaDiff{}, diffs)
+
+	_, err = db.Exec("CREATE INDEX foo_stuff ON foo (stuff)")
+	assert.Nil(t, err)
+	diffs, err = DetectDriftContext(ctx, db, dburl, goodMigrations)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(diffs))
+	assert.Equal(t, "index", diffs[0].Kind)
+	assert.Equal(t, "extra", diffs[0].Change)
+}
+
+func TestDetectDriftEnvironmentTagged(t *testing.T) {
+	ctx := context.Background()
+	migs := append(append([]Migration{}, goodMigrations[:3]...), devTableMigration("00004_dev_table"))
+	for _, env := range []string{"dev", "prod"} {
+		db, cleanup := freshDB(t)
+		defer cleanup()
+		err := MigrateForwardToWithOptions(ctx, "", db, migs, false, Options{Environment: env})
+		assert.Nil(t, err)
+		// the table is expected only where the migration ran, rather than was skipped
+		diffs, err := DetectDriftContext(ctx, db, dburl, migs)
+		assert.Nil(t, err, env)
+		assert.Equal(t, []SchemaDiff{}, diffs, env)
+	}
+}
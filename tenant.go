@@ -0,0 +1,148 @@
+package pomegranate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TenantResult reports what happened when a tenant's schema was migrated by
+// MigrateTenantsContext.  Started is false for stragglers, the tenants that were never reached
+// because the context was cancelled or its deadline passed first.
+type TenantResult struct {
+	Schema   string
+	Started  bool
+	Error    error
+	Duration time.Duration
+}
+
+// OK reports whether the tenant's schema was migrated without error.
+func (r TenantResult) OK() bool {
+	return r.Started && r.Error == nil
+}
+
+// String is the tenant's status in pmg's summary table: "ok", "failed: " and the error, or "not
+// run" for a straggler.
+func (r TenantResult) String() string {
+	return runStatus(r.Started, r.Error)
+}
+
+// tenantSchemasSQL lists the schemas whose names match a LIKE pattern, leaving out Postgres's own.
+const tenantSchemasSQL = `SELECT nspname FROM pg_namespace
+WHERE nspname LIKE $1 AND nspname NOT IN ('pg_catalog', 'information_schema') AND nspname NOT LIKE 'pg_toast%'
+ORDER BY nspname;`
+
+// GetTenantSchemasContext returns the names of the schemas matching pattern, which uses the
+// syntax of SQL's LIKE, as in "tenant_%".
+func GetTenantSchemasContext(ctx context.Context, db Database, pattern string) ([]string, error) {
+	return queryTenantSchemasContext(ctx, db, tenantSchemasSQL, pattern)
+}
+
+// QueryTenantSchemasContext returns the schema names listed in the single column returned by
+// query, like "SELECT schema_name FROM accounts WHERE active".
+func QueryTenantSchemasContext(ctx context.Context, db Database, query string) ([]string, error) {
+	return queryTenantSchemasContext(ctx, db, query)
+}
+
+func queryTenantSchemasContext(ctx context.Context, db Database, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not list tenant schemas: %v", err)
+	}
+	defer rows.Close()
+	schemas := []string{}
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			return nil, fmt.Errorf("could not list tenant schemas: %v", err)
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, rows.Err()
+}
+
+// MigrateTenantsContext runs all the forward migrations that have not yet been run into each of
+// the tenant schemas, with up to concurrency tenants at a time.  Each tenant is migrated on its
+// own connection, with its search_path set to the tenant's schema followed by public, so that
+// unqualified names in the migrations, including migration_state, refer to the tenant's own
+// tables.  Each schema therefore needs its own copy of the initial migration that creates the
+// bookkeeping tables.
+//
+// A failure in one tenant doesn't stop the others.  The results are in the same order as
+// schemas.  If ctx is cancelled, the tenants not yet started are left as stragglers.
+func MigrateTenantsContext(ctx context.Context, db *sql.DB, schemas []string, allMigrations []Migration, concurrency int) []TenantResult {
+	return MigrateTenantsWithOptions(ctx, db, schemas, allMigrations, concurrency, Options{})
+}
+
+// MigrateTenantsWithOptions works like MigrateTenantsContext, migrating each tenant with opts.
+// opts.Repeatables are applied to each tenant's schema.  Each line of progress written to
+// opts.Output starts with the tenant's schema, as tenants are migrated side by side.
+func MigrateTenantsWithOptions(ctx context.Context, db *sql.DB, schemas []string, allMigrations []Migration, concurrency int, opts Options) []TenantResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]TenantResult, len(schemas))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var outMu sync.Mutex
+	for i, schema := range schemas {
+		results[i].Schema = schema
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+		if ctx.Err() != nil {
+			<-slots
+			continue
+		}
+		results[i].Started = true
+		wg.Add(1)
+		go func(result *TenantResult) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			out := newPrefixWriter(opts.output(), &outMu, result.Schema+": ")
+			defer out.Flush()
+			tenantOpts := opts
+			tenantOpts.Output = out
+			start := time.Now()
+			result.Error = migrateTenantContext(ctx, db, result.Schema, allMigrations, tenantOpts)
+			result.Duration = time.Since(start)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// migrateTenantContext runs the pending forward migrations into a single tenant's schema.
+func migrateTenantContext(ctx context.Context, db *sql.DB, schema string, allMigrations []Migration, opts Options) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "SET search_path TO "+pq.QuoteIdentifier(schema)+", public"); err != nil {
+		return fmt.Errorf("could not set search_path: %v", err)
+	}
+	// the connection goes back to the pool afterwards, so it mustn't keep the tenant's search_path,
+	// or a transaction left open by a failed migration
+	defer func() {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		conn.ExecContext(context.Background(), "RESET search_path")
+	}()
+
+	// current_schema() skips schemas in search_path that don't exist, and we mustn't create a
+	// tenant's tables in public.
+	var current sql.NullString
+	if err := conn.QueryRowContext(ctx, "SELECT current_schema()").Scan(&current); err != nil {
+		return err
+	}
+	if current.String != schema {
+		return fmt.Errorf("schema %s does not exist", schema)
+	}
+	return MigrateForwardToWithOptions(ctx, "", conn, allMigrations, false, opts)
+}
@@ -0,0 +1,81 @@
+package pomegranate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantResult(t *testing.T) {
+	assert.True(t, TenantResult{Schema: "tenant_a", Started: true}.OK())
+	assert.False(t, TenantResult{Schema: "tenant_a", Started: true, Error: errors.New("boom")}.OK())
+	// a straggler has no error, but wasn't migrated either
+	straggler := TenantResult{Schema: "tenant_b"}
+	assert.False(t, straggler.OK())
+	assert.Equal(t, "not run", straggler.String())
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	a := newPrefixWriter(&buf, &mu, "tenant_a: ")
+	b := newPrefixWriter(&buf, &mu, "tenant_b: ")
+	fmt.Fprintf(a, "Running 00001_init... ")
+	fmt.Fprintf(b, "Running 00001_init... ")
+	fmt.Fprintln(b, "Success!")
+	fmt.Fprintln(a, "Failure :(\nwarning: one\nwarning: two")
+	fmt.Fprintf(b, "Running 00002_foobar... ")
+	assert.Nil(t, a.Flush())
+	assert.Nil(t, b.Flush())
+	assert.Equal(t, `tenant_b: Running 00001_init... Success!
+tenant_a: Running 00001_init... Failure :(
+tenant_a: warning: one
+tenant_a: warning: two
+tenant_b: Running 00002_foobar... 
+`, buf.String())
+}
+
+func TestMigrateTenantsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := MigrateTenantsContext(ctx, nil, []string{"tenant_a", "tenant_b"}, goodMigrations, 2)
+	assert.Equal(t, []TenantResult{{Schema: "tenant_a"}, {Schema: "tenant_b"}}, results)
+}
+
+func TestMigrateTenants(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	for _, schema := range []string{"tenant_a", "tenant_b"} {
+		_, err := db.Exec("CREATE SCHEMA " + schema)
+		assert.Nil(t, err)
+	}
+
+	schemas, err := GetTenantSchemasContext(ctx, db, "tenant_%")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"tenant_a", "tenant_b"}, schemas)
+
+	// tenant_a is partly migrated already, and tenant_c doesn't exist
+	results := MigrateTenantsContext(ctx, db, []string{"tenant_a"}, goodMigrations[:2], 2)
+	assert.True(t, results[0].OK())
+	results = MigrateTenantsContext(ctx, db, []string{"tenant_a", "tenant_b", "tenant_c"}, goodMigrations[:3], 2)
+	assert.True(t, results[0].OK())
+	assert.True(t, results[1].OK())
+	assert.Equal(t, "failed: schema tenant_c does not exist", results[2].String())
+
+	for _, schema := range []string{"tenant_a", "tenant_b"} {
+		var count int
+		err := db.QueryRow("SELECT count(*) FROM " + schema + ".migration_state").Scan(&count)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, count)
+	}
+	// nothing was created in public
+	state, err := GetMigrationState(db)
+	assert.Nil(t, err)
+	assert.Equal(t, []MigrationRecord{}, state)
+}
@@ -0,0 +1,93 @@
+package pomegranate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// NotUpToDateError is returned by CheckUpToDateContext when the database's migration state
+// doesn't match the migrations the application was built with.  Pending lists the migrations that
+// haven't been run yet, and Unknown the ones that have been run but aren't in the application's
+// list, which usually means the database has been migrated by a newer version.
+type NotUpToDateError struct {
+	Pending []string
+	Unknown []string
+}
+
+func (e *NotUpToDateError) Error() string {
+	problems := []string{}
+	if len(e.Pending) > 0 {
+		problems = append(problems, "pending migrations: "+strings.Join(e.Pending, ", "))
+	}
+	if len(e.Unknown) > 0 {
+		problems = append(problems, "unknown migrations: "+strings.Join(e.Unknown, ", "))
+	}
+	return "database is not up to date: " + strings.Join(problems, "; ")
+}
+
+// CheckUpToDateContext returns a *NotUpToDateError if any of allMigrations have not been run
+// against db, or if db has had migrations run that aren't in allMigrations.  It is meant for
+// applications that don't run their own migrations, but shouldn't start against a database that
+// is behind.  Post-deploy migrations are not counted as pending, since they only run once the
+// new code is out.
+func CheckUpToDateContext(ctx context.Context, db Database, allMigrations []Migration) error {
+	state, err := getSetStateContext(ctx, db, allMigrations)
+	if err != nil {
+		return fmt.Errorf("could not get migration state: %v", err)
+	}
+	state, err = CollapseReplacedState(state, allMigrations)
+	if err != nil {
+		return err
+	}
+	e := &NotUpToDateError{}
+	for _, mig := range allMigrations {
+		if !nameInState(mig.Name, state) && mig.Phase() != PostDeploy {
+			e.Pending = append(e.Pending, mig.Name)
+		}
+	}
+	for _, rec := range state {
+		if !nameInMigrationList(rec.Name, allMigrations) {
+			e.Unknown = append(e.Unknown, rec.Name)
+		}
+	}
+	if len(e.Pending) > 0 || len(e.Unknown) > 0 {
+		return e
+	}
+	return nil
+}
+
+// WaitForMigrationsContext calls CheckUpToDateContext every interval until the database is up to
+// date, for applications that start alongside another process, like a migration job, that
+// migrates the database.  Errors, such as the database not accepting connections yet, are retried
+// too.  It gives up and returns the last error when ctx is done, so give it a deadline.  It
+// returns at once if the database has migrations the application doesn't know about, since
+// waiting won't fix that.  interval must be positive.
+func WaitForMigrationsContext(ctx context.Context, db Database, allMigrations []Migration, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive, not %v", interval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last error
+	for {
+		err := CheckUpToDateContext(ctx, db, allMigrations)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil && last != nil {
+			// the check was cut short by ctx, so the previous one says more
+			return last
+		}
+		if e, ok := err.(*NotUpToDateError); ok && len(e.Unknown) > 0 {
+			return err
+		}
+		last = err
+		select {
+		case <-ctx.Done():
+			return last
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package pomegranate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotUpToDateError(t *testing.T) {
+	tt := []struct {
+		err NotUpToDateError
+		msg string
+	}{
+		{
+			NotUpToDateError{Pending: []string{"00004_a", "00005_b"}},
+			"database is not up to date: pending migrations: 00004_a, 00005_b",
+		},
+		{
+			NotUpToDateError{Unknown: []string{"00006_c"}},
+			"database is not up to date: unknown migrations: 00006_c",
+		},
+		{
+			NotUpToDateError{Pending: []string{"00004_a"}, Unknown: []string{"00006_c"}},
+			"database is not up to date: pending migrations: 00004_a; unknown migrations: 00006_c",
+		},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.msg, tc.err.Error())
+	}
+}
+
+func TestCheckUpToDate(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	err := MigrateForwardToContext(ctx, "00002_foobar", db, goodMigrations, false)
+	assert.Nil(t, err)
+	assert.Nil(t, CheckUpToDateContext(ctx, db, goodMigrations[:2]))
+
+	err = CheckUpToDateContext(ctx, db, goodMigrations[:3])
+	assert.Equal(t, &NotUpToDateError{Pending: []string{"00003_foobaz"}}, err)
+	err = CheckUpToDateContext(ctx, db, goodMigrations[:1])
+	assert.Equal(t, &NotUpToDateError{Unknown: []string{"00002_foobar"}}, err)
+
+	// post-deploy migrations may still be pending
+	migs := append([]Migration{}, goodMigrations[:3]...)
+	migs[2].ForwardSQL = []string{"-- pmg:phase post\n" + migs[2].ForwardSQL[0]}
+	assert.Nil(t, CheckUpToDateContext(ctx, db, migs))
+}
+
+func TestWaitForMigrationsInterval(t *testing.T) {
+	// the interval is checked before db is used
+	err := WaitForMigrationsContext(context.Background(), nil, goodMigrations, 0)
+	assert.Equal(t, "interval must be positive, not 0s", err.Error())
+	err = WaitForMigrationsContext(context.Background(), nil, goodMigrations, -time.Second)
+	assert.Equal(t, "interval must be positive, not -1s", err.Error())
+}
+
+func TestWaitForMigrations(t *testing.T) {
+	db, cleanup := freshDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	err := MigrateForwardToContext(ctx, "00002_foobar", db, goodMigrations, false)
+	assert.Nil(t, err)
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err = WaitForMigrationsContext(timeout, db, goodMigrations[:3], 10*time.Millisecond)
+	assert.Equal(t, &NotUpToDateError{Pending: []string{"00003_foobaz"}}, err)
+
+	done := make(chan error)
+	go func() {
+		done <- WaitForMigrationsContext(ctx, db, goodMigrations[:3], 10*time.Millisecond)
+	}()
+	err = MigrateForwardToContext(ctx, "00003_foobaz", db, goodMigrations, false)
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+}
@@ -2,10 +2,15 @@ package pomegranate
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"sync"
 )
 
 // This file should contain only private, mostly pure functions.  They should
@@ -29,16 +34,177 @@ func nameInState(name string, state []MigrationRecord) bool {
 	return false
 }
 
-func getConfirm(toRun []Migration, forwardBack string, input io.Reader) error {
+// getConfirm lists the migrations to be run on out, and asks for confirmation on input.
+func getConfirm(toRun []Migration, forwardBack string, out io.Writer, input io.Reader) error {
 	names := []string{}
 	for _, mig := range toRun {
-		names = append(names, mig.Name)
+		names = append(names, displayName(mig))
 	}
-	fmt.Printf(
+	fmt.Fprintf(
+		out,
 		"%s migrations that will be run:\n%s\nRun these migrations? (y/n) ",
 		forwardBack,
 		strings.Join(names, "\n"),
 	)
+	return readConfirm(input)
+}
+
+// getFleetConfirm is like getConfirm, but lists the migrations to be run against each of several
+// databases, named by labels.
+func getFleetConfirm(labels []string, plans [][]Migration, out io.Writer, input io.Reader) error {
+	fmt.Fprintln(out, "Forward migrations that will be run:")
+	for i, label := range labels {
+		if len(plans[i]) == 0 {
+			fmt.Fprintf(out, "%s: none\n", label)
+			continue
+		}
+		fmt.Fprintf(out, "%s:\n", label)
+		for _, mig := range plans[i] {
+			fmt.Fprintf(out, "  %s\n", displayName(mig))
+		}
+	}
+	fmt.Fprint(out, "Run these migrations? (y/n) ")
+	return readConfirm(input)
+}
+
+// getSyncConfirm is like getConfirm, but lists both halves of a sync plan.
+func getSyncConfirm(backward, forward []Migration, out io.Writer, input io.Reader) error {
+	fmt.Fprintln(out, "Backward migrations that will be run:")
+	for _, mig := range backward {
+		fmt.Fprintln(out, displayName(mig))
+	}
+	fmt.Fprintln(out, "Then forward migrations that will be run:")
+	for _, mig := range forward {
+		fmt.Fprintln(out, displayName(mig))
+	}
+	fmt.Fprint(out, "Run these migrations? (y/n) ")
+	return readConfirm(input)
+}
+
+// getChangedRepeatables returns the repeatable migrations that have no record, or whose checksum
+// differs from the one recorded when they were last applied.
+func getChangedRepeatables(records []RepeatableRecord, repeatables []RepeatableMigration) []RepeatableMigration {
+	applied := map[string]string{}
+	for _, rec := range records {
+		applied[rec.Name] = rec.Checksum
+	}
+	changed := []RepeatableMigration{}
+	for _, r := range repeatables {
+		if applied[r.Name] != r.Checksum() {
+			changed = append(changed, r)
+		}
+	}
+	return changed
+}
+
+// namespaceOf returns the namespace that a migration name is qualified by, or an empty string.
+func namespaceOf(name string) string {
+	if i := strings.Index(name, namespaceSeparator); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// qualifyReference qualifies ref, a migration named in one of the directives of the migration
+// called name, by name's namespace, since a set's directives name its other migrations unqualified.
+func qualifyReference(name, ref string) string {
+	namespace := namespaceOf(name)
+	if namespace == "" || strings.Contains(ref, namespaceSeparator) {
+		return ref
+	}
+	return namespace + namespaceSeparator + ref
+}
+
+// filterStateByNamespace returns the records in state for migrations in the given namespace.
+func filterStateByNamespace(state []MigrationRecord, namespace string) []MigrationRecord {
+	filtered := []MigrationRecord{}
+	for _, rec := range state {
+		if namespaceOf(rec.Name) == namespace {
+			filtered = append(filtered, rec)
+		}
+	}
+	return filtered
+}
+
+// displayName returns the migration's name, marked if it is written in Go, for listing
+// migrations before running them.
+func displayName(mig Migration) string {
+	if mig.IsGo() {
+		return mig.Name + " (Go)"
+	}
+	return mig.Name
+}
+
+// printNothingToRun tells out that there are no migrations to run, or to fake, and why if the
+// named one has already been run.
+func printNothingToRun(out io.Writer, name string, state []MigrationRecord, verb string) {
+	if name != "" && nameInState(name, state) {
+		fmt.Fprintf(out, "migration '%s' has already been run\n", name)
+	}
+	fmt.Fprintf(out, "No migrations to %s\n", verb)
+}
+
+// runStatus is the status of one of several runs made side by side, like a tenant's or a
+// database's: "not run" if it was never started, "failed: <err>" if it failed, and "ok" otherwise.
+func runStatus(started bool, err error) string {
+	switch {
+	case !started:
+		return "not run"
+	case err != nil:
+		return fmt.Sprintf("failed: %v", err)
+	}
+	return "ok"
+}
+
+// prefixWriter writes whole lines to w, each starting with prefix, so that the progress of
+// migrations run side by side can be told apart.  Writers sharing w must share mu.  Text after the
+// last newline is held until the next one, or until Flush.
+type prefixWriter struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, mu *sync.Mutex, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, mu: mu, prefix: prefix}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	end := bytes.LastIndexByte(p.buf, '\n')
+	if end < 0 {
+		return len(b), nil
+	}
+	lines := p.buf[:end+1]
+	p.buf = append([]byte{}, p.buf[end+1:]...)
+	return len(b), p.write(lines)
+}
+
+// Flush writes any text left after the last newline, as a line of its own.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	rest := append(p.buf, '\n')
+	p.buf = nil
+	return p.write(rest)
+}
+
+func (p *prefixWriter) write(lines []byte) error {
+	prefixed := []byte{}
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) > 0 {
+			prefixed = append(append(prefixed, p.prefix...), line...)
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(prefixed)
+	return err
+}
+
+func readConfirm(input io.Reader) error {
 	reader := bufio.NewReader(input)
 	resp, err := reader.ReadString('\n')
 	if err != nil {
@@ -58,6 +224,13 @@ func getConfirm(toRun []Migration, forwardBack string, input io.Reader) error {
 // of all migrations, and returns all that haven't been run yet.  Error if the
 // state is out of sync with the allMigrations list.
 func getForwardMigrations(state []MigrationRecord, allMigrations []Migration) ([]Migration, error) {
+	if hasDependencies(allMigrations) {
+		return getDAGForwardMigrations(state, allMigrations)
+	}
+	state, err := CollapseReplacedState(state, allMigrations)
+	if err != nil {
+		return nil, err
+	}
 	stateCount := len(state)
 	migCount := len(allMigrations)
 	if stateCount > migCount {
@@ -93,9 +266,11 @@ func getForwardMigrationsToRun(name string, state []MigrationRecord, allMigratio
 		return nil, errors.New("no migrations provided")
 	}
 	if nameInState(name, state) {
-		fmt.Printf("migration '%s' has already been run\n", name)
 		return []Migration{}, nil
 	}
+	if hasDependencies(allMigrations) {
+		return getDAGForwardMigrationsToRun(name, state, allMigrations)
+	}
 	if name == "" {
 		name = allMigrations[len(allMigrations)-1].Name
 	}
@@ -116,6 +291,13 @@ func getForwardMigrationsToRun(name string, state []MigrationRecord, allMigratio
 // getMigrationsToReverse takes the name that you're rolling back to, state of
 // all migrations run so far, and an ordered list of all possible migrations.
 func getMigrationsToReverse(name string, state []MigrationRecord, allMigrations []Migration) ([]Migration, error) {
+	if hasDependencies(allMigrations) {
+		return getDAGMigrationsToReverse(name, state, allMigrations)
+	}
+	state, err := CollapseReplacedState(state, allMigrations)
+	if err != nil {
+		return nil, err
+	}
 	// get name of most recent migration
 	latest := state[len(state)-1].Name
 	// trim allMigrations to ignore anything newer than latest in state.
@@ -151,6 +333,638 @@ func getMigrationsToReverse(name string, state []MigrationRecord, allMigrations
 	return nil, fmt.Errorf("migration %s not in state", name)
 }
 
+// getMigrationsToReverseStored works like getMigrationsToReverse, but falls back to the
+// BackwardSQL stored in the database for migrations in state that are missing from
+// allMigrations.  When a migration has both source and a stored copy, the source is used, and a
+// warning is printed if the two differ.
+func getMigrationsToReverseStored(name string, state []MigrationRecord, allMigrations []Migration, stored []StoredMigration) ([]Migration, error) {
+	state, err := CollapseReplacedState(state, allMigrations)
+	if err != nil {
+		return nil, err
+	}
+	if hasDependencies(allMigrations) {
+		// only the named migration and the ones that might depend on it are reversed
+		names, err := getDAGNamesToReverse(name, state, allMigrations)
+		if err != nil {
+			return nil, err
+		}
+		state = []MigrationRecord{}
+		for i := len(names) - 1; i >= 0; i-- {
+			state = append(state, MigrationRecord{Name: names[i]})
+		}
+	}
+	sources := map[string]Migration{}
+	for _, mig := range allMigrations {
+		sources[mig.Name] = mig
+	}
+	storedByName := map[string]StoredMigration{}
+	for _, s := range stored {
+		storedByName[s.Name] = s
+	}
+	toRun := []Migration{}
+	for i := len(state) - 1; i >= 0; i-- {
+		recName := state[i].Name
+		mig, haveSource := sources[recName]
+		s, haveStored := storedByName[recName]
+		switch {
+		case haveSource && haveStored:
+			if s.Checksum != mig.BackwardChecksum() {
+				fmt.Printf(
+					"warning: backward SQL for %s differs from the copy stored when it was applied; using source\n",
+					recName,
+				)
+			}
+		case haveStored:
+			mig = Migration{Name: recName, BackwardSQL: s.BackwardSQL}
+		case !haveSource:
+			return nil, fmt.Errorf("migration %s is in state, but has neither source nor stored backward SQL", recName)
+		}
+		toRun = append(toRun, mig)
+		if recName == name {
+			return toRun, nil
+		}
+	}
+	return nil, fmt.Errorf("migration %s not in state", name)
+}
+
+// getSyncMigrations returns the backward migrations (most recent first) and forward migrations
+// needed to make state exactly match allMigrations.  Migrations in state beyond the end of
+// allMigrations are rolled back using stored backward SQL where no source is available.  It is an
+// error for both state and allMigrations to have entries beyond their common prefix, as that
+// means their histories have diverged.  Migrations that declare their dependencies are synced by
+// getDAGSyncMigrations instead.
+func getSyncMigrations(state []MigrationRecord, allMigrations []Migration, stored []StoredMigration) ([]Migration, []Migration, error) {
+	if hasDependencies(allMigrations) {
+		return getDAGSyncMigrations(state, allMigrations, stored)
+	}
+	state, err := CollapseReplacedState(state, allMigrations)
+	if err != nil {
+		return nil, nil, err
+	}
+	common := 0
+	for common < len(state) && common < len(allMigrations) && state[common].Name == allMigrations[common].Name {
+		common++
+	}
+	extraState := state[common:]
+	forward := allMigrations[common:]
+	if len(extraState) > 0 && len(forward) > 0 {
+		return nil, nil, fmt.Errorf(
+			"histories have diverged: migration %d from state (%s) does not match name from static list (%s)",
+			common+1, extraState[0].Name, forward[0].Name,
+		)
+	}
+	backward := []Migration{}
+	if len(extraState) > 0 {
+		backward, err = getMigrationsToReverseStored(extraState[0].Name, state, allMigrations, stored)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return backward, forward, nil
+}
+
+// makePlan builds a Plan for running toRun against the database with the given identity and state.
+func makePlan(identity DatabaseIdentity, state []MigrationRecord, toRun []Migration) Plan {
+	p := Plan{
+		Version:    planVersion,
+		Database:   identity,
+		State:      []string{},
+		Migrations: []PlannedMigration{},
+	}
+	for _, rec := range state {
+		p.State = append(p.State, rec.Name)
+	}
+	for _, mig := range toRun {
+		p.Migrations = append(p.Migrations, PlannedMigration{
+			Name:             mig.Name,
+			ForwardSQL:       mig.ForwardSQL,
+			ForwardChecksum:  mig.ForwardChecksum(),
+			BackwardSQL:      mig.BackwardSQL,
+			BackwardChecksum: mig.BackwardChecksum(),
+		})
+	}
+	return p
+}
+
+// verifyPlan checks that a Plan is still valid for the database with the given identity and
+// state, and that neither the plan nor the source in allMigrations has changed since it was made.
+// It returns the migrations to run.
+func verifyPlan(p Plan, identity DatabaseIdentity, state []MigrationRecord, allMigrations []Migration) ([]Migration, error) {
+	if p.Version != planVersion {
+		return nil, fmt.Errorf("unsupported plan version %d", p.Version)
+	}
+	if p.Database != identity {
+		return nil, fmt.Errorf(
+			"plan was made for database '%s' on %s:%d, not '%s' on %s:%d",
+			p.Database.Name, p.Database.Host, p.Database.Port, identity.Name, identity.Host, identity.Port,
+		)
+	}
+	if len(p.State) != len(state) {
+		return nil, fmt.Errorf("migration state has %d entries, but plan was made with %d", len(state), len(p.State))
+	}
+	for i, rec := range state {
+		if rec.Name != p.State[i] {
+			return nil, fmt.Errorf(
+				"migration %d from state (%s) does not match state when plan was made (%s)",
+				i+1, rec.Name, p.State[i],
+			)
+		}
+	}
+	sources := map[string]Migration{}
+	for _, mig := range allMigrations {
+		sources[mig.Name] = mig
+	}
+	toRun := []Migration{}
+	for _, pm := range p.Migrations {
+		mig := Migration{Name: pm.Name, ForwardSQL: pm.ForwardSQL, BackwardSQL: pm.BackwardSQL}
+		if mig.ForwardChecksum() != pm.ForwardChecksum || mig.BackwardChecksum() != pm.BackwardChecksum {
+			return nil, fmt.Errorf("SQL for %s in plan does not match its checksum", pm.Name)
+		}
+		src, ok := sources[pm.Name]
+		if !ok {
+			return nil, fmt.Errorf("migration %s in plan not found in source", pm.Name)
+		}
+		if src.ForwardChecksum() != pm.ForwardChecksum || src.BackwardChecksum() != pm.BackwardChecksum {
+			return nil, fmt.Errorf("source for %s has changed since plan was made", pm.Name)
+		}
+		if src.IsGo() {
+			// the plan can only record the name of a Go migration
+			mig = src
+		}
+		toRun = append(toRun, mig)
+	}
+	if hasDependencies(allMigrations) {
+		if err := checkDependencyOrder(state, toRun, allMigrations); err != nil {
+			return nil, err
+		}
+	}
+	return toRun, nil
+}
+
+// getMigrationRange returns the migrations from allMigrations starting with `from` and ending with
+// `to`, inclusive.  An empty `from` starts at the first migration, and an empty `to` ends at the
+// last.  Migrations that declare their dependencies are taken in dependency order.
+func getMigrationRange(from, to string, allMigrations []Migration) ([]Migration, error) {
+	if len(allMigrations) == 0 {
+		return nil, errors.New("no migrations provided")
+	}
+	if hasDependencies(allMigrations) {
+		ordered, err := orderMigrations(allMigrations)
+		if err != nil {
+			return nil, err
+		}
+		allMigrations = ordered
+	}
+	if from == "" {
+		from = allMigrations[0].Name
+	}
+	if to == "" {
+		to = allMigrations[len(allMigrations)-1].Name
+	}
+	start := -1
+	for i, mig := range allMigrations {
+		if mig.Name == from {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("migration %s not found", from)
+	}
+	if !nameInMigrationList(to, allMigrations[start:]) {
+		return nil, fmt.Errorf("migration %s not found after %s", to, from)
+	}
+	return trimMigrationsTail(to, allMigrations[start:])
+}
+
+// reverseMigrations returns a copy of migs in reverse order.
+func reverseMigrations(migs []Migration) []Migration {
+	reversed := make([]Migration, 0, len(migs))
+	for i := len(migs) - 1; i >= 0; i-- {
+		reversed = append(reversed, migs[i])
+	}
+	return reversed
+}
+
+// getDirectives returns the values of all the "-- pmg:<name> <value>" comment lines in sqls with
+// the given name, in the order they appear.
+func getDirectives(name string, sqls []string) []string {
+	values := []string{}
+	prefix := directivePrefix + name
+	for _, sql := range sqls {
+		for _, line := range strings.Split(sql, "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, prefix) {
+				continue
+			}
+			rest := line[len(prefix):]
+			if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+				// a longer directive name that starts with this one
+				continue
+			}
+			values = append(values, strings.TrimSpace(rest))
+		}
+	}
+	return values
+}
+
+// CollapseReplacedState returns a copy of state in which any run of records for migrations that
+// have been squashed is replaced by a single record for the migration that replaced them, stamped
+// with the time of the last of them.  It returns an error if state contains only some of the
+// migrations replaced by a squashed one.
+func CollapseReplacedState(state []MigrationRecord, allMigrations []Migration) ([]MigrationRecord, error) {
+	for _, mig := range allMigrations {
+		replaces := mig.Replaces()
+		if len(replaces) == 0 || nameInState(mig.Name, state) {
+			continue
+		}
+		start := -1
+		for i, rec := range state {
+			if rec.Name == replaces[0] {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			continue
+		}
+		end := start + len(replaces)
+		if end > len(state) {
+			end = len(state)
+		}
+		for i := start; i < end; i++ {
+			if state[i].Name != replaces[i-start] {
+				return nil, fmt.Errorf(
+					"migration %d from state (%s) does not match migration squashed into %s (%s)",
+					i+1, state[i].Name, mig.Name, replaces[i-start],
+				)
+			}
+		}
+		if end-start < len(replaces) {
+			return nil, fmt.Errorf(
+				"state has only %d of the %d migrations squashed into %s; run the rest with a version from before the squash",
+				end-start, len(replaces), mig.Name,
+			)
+		}
+		collapsed := append([]MigrationRecord{}, state[:start]...)
+		last := state[end-1]
+		collapsed = append(collapsed, MigrationRecord{Name: mig.Name, Time: last.Time, Who: last.Who})
+		state = append(collapsed, state[end:]...)
+	}
+	return state, nil
+}
+
+// diffSchemas returns the differences between an expected and an actual Schema, grouped by kind
+// of object in the order they appear in a Schema, and sorted by name within each kind.  Columns
+// are compared individually for tables that are in both.
+func diffSchemas(expected, actual Schema) []SchemaDiff {
+	diffs := []SchemaDiff{}
+	diffs = append(diffs, diffObjects("schema", expected.Schemas, actual.Schemas)...)
+	diffs = append(diffs, diffObjects("extension", expected.Extensions, actual.Extensions)...)
+	diffs = append(diffs, diffObjects("type", expected.Types, actual.Types)...)
+	diffs = append(diffs, diffObjects("function", expected.Functions, actual.Functions)...)
+	diffs = append(diffs, diffObjects("sequence", expected.Sequences, actual.Sequences)...)
+	diffs = append(diffs, diffTables(expected.Tables, actual.Tables)...)
+	diffs = append(diffs, diffObjects("constraint", expected.Constraints, actual.Constraints)...)
+	diffs = append(diffs, diffObjects("index", expected.Indexes, actual.Indexes)...)
+	diffs = append(diffs, diffObjects("view", expected.Views, actual.Views)...)
+	diffs = append(diffs, diffObjects("trigger", expected.Triggers, actual.Triggers)...)
+	diffs = append(diffs, diffObjects("grant", expected.Grants, actual.Grants)...)
+	return diffs
+}
+
+func diffObjects(kind string, expected, actual []SchemaObject) []SchemaDiff {
+	expectedDefs := map[string]string{}
+	actualDefs := map[string]string{}
+	names := []string{}
+	for _, o := range expected {
+		expectedDefs[o.Name] = o.Definition
+		names = append(names, o.Name)
+	}
+	for _, o := range actual {
+		actualDefs[o.Name] = o.Definition
+		if _, ok := expectedDefs[o.Name]; !ok {
+			names = append(names, o.Name)
+		}
+	}
+	sort.Strings(names)
+	diffs := []SchemaDiff{}
+	for _, name := range names {
+		e, inExpected := expectedDefs[name]
+		a, inActual := actualDefs[name]
+		switch {
+		case !inActual:
+			diffs = append(diffs, SchemaDiff{Kind: kind, Name: name, Change: "missing", Expected: e})
+		case !inExpected:
+			diffs = append(diffs, SchemaDiff{Kind: kind, Name: name, Change: "extra", Actual: a})
+		case e != a:
+			diffs = append(diffs, SchemaDiff{Kind: kind, Name: name, Change: "changed", Expected: e, Actual: a})
+		}
+	}
+	return diffs
+}
+
+func diffTables(expected, actual []Table) []SchemaDiff {
+	tableObjects := func(tables []Table) []SchemaObject {
+		objects := []SchemaObject{}
+		for _, t := range tables {
+			objects = append(objects, SchemaObject{Name: t.Name, Definition: t.SQL()})
+		}
+		return objects
+	}
+	columnObjects := func(t Table) []SchemaObject {
+		objects := []SchemaObject{}
+		for _, c := range t.Columns {
+			objects = append(objects, SchemaObject{Name: t.Name + "." + c.Name, Definition: c.SQL()})
+		}
+		return objects
+	}
+	diffs := []SchemaDiff{}
+	actualTables := map[string]Table{}
+	for _, t := range actual {
+		actualTables[t.Name] = t
+	}
+	for _, d := range diffObjects("table", tableObjects(expected), tableObjects(actual)) {
+		if d.Change != "changed" {
+			diffs = append(diffs, d)
+		}
+	}
+	for _, e := range expected {
+		if a, ok := actualTables[e.Name]; ok {
+			diffs = append(diffs, diffObjects("column", columnObjects(e), columnObjects(a))...)
+		}
+	}
+	return diffs
+}
+
+// firstDifference compares two multi-line strings, and returns the first line number at which
+// they differ along with the lines from each.  A missing line is returned as "<end of file>".
+func firstDifference(a, b string) (int, string, string, bool) {
+	aLines := strings.Split(a, "\n")
+	bLines := strings.Split(b, "\n")
+	for i := 0; i < len(aLines) || i < len(bLines); i++ {
+		aLine, bLine := "<end of file>", "<end of file>"
+		if i < len(aLines) {
+			aLine = aLines[i]
+		}
+		if i < len(bLines) {
+			bLine = bLines[i]
+		}
+		if aLine != bLine {
+			return i + 1, aLine, bLine, true
+		}
+	}
+	return 0, "", "", false
+}
+
+// splitStatements splits a string of SQL into individual statements on semicolons, taking care
+// not to split inside quoted strings and identifiers, dollar-quoted strings or comments.  The
+// statements are returned trimmed and without their terminating semicolons.  Statements
+// containing nothing but comments are dropped.
+func splitStatements(sql string) []string {
+	statements := []string{}
+	start := 0
+	hasCode := false
+	add := func(end int) {
+		if hasCode {
+			statements = append(statements, strings.TrimSpace(sql[start:end]))
+		}
+		hasCode = false
+	}
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			if end := strings.IndexByte(sql[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(sql)
+			}
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			depth := 0
+			for ; i < len(sql); i++ {
+				if strings.HasPrefix(sql[i:], "/*") {
+					depth++
+					i++
+				} else if strings.HasPrefix(sql[i:], "*/") {
+					depth--
+					i++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+		case c == '\'' || c == '"':
+			hasCode = true
+			escapes := c == '\'' && i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e')
+			for i++; i < len(sql); i++ {
+				if escapes && sql[i] == '\\' {
+					i++
+					continue
+				}
+				if sql[i] == c {
+					if i+1 < len(sql) && sql[i+1] == c {
+						i++
+						continue
+					}
+					break
+				}
+			}
+		case c == '$':
+			hasCode = true
+			if tag := dollarQuoteTag(sql[i:]); tag != "" {
+				if end := strings.Index(sql[i+len(tag):], tag); end >= 0 {
+					i += len(tag) + end + len(tag) - 1
+				} else {
+					i = len(sql)
+				}
+			}
+		case c == ';':
+			add(i)
+			start = i + 1
+		case c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			hasCode = true
+		}
+	}
+	add(len(sql))
+	return statements
+}
+
+// dollarQuoteTag returns the dollar quote tag (like "$$" or "$body$") that sql starts with, or an
+// empty string if it doesn't start with one.
+func dollarQuoteTag(sql string) string {
+	for i := 1; i < len(sql); i++ {
+		c := sql[i]
+		if c == '$' {
+			return sql[:i+1]
+		}
+		isLetter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+		if !isLetter && (i == 1 || c < '0' || c > '9') {
+			return ""
+		}
+	}
+	return ""
+}
+
+// transactionStatements returns the statements in a migration's SQL files, leaving out the ones
+// that begin or commit a transaction, so they can be run inside a transaction of our own.
+func transactionStatements(sqls []string) []string {
+	statements := []string{}
+	for _, sql := range sqls {
+		for _, stmt := range splitStatements(sql) {
+			if !isTransactionControl(stmt) {
+				statements = append(statements, stmt)
+			}
+		}
+	}
+	return statements
+}
+
+// isTransactionControl reports whether a statement begins or commits a transaction.
+func isTransactionControl(stmt string) bool {
+	words := strings.Fields(statementHead(stmt))
+	if len(words) == 0 {
+		return false
+	}
+	switch words[0] {
+	case "BEGIN", "COMMIT", "END":
+		return true
+	case "START":
+		return len(words) > 1 && words[1] == "TRANSACTION"
+	}
+	return false
+}
+
+// nonTransactionalPrefixes are the starts of statements that Postgres refuses to run inside a
+// transaction block.
+var nonTransactionalPrefixes = []string{
+	"CREATE INDEX CONCURRENTLY",
+	"CREATE UNIQUE INDEX CONCURRENTLY",
+	"DROP INDEX CONCURRENTLY",
+	"REINDEX",
+	"VACUUM",
+	"CREATE DATABASE",
+	"DROP DATABASE",
+	"ALTER SYSTEM",
+	"CREATE TABLESPACE",
+	"DROP TABLESPACE",
+}
+
+// nonTransactionalReason explains why a migration's SQL files can't be run inside a single
+// transaction, or returns an empty string if they can.
+func nonTransactionalReason(sqls []string) string {
+	if len(sqls) > 1 {
+		return "multi-file migrations run each file separately"
+	}
+	for _, sql := range sqls {
+		for _, stmt := range splitStatements(sql) {
+			head := statementHead(stmt)
+			for _, prefix := range nonTransactionalPrefixes {
+				if strings.HasPrefix(head, prefix) && (prefix != "REINDEX" || strings.Contains(head, " CONCURRENTLY")) {
+					return prefix + " can't run inside a transaction"
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// migrationStateStatement returns the first statement in sqls that inserts into, updates, or
+// deletes from migration_state, or an empty string if there is none.
+func migrationStateStatement(sqls []string) string {
+	for _, sql := range sqls {
+		for _, stmt := range splitStatements(sql) {
+			if strings.TrimPrefix(changedTable(stmt), "PUBLIC.") == "MIGRATION_STATE" {
+				return stmt
+			}
+		}
+	}
+	return ""
+}
+
+// dataStatement returns the first statement in sqls that inserts into, updates, deletes from, or
+// copies into a table other than pomegranate's own, or an empty string if there is none.
+func dataStatement(sqls []string) string {
+	bookkeeping := map[string]bool{}
+	for _, name := range bookkeepingTables {
+		bookkeeping[strings.ToUpper(strings.TrimPrefix(name, "public."))] = true
+	}
+	for _, sql := range sqls {
+		for _, stmt := range splitStatements(sql) {
+			table := changedTable(stmt)
+			if table != "" && !bookkeeping[strings.TrimPrefix(table, "PUBLIC.")] {
+				return stmt
+			}
+		}
+	}
+	return ""
+}
+
+// changedTable returns the table that stmt inserts into, updates, deletes from, or copies into, in
+// upper case, or an empty string if it does none of those.
+func changedTable(stmt string) string {
+	head := statementHead(stmt)
+	words := strings.Fields(strings.NewReplacer("(", " ").Replace(head))
+	switch {
+	case len(words) > 2 && (words[0] == "INSERT" && words[1] == "INTO" || words[0] == "DELETE" && words[1] == "FROM"):
+		return words[2]
+	case len(words) > 1 && words[0] == "UPDATE":
+		return words[1]
+	case len(words) > 1 && words[0] == "COPY" && strings.Contains(head, " FROM "):
+		return words[1]
+	}
+	return ""
+}
+
+// statementHead returns a statement with its leading comments removed, its whitespace collapsed
+// to single spaces, and in upper case, for matching against keywords.
+func statementHead(stmt string) string {
+	for {
+		stmt = strings.TrimSpace(stmt)
+		if strings.HasPrefix(stmt, "--") {
+			end := strings.IndexByte(stmt, '\n')
+			if end < 0 {
+				return ""
+			}
+			stmt = stmt[end+1:]
+			continue
+		}
+		if strings.HasPrefix(stmt, "/*") {
+			depth := 0
+			i := 0
+			for ; i < len(stmt); i++ {
+				if strings.HasPrefix(stmt[i:], "/*") {
+					depth++
+					i++
+				} else if strings.HasPrefix(stmt[i:], "*/") {
+					depth--
+					i++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if i >= len(stmt) {
+				return ""
+			}
+			stmt = stmt[i+1:]
+			continue
+		}
+		return strings.ToUpper(strings.Join(strings.Fields(stmt), " "))
+	}
+}
+
+// sqlChecksum returns a hex encoded SHA-256 digest of a list of SQL strings.  Each string is
+// terminated with a NUL byte so that splitting the same SQL differently changes the result.
+func sqlChecksum(sqls []string) string {
+	h := sha256.New()
+	for _, sql := range sqls {
+		h.Write([]byte(sql))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 func panicOnError(err error, message string, args ...interface{}) {
 	if err != nil {
 		panic(fmt.Errorf(message, args...))
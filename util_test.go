@@ -3,6 +3,7 @@ package pomegranate
 import (
 	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
 
@@ -32,7 +33,7 @@ func TestConfirm(t *testing.T) {
 		},
 	}
 	for _, tc := range tt {
-		err := getConfirm(goodMigrations, "", strings.NewReader(tc.input))
+		err := getConfirm(goodMigrations, "", io.Discard, strings.NewReader(tc.input))
 		assert.Equal(t, tc.err, err)
 	}
 }
@@ -269,3 +270,456 @@ func Test_panicOnError(t *testing.T) {
 		})
 	}
 }
+
+func TestGetMigrationsToReverseStored(t *testing.T) {
+	tt := []struct {
+		desc        string
+		name        string
+		statenames  []string
+		staticnames []string
+		storednames []string
+		out         []string
+		err         error
+	}{
+		{
+			desc:        "all from source",
+			name:        "b",
+			statenames:  []string{"a", "b", "c"},
+			staticnames: []string{"a", "b", "c"},
+			storednames: []string{},
+			out:         []string{"c", "b"},
+			err:         nil,
+		},
+		{
+			desc:        "newer migrations from stored",
+			name:        "b",
+			statenames:  []string{"a", "b", "c", "d"},
+			staticnames: []string{"a", "b"},
+			storednames: []string{"c", "d"},
+			out:         []string{"d", "c", "b"},
+			err:         nil,
+		},
+		{
+			desc:        "neither source nor stored",
+			name:        "b",
+			statenames:  []string{"a", "b", "c", "d"},
+			staticnames: []string{"a", "b"},
+			storednames: []string{"d"},
+			out:         nil,
+			err:         errors.New("migration c is in state, but has neither source nor stored backward SQL"),
+		},
+		{
+			desc:        "not in state",
+			name:        "e",
+			statenames:  []string{"a", "b"},
+			staticnames: []string{"a", "b"},
+			storednames: []string{"a", "b"},
+			out:         nil,
+			err:         errors.New("migration e not in state"),
+		},
+	}
+	for _, tc := range tt {
+		state := namesToState(tc.statenames)
+		migs := namesToMigs(tc.staticnames)
+		stored := []StoredMigration{}
+		for _, name := range tc.storednames {
+			stored = append(stored, StoredMigration{Name: name, Checksum: sqlChecksum(nil)})
+		}
+		out, err := getMigrationsToReverseStored(tc.name, state, migs, stored)
+		assert.Equal(t, tc.out, migsToNames(out), tc.desc)
+		assert.Equal(t, tc.err, err, tc.desc)
+	}
+}
+
+func TestGetMigrationsToReverseStoredSquashed(t *testing.T) {
+	migs := []Migration{
+		{Name: "b_squashed", ForwardSQL: []string{"-- pmg:replaces a b\n"}},
+		{Name: "c"},
+	}
+	state := namesToState([]string{"a", "b", "c"})
+	out, err := getMigrationsToReverseStored("b_squashed", state, migs, []StoredMigration{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c", "b_squashed"}, migsToNames(out))
+}
+
+func TestSQLChecksum(t *testing.T) {
+	assert.Equal(t, sqlChecksum([]string{"a", "b"}), sqlChecksum([]string{"a", "b"}))
+	assert.NotEqual(t, sqlChecksum([]string{"ab"}), sqlChecksum([]string{"a", "b"}))
+	assert.NotEqual(t, sqlChecksum([]string{"a"}), sqlChecksum([]string{"b"}))
+}
+
+func TestGetSyncMigrations(t *testing.T) {
+	tt := []struct {
+		desc        string
+		statenames  []string
+		staticnames []string
+		storednames []string
+		backward    []string
+		forward     []string
+		err         error
+	}{
+		{
+			desc:        "in sync",
+			statenames:  []string{"a", "b"},
+			staticnames: []string{"a", "b"},
+			backward:    []string{},
+			forward:     []string{},
+		},
+		{
+			desc:        "behind",
+			statenames:  []string{"a"},
+			staticnames: []string{"a", "b", "c"},
+			backward:    []string{},
+			forward:     []string{"b", "c"},
+		},
+		{
+			desc:        "ahead",
+			statenames:  []string{"a", "b", "c"},
+			staticnames: []string{"a"},
+			storednames: []string{"b", "c"},
+			backward:    []string{"c", "b"},
+			forward:     []string{},
+		},
+		{
+			desc:        "ahead without stored sql",
+			statenames:  []string{"a", "b", "c"},
+			staticnames: []string{"a"},
+			storednames: []string{"c"},
+			err:         errors.New("migration b is in state, but has neither source nor stored backward SQL"),
+		},
+		{
+			desc:        "diverged",
+			statenames:  []string{"a", "b"},
+			staticnames: []string{"a", "c"},
+			storednames: []string{"b"},
+			err:         errors.New("histories have diverged: migration 2 from state (b) does not match name from static list (c)"),
+		},
+	}
+	for _, tc := range tt {
+		stored := []StoredMigration{}
+		for _, name := range tc.storednames {
+			stored = append(stored, StoredMigration{Name: name})
+		}
+		backward, forward, err := getSyncMigrations(namesToState(tc.statenames), namesToMigs(tc.staticnames), stored)
+		assert.Equal(t, tc.err, err, tc.desc)
+		assert.Equal(t, tc.backward, migsToNames(backward), tc.desc)
+		assert.Equal(t, tc.forward, migsToNames(forward), tc.desc)
+	}
+}
+
+func TestVerifyPlan(t *testing.T) {
+	identity := DatabaseIdentity{Name: "db", Host: "10.0.0.1", Port: 5432}
+	migs := []Migration{
+		{Name: "a", ForwardSQL: []string{"a forward"}, BackwardSQL: []string{"a backward"}},
+		{Name: "b", ForwardSQL: []string{"b forward"}, BackwardSQL: []string{"b backward"}},
+		{Name: "c", ForwardSQL: []string{"c forward"}, BackwardSQL: []string{"c backward"}},
+	}
+	state := namesToState([]string{"a"})
+	plan := makePlan(identity, state, migs[1:])
+
+	changed := append([]Migration{}, migs...)
+	changed[2] = Migration{Name: "c", ForwardSQL: []string{"c forward, edited"}, BackwardSQL: []string{"c backward"}}
+
+	tampered := makePlan(identity, state, migs[1:])
+	tampered.Migrations[0].ForwardSQL = []string{"DROP TABLE users;"}
+
+	tt := []struct {
+		desc     string
+		plan     Plan
+		identity DatabaseIdentity
+		state    []MigrationRecord
+		migs     []Migration
+		toRun    []string
+		err      error
+	}{
+		{
+			desc:     "unchanged",
+			plan:     plan,
+			identity: identity,
+			state:    state,
+			migs:     migs,
+			toRun:    []string{"b", "c"},
+		},
+		{
+			desc:     "different database",
+			plan:     plan,
+			identity: DatabaseIdentity{Name: "other", Host: "10.0.0.1", Port: 5432},
+			state:    state,
+			migs:     migs,
+			err:      errors.New("plan was made for database 'db' on 10.0.0.1:5432, not 'other' on 10.0.0.1:5432"),
+		},
+		{
+			desc:     "state moved on",
+			plan:     plan,
+			identity: identity,
+			state:    namesToState([]string{"a", "b"}),
+			migs:     migs,
+			err:      errors.New("migration state has 2 entries, but plan was made with 1"),
+		},
+		{
+			desc:     "source changed",
+			plan:     plan,
+			identity: identity,
+			state:    state,
+			migs:     changed,
+			err:      errors.New("source for c has changed since plan was made"),
+		},
+		{
+			desc:     "plan tampered with",
+			plan:     tampered,
+			identity: identity,
+			state:    state,
+			migs:     migs,
+			err:      errors.New("SQL for b in plan does not match its checksum"),
+		},
+	}
+	for _, tc := range tt {
+		toRun, err := verifyPlan(tc.plan, tc.identity, tc.state, tc.migs)
+		assert.Equal(t, tc.err, err, tc.desc)
+		assert.Equal(t, tc.toRun, migsToNames(toRun), tc.desc)
+	}
+}
+
+func TestGetMigrationRange(t *testing.T) {
+	tt := []struct {
+		desc string
+		from string
+		to   string
+		out  []string
+		err  error
+	}{
+		{desc: "everything", out: []string{"a", "b", "c", "d"}},
+		{desc: "from", from: "b", out: []string{"b", "c", "d"}},
+		{desc: "to", to: "c", out: []string{"a", "b", "c"}},
+		{desc: "from and to", from: "b", to: "c", out: []string{"b", "c"}},
+		{desc: "single", from: "c", to: "c", out: []string{"c"}},
+		{desc: "unknown from", from: "banana", err: errors.New("migration banana not found")},
+		{desc: "to before from", from: "c", to: "b", err: errors.New("migration b not found after c")},
+	}
+	for _, tc := range tt {
+		out, err := getMigrationRange(tc.from, tc.to, namesToMigs([]string{"a", "b", "c", "d"}))
+		assert.Equal(t, tc.err, err, tc.desc)
+		assert.Equal(t, tc.out, migsToNames(out), tc.desc)
+	}
+}
+
+func TestGetDirectives(t *testing.T) {
+	sqls := []string{
+		"BEGIN;\n-- pmg:replaces 00001_init 00002_foo\n  -- pmg:replaces 00003_bar\nCOMMIT;\n",
+		"-- pmg:replacesall nope\n-- pmg:other value\n-- not a directive\n",
+	}
+	assert.Equal(t, []string{"00001_init 00002_foo", "00003_bar"}, getDirectives("replaces", sqls))
+	assert.Equal(t, []string{"value"}, getDirectives("other", sqls))
+	assert.Equal(t, []string{}, getDirectives("missing", sqls))
+}
+
+func TestCollapseReplacedState(t *testing.T) {
+	squashed := Migration{
+		Name:       "c_squashed",
+		ForwardSQL: []string{"-- pmg:replaces a\n-- pmg:replaces b c\n"},
+	}
+	migs := []Migration{squashed, {Name: "d"}}
+	tt := []struct {
+		desc       string
+		statenames []string
+		out        []string
+		err        error
+	}{
+		{
+			desc:       "fresh database",
+			statenames: []string{},
+			out:        []string{},
+		},
+		{
+			desc:       "squashed migration recorded",
+			statenames: []string{"c_squashed", "d"},
+			out:        []string{"c_squashed", "d"},
+		},
+		{
+			desc:       "replaced migrations recorded",
+			statenames: []string{"a", "b", "c", "d"},
+			out:        []string{"c_squashed", "d"},
+		},
+		{
+			desc:       "some replaced migrations recorded",
+			statenames: []string{"a", "b"},
+			err:        errors.New("state has only 2 of the 3 migrations squashed into c_squashed; run the rest with a version from before the squash"),
+		},
+		{
+			desc:       "mismatched replaced migrations",
+			statenames: []string{"a", "banana", "c"},
+			err:        errors.New("migration 2 from state (banana) does not match migration squashed into c_squashed (b)"),
+		},
+	}
+	for _, tc := range tt {
+		out, err := CollapseReplacedState(namesToState(tc.statenames), migs)
+		assert.Equal(t, tc.err, err, tc.desc)
+		if tc.err == nil {
+			names := []string{}
+			for _, rec := range out {
+				names = append(names, rec.Name)
+			}
+			assert.Equal(t, tc.out, names, tc.desc)
+		}
+	}
+
+	toRun, err := getForwardMigrations(namesToState([]string{"a", "b", "c"}), migs)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d"}, migsToNames(toRun))
+}
+
+func TestFirstDifference(t *testing.T) {
+	_, _, _, differ := firstDifference("a\nb\n", "a\nb\n")
+	assert.False(t, differ)
+	line, a, b, differ := firstDifference("a\nb\nc\n", "a\nB\nc\n")
+	assert.True(t, differ)
+	assert.Equal(t, []interface{}{2, "b", "B"}, []interface{}{line, a, b})
+	line, a, b, differ = firstDifference("a\n", "a\nb")
+	assert.True(t, differ)
+	assert.Equal(t, []interface{}{2, "", "b"}, []interface{}{line, a, b})
+	line, a, b, differ = firstDifference("a", "a\nb")
+	assert.True(t, differ)
+	assert.Equal(t, []interface{}{2, "<end of file>", "b"}, []interface{}{line, a, b})
+}
+
+func TestDiffSchemas(t *testing.T) {
+	expected := Schema{
+		Tables: []Table{
+			{Name: "public.a", Columns: []Column{{Name: "id", Type: "integer"}, {Name: "name", Type: "text"}}},
+			{Name: "public.b", Columns: []Column{{Name: "id", Type: "integer"}}},
+		},
+		Indexes: []SchemaObject{
+			{Name: "public.a_name", Table: "public.a", Definition: "CREATE INDEX a_name ON public.a USING btree (name);"},
+		},
+		Grants: []SchemaObject{
+			{Name: "public.a SELECT TO app", Table: "public.a", Definition: "GRANT SELECT ON TABLE public.a TO app;"},
+		},
+	}
+	actual := Schema{
+		Tables: []Table{
+			{Name: "public.a", Columns: []Column{{Name: "id", Type: "bigint"}, {Name: "extra", Type: "text"}}},
+			{Name: "public.c", Columns: []Column{{Name: "id", Type: "integer"}}},
+		},
+		Indexes: []SchemaObject{
+			{Name: "public.a_name", Table: "public.a", Definition: "CREATE INDEX a_name ON public.a USING hash (name);"},
+		},
+		Grants: []SchemaObject{
+			{Name: "public.a SELECT TO app", Table: "public.a", Definition: "GRANT SELECT ON TABLE public.a TO app;"},
+		},
+	}
+	diffs := diffSchemas(expected, actual)
+	summary := []string{}
+	for _, d := range diffs {
+		summary = append(summary, fmt.Sprintf("%s %s %s", d.Kind, d.Name, d.Change))
+	}
+	assert.Equal(t, []string{
+		"table public.b missing",
+		"table public.c extra",
+		"column public.a.extra extra",
+		"column public.a.id changed",
+		"column public.a.name missing",
+		"index public.a_name changed",
+	}, summary)
+	assert.Equal(t, "id integer", diffs[3].Expected)
+	assert.Equal(t, "id bigint", diffs[3].Actual)
+	assert.Equal(t, []SchemaDiff{}, diffSchemas(expected, expected))
+}
+
+func TestSplitStatements(t *testing.T) {
+	tt := []struct {
+		desc string
+		sql  string
+		out  []string
+	}{
+		{
+			desc: "simple",
+			sql:  "SELECT 1; SELECT 2;\n",
+			out:  []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			desc: "no trailing semicolon",
+			sql:  "SELECT 1;\nSELECT 2",
+			out:  []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			desc: "quotes",
+			sql:  `SELECT 'a;b', 'it''s;', "weird;name", E'\';' FROM t; SELECT 2`,
+			out:  []string{`SELECT 'a;b', 'it''s;', "weird;name", E'\';' FROM t`, "SELECT 2"},
+		},
+		{
+			desc: "comments",
+			sql:  "-- leading; comment\nSELECT 1 /* block; /* nested; */ */; -- only a comment;\n",
+			out:  []string{"-- leading; comment\nSELECT 1 /* block; /* nested; */ */"},
+		},
+		{
+			desc: "dollar quotes",
+			sql:  "CREATE FUNCTION f() RETURNS int AS $body$ BEGIN RETURN 1; END; $body$ LANGUAGE plpgsql; SELECT $1, $$;$$",
+			out: []string{
+				"CREATE FUNCTION f() RETURNS int AS $body$ BEGIN RETURN 1; END; $body$ LANGUAGE plpgsql",
+				"SELECT $1, $$;$$",
+			},
+		},
+		{
+			desc: "empty",
+			sql:  " ;\n-- nothing\n",
+			out:  []string{},
+		},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.out, splitStatements(tc.sql), tc.desc)
+	}
+}
+
+func TestStatementHead(t *testing.T) {
+	assert.Equal(t, "CREATE INDEX CONCURRENTLY FOO", statementHead("-- why\n/* a /* nested */ comment */\n create  index\n\tconcurrently foo"))
+	assert.Equal(t, "", statementHead("-- only a comment"))
+	assert.Equal(t, "", statementHead("/* unterminated"))
+}
+
+func TestIsTransactionControl(t *testing.T) {
+	for stmt, want := range map[string]bool{
+		"BEGIN":                      true,
+		"begin transaction":          true,
+		"-- done\nCOMMIT":            true,
+		"END":                        true,
+		"START TRANSACTION":          true,
+		"ROLLBACK":                   false,
+		"CREATE TABLE beginnings ()": false,
+		"DO $$ BEGIN NULL; END $$":   false,
+	} {
+		assert.Equal(t, want, isTransactionControl(stmt), stmt)
+	}
+}
+
+func TestTransactionStatements(t *testing.T) {
+	mig := Migration{ForwardSQL: []string{"BEGIN;\nCREATE TABLE foo (id INT);\nINSERT INTO migration_state(name) VALUES ('x');\nCOMMIT;\n"}}
+	assert.Equal(t, []string{"CREATE TABLE foo (id INT)", "INSERT INTO migration_state(name) VALUES ('x')"}, transactionStatements(mig.ForwardSQL))
+}
+
+func TestRunStatus(t *testing.T) {
+	assert.Equal(t, "ok", runStatus(true, nil))
+	assert.Equal(t, "failed: boom", runStatus(true, errors.New("boom")))
+	assert.Equal(t, "not run", runStatus(false, nil))
+	// a run that was never started has no error to report
+	assert.Equal(t, "not run", runStatus(false, errors.New("boom")))
+}
+
+func TestDataStatement(t *testing.T) {
+	assert.Equal(t, "", dataStatement(goodMigrations[1].ForwardSQL))
+	assert.Equal(t, "", dataStatement(goodMigrations[1].BackwardSQL))
+	assert.Equal(t, "", dataStatement([]string{"COPY foo TO STDOUT;"}))
+	assert.Equal(t, "update public.foo set stuff = 'x'",
+		dataStatement([]string{"CREATE TABLE bar (id INT);\nupdate public.foo set stuff = 'x';"}))
+	assert.Equal(t, "COPY foo (stuff) FROM STDIN", dataStatement([]string{"COPY foo (stuff) FROM STDIN;"}))
+	assert.Equal(t, "DELETE FROM foo", dataStatement([]string{"DELETE FROM migration_skipped WHERE name = 'x'; DELETE FROM foo;"}))
+}
+
+func TestNonTransactionalReason(t *testing.T) {
+	assert.Equal(t, "", nonTransactionalReason(goodMigrations[1].ForwardSQL))
+	assert.Equal(t, "multi-file migrations run each file separately", nonTransactionalReason([]string{"SELECT 1", "SELECT 2"}))
+	assert.Equal(t, "CREATE INDEX CONCURRENTLY can't run inside a transaction",
+		nonTransactionalReason([]string{"create index concurrently foo_id on foo (id);"}))
+	assert.Equal(t, "", nonTransactionalReason([]string{"REINDEX TABLE foo;"}))
+	assert.Equal(t, "REINDEX can't run inside a transaction",
+		nonTransactionalReason([]string{"REINDEX TABLE CONCURRENTLY foo;"}))
+}